@@ -14,6 +14,8 @@ export interface TransportEvent {
     | 'room'
     | 'mute'
     | 'unmute'
+    | 'user_mute'
+    | 'user_unmute'
     | 'enqueue'
     | 'next_song';
 
@@ -183,12 +183,12 @@ const Conference = ({ roomId }: ConferenceProps) => {
         setUser(event.user);
       } else if (event.type === 'room') {
         store.update({ room: event.room });
-      } else if (event.type === 'mute') {
+      } else if (event.type === 'user_mute') {
         if (!event.user) {
           throw new Error('no user');
         }
         store.api.roomUserUpdate(event.user);
-      } else if (event.type === 'unmute') {
+      } else if (event.type === 'user_unmute') {
         if (!event.user) {
           throw new Error('no user');
         }
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/rtc"
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
 	"github.com/Nahemah1022/singsphere-voice-server/room"
@@ -16,7 +21,11 @@ import (
 	"github.com/joho/godotenv"
 )
 
-var roomManager *room.RoomManager
+var (
+	roomManager *room.RoomManager
+	// Verifies the tokens of users joining rooms, nil lets anyone join anonymously with AUTH_DISABLED=true
+	authenticator *auth.Authenticator
+)
 
 func main() {
 	err := godotenv.Load(".env")
@@ -24,6 +33,12 @@ func main() {
 		log.Fatalf("Error loading .env file")
 	}
 	roomManager = room.NewRoomManager()
+	// Without keys every websocket would be let in, so anonymous joins must be asked for with AUTH_DISABLED=true
+	if disabled, _ := strconv.ParseBool(os.Getenv("AUTH_DISABLED")); disabled {
+		log.Println("AUTH_DISABLED is set, users join anonymously")
+	} else if authenticator, err = auth.FromEnv(); err != nil {
+		log.Fatalf("fail to set up authentication, set AUTH_DISABLED=true to let users join anonymously: %v", err)
+	}
 	router := registerRouters()
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -48,7 +63,7 @@ func registerRouters() *mux.Router {
 	router.HandleFunc("/api/stats", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Add("Access-Control-Allow-Headers", "*")
 		w.Header().Add("Access-Control-Allow-Origin", "*")
-		bytes, err := json.Marshal(roomManager.GetStats())
+		bytes, err := json.Marshal(roomManager.GetStats(callerID(req)))
 		if err != nil {
 			http.Error(w, fmt.Sprint(err), 500)
 		}
@@ -62,22 +77,199 @@ func registerRouters() *mux.Router {
 		roomID := vars["id"]
 
 		r, err := roomManager.Get(roomID)
+		if err == room.ErrNotFound || !r.IsMember(callerID(req)) {
+			http.NotFound(w, req)
+			return
+		}
+
+		bytes, err := json.Marshal(r.Snapshot())
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.Write(bytes)
+	}).Methods("GET")
+
+	// Admins override the loudness songs of a room are normalized to, with {"target": <LUFS>}
+	router.HandleFunc("/api/rooms/{id}/loudness", func(w http.ResponseWriter, req *http.Request) {
+		if !isAdmin(req) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		r, err := roomManager.Get(mux.Vars(req)["id"])
 		if err == room.ErrNotFound {
 			http.NotFound(w, req)
 			return
 		}
+		var body struct {
+			Target *float64 `json:"target"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Target == nil {
+			http.Error(w, "expected a JSON body with a target", http.StatusBadRequest)
+			return
+		}
+		if err := r.SetLoudnessTarget(*body.Target); err != nil {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PUT")
+
+	// Recent chat messages of a room, oldest first, the last ?limit=<n> of them if given
+	router.HandleFunc("/api/rooms/{id}/chat", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		r, err := roomManager.Get(mux.Vars(req)["id"])
+		if err == room.ErrNotFound || !r.IsMember(callerID(req)) {
+			http.NotFound(w, req)
+			return
+		}
+		limit := 0
+		if value := req.URL.Query().Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		bytes, err := json.Marshal(r.ChatHistory(limit))
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.Write(bytes)
+	}).Methods("GET")
 
-		bytes, err := json.Marshal(r.Wrap())
+	router.HandleFunc("/api/rooms/{id}/recordings", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		r, err := roomManager.Get(mux.Vars(req)["id"])
+		if err == room.ErrNotFound || !r.IsMember(callerID(req)) {
+			http.NotFound(w, req)
+			return
+		}
+		recordings, err := r.Recordings()
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), http.StatusServiceUnavailable)
+			return
+		}
+		bytes, err := json.Marshal(recordings)
 		if err != nil {
 			http.Error(w, fmt.Sprint(err), 500)
 		}
 		w.Write(bytes)
 	}).Methods("GET")
 
+	// Admins start and stop recording a room, the recording is returned as JSON
+	router.HandleFunc("/api/rooms/{id}/recordings/{action:start|stop}", func(w http.ResponseWriter, req *http.Request) {
+		if !isAdmin(req) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		vars := mux.Vars(req)
+		r, err := roomManager.Get(vars["id"])
+		if err == room.ErrNotFound {
+			http.NotFound(w, req)
+			return
+		}
+		var info *socket.RecordingWrap
+		if vars["action"] == "start" {
+			info, err = r.StartRecording()
+		} else {
+			info, err = r.StopRecording()
+		}
+		if errors.Is(err, room.ErrRecordingUnavailable) {
+			http.Error(w, fmt.Sprint(err), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprint(err), http.StatusConflict)
+			return
+		}
+		bytes, err := json.Marshal(info)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.Write(bytes)
+	}).Methods("POST")
+
+	// Files of a take, e.g. /api/rooms/{id}/recordings/{recording}/001/mix.ogg
+	router.HandleFunc("/api/rooms/{id}/recordings/{recording}/{take}/{file}", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		vars := mux.Vars(req)
+		r, err := roomManager.Get(vars["id"])
+		if err == room.ErrNotFound || !r.IsMember(callerID(req)) {
+			http.NotFound(w, req)
+			return
+		}
+		path, err := r.RecordingPath(vars["recording"], vars["take"], vars["file"])
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeFile(w, req, path)
+	}).Methods("GET")
+
+	router.HandleFunc("/api/rooms/{id}/clips/{clipID}", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		vars := mux.Vars(req)
+		r, err := roomManager.Get(vars["id"])
+		if err == room.ErrNotFound || !r.IsMember(callerID(req)) {
+			http.NotFound(w, req)
+			return
+		}
+		path, err := r.ClipPath(vars["clipID"])
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/ogg")
+		http.ServeFile(w, req, path)
+	}).Methods("GET")
+
 	router.HandleFunc("/ws/{id}", func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 		roomID := vars["id"]
-		room := roomManager.GetOrCreate(roomID)
+
+		// Users are authenticated and admitted before anything is set up for them, so they can be told why they
+		// can't join through the websocket
+		query := req.URL.Query()
+		identity := auth.Anonymous()
+		if authenticator != nil {
+			var err error
+			identity, err = authenticator.Authenticate(auth.TokenFromRequest(req))
+			if err != nil {
+				log.Println(err)
+				if err := socket.Reject(w, req, socket.CloseUnauthorized, room.JoinError(err)); err != nil {
+					log.Println(err)
+				}
+				return
+			}
+		}
+		password := query.Get("password")
+		if err := room.ValidatePassword(password); err != nil {
+			if err := socket.Reject(w, req, socket.CloseRejected, room.JoinError(err)); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		// The first user of a room creates it, they may ask for the room to be mixed on the server with ?mode=mcu,
+		// and for it to be private with ?private=true, protected by the password if any. Others are admitted first,
+		// so rejected users never create rooms.
+		r, err := roomManager.Get(roomID)
+		if err == room.ErrNotFound {
+			private, _ := strconv.ParseBool(query.Get("private"))
+			r = roomManager.GetOrCreate(roomID, room.Options{
+				Mode:     query.Get("mode"),
+				Private:  private,
+				Password: password,
+				Creator:  identity.ID,
+			})
+		} else if err := r.Admit(identity.ID, room.Credentials{Password: password, Invite: query.Get("invite")}); err != nil {
+			log.Println(err)
+			if err := socket.Reject(w, req, socket.CloseRejected, room.JoinError(err)); err != nil {
+				log.Println(err)
+			}
+			return
+		}
 
 		// Establish websocket connection and inject it as external dependency to user
 		ws, err := socket.New(w, req, func() {
@@ -95,9 +287,28 @@ func registerRouters() *mux.Router {
 			return
 		}
 
-		newUser := user.New(room.UserJoinCh, room.UserLeaveCh, ws, rtcNode)
+		newUser := user.New(r.UserJoinCh, r.UserLeaveCh, r.UserRequestCh, ws, rtcNode, identity)
 		go newUser.Run()
 	})
 
 	return router
 }
+
+// callerID returns the id of the user a request authenticates, or an empty string
+func callerID(req *http.Request) string {
+	if authenticator == nil {
+		return ""
+	}
+	identity, err := authenticator.Authenticate(auth.TokenFromRequest(req))
+	if err != nil {
+		return ""
+	}
+	return identity.ID
+}
+
+// isAdmin tells whether the request carries the ADMIN_TOKEN as bearer token, admin routes are disabled without it
+func isAdmin(req *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	given, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return token != "" && found && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
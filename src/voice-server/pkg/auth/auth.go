@@ -0,0 +1,145 @@
+/*
+Package auth authenticates the users joining rooms with JSON Web Tokens. Tokens are signed either with a
+secret shared with the app issuing them (HS256, HS384 or HS512), or with the keys of a JSON Web Key Set
+published by an identity provider (RS*, PS* and ES* algorithms). The subject of a token identifies the user,
+other claims are passed along as they are for the user's profile.
+*/
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Longest user id taken from a token
+	maxSubjectLength = 128
+	// Clock difference tolerated between the server and the token issuer
+	leeway = 30 * time.Second
+)
+
+var (
+	ErrNoToken      = errors.New("authentication required")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrNoKeys       = errors.New("neither AUTH_SECRET nor AUTH_JWKS_URL is set")
+)
+
+// Identity is who a token was issued to, the claims besides the subject are optional and unchecked
+type Identity struct {
+	ID     string // subject of the token
+	Name   string // display name
+	Avatar string // URL of the avatar
+	Emoji  string
+	Color  string // preferred color
+}
+
+// Authenticator verifies tokens, it is safe for concurrent use
+type Authenticator struct {
+	secret []byte
+	keys   *KeySet
+	parser *jwt.Parser
+}
+
+// claims are the claims read from tokens, avatar falls back to the OpenID Connect picture
+type claims struct {
+	jwt.RegisteredClaims
+	Name    string `json:"name"`
+	Avatar  string `json:"avatar"`
+	Picture string `json:"picture"`
+	Emoji   string `json:"emoji"`
+	Color   string `json:"color"`
+}
+
+// New creates an authenticator accepting tokens signed with the given HMAC secret or the keys of the given set,
+// either may be nil. Tokens must come from the issuer and be meant for the audience when these aren't empty.
+func New(secret []byte, keys *KeySet, issuer string, audience string) (*Authenticator, error) {
+	if len(secret) == 0 && keys == nil {
+		return nil, ErrNoKeys
+	}
+	methods := []string{}
+	if len(secret) > 0 {
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	if keys != nil {
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512")
+	}
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithLeeway(leeway)}
+	if issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	return &Authenticator{
+		secret: secret,
+		keys:   keys,
+		parser: jwt.NewParser(options...),
+	}, nil
+}
+
+// FromEnv creates an authenticator from AUTH_SECRET and AUTH_JWKS_URL, along with the optional AUTH_ISSUER
+// and AUTH_AUDIENCE. It fails with ErrNoKeys if no key is configured.
+func FromEnv() (*Authenticator, error) {
+	var keys *KeySet
+	if jwksURL := os.Getenv("AUTH_JWKS_URL"); jwksURL != "" {
+		keys = NewKeySet(jwksURL)
+	}
+	return New([]byte(os.Getenv("AUTH_SECRET")), keys, os.Getenv("AUTH_ISSUER"), os.Getenv("AUTH_AUDIENCE"))
+}
+
+// Authenticate verifies a token, and returns the identity of its subject
+func (a *Authenticator) Authenticate(token string) (*Identity, error) {
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	var c claims
+	if _, err := a.parser.ParseWithClaims(token, &c, a.key); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if c.Subject == "" || len(c.Subject) > maxSubjectLength || !utf8.ValidString(c.Subject) {
+		return nil, fmt.Errorf("%w: invalid subject", ErrInvalidToken)
+	}
+	avatar := c.Avatar
+	if avatar == "" {
+		avatar = c.Picture
+	}
+	return &Identity{
+		ID:     c.Subject,
+		Name:   c.Name,
+		Avatar: avatar,
+		Emoji:  c.Emoji,
+		Color:  c.Color,
+	}, nil
+}
+
+// Anonymous returns a new identity for a user joining without a token
+func Anonymous() *Identity {
+	// generate random id based on timestamp
+	return &Identity{ID: strconv.FormatInt(time.Now().UnixNano(), 10)}
+}
+
+// key returns the key verifying the given token
+func (a *Authenticator) key(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return a.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	return a.keys.Key(kid)
+}
+
+// TokenFromRequest returns the bearer token of a request. Browsers can't set headers on websockets,
+// so the token may also be passed as the token query parameter.
+func TokenFromRequest(req *http.Request) string {
+	if token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return req.URL.Query().Get("token")
+}
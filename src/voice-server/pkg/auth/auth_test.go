@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testSecret = []byte("secret")
+
+// sign returns a token of the given claims signed with the given method and key
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newKeySet publishes the public part of the given RSA key under the given key id
+func newKeySet(t *testing.T, kid string, key *rsa.PrivateKey) *KeySet {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kid: kid,
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(server.Close)
+	return NewKeySet(server.URL)
+}
+
+func TestAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	valid := jwt.RegisteredClaims{
+		Subject:   "alice",
+		Issuer:    "issuer",
+		Audience:  jwt.ClaimStrings{"singsphere"},
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	// with returns the valid claims changed by the given function
+	with := func(change func(c *jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		c := valid
+		change(&c)
+		return c
+	}
+	rs256 := func(c *jwt.RegisteredClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+		token.Header["kid"] = "key"
+		signed, err := token.SignedString(rsaKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "HS256", token: sign(t, jwt.SigningMethodHS256, testSecret, valid)},
+		{name: "HS512", token: sign(t, jwt.SigningMethodHS512, testSecret, valid)},
+		{name: "RS256 from the key set", token: rs256(&valid)},
+		{
+			name:  "expired within the leeway",
+			token: sign(t, jwt.SigningMethodHS256, testSecret, with(func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-leeway / 2)) })),
+		},
+		{name: "no token", token: "", wantErr: ErrNoToken},
+		{name: "garbage", token: "not.a.token", wantErr: ErrInvalidToken},
+		{
+			name:    "expired",
+			token:   sign(t, jwt.SigningMethodHS256, testSecret, with(func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Hour)) })),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "not valid yet",
+			token:   sign(t, jwt.SigningMethodHS256, testSecret, with(func(c *jwt.RegisteredClaims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour)) })),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "wrong audience",
+			token:   sign(t, jwt.SigningMethodHS256, testSecret, with(func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"other"} })),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "wrong issuer",
+			token:   sign(t, jwt.SigningMethodHS256, testSecret, with(func(c *jwt.RegisteredClaims) { c.Issuer = "other" })),
+			wantErr: ErrInvalidToken,
+		},
+		{name: "wrong secret", token: sign(t, jwt.SigningMethodHS256, []byte("other"), valid), wantErr: ErrInvalidToken},
+		{name: "wrong key", token: sign(t, jwt.SigningMethodRS256, otherKey, valid), wantErr: ErrInvalidToken},
+		{name: "unsigned", token: sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid), wantErr: ErrInvalidToken},
+		{
+			name:    "no subject",
+			token:   sign(t, jwt.SigningMethodHS256, testSecret, with(func(c *jwt.RegisteredClaims) { c.Subject = "" })),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "subject too long",
+			token:   sign(t, jwt.SigningMethodHS256, testSecret, with(func(c *jwt.RegisteredClaims) { c.Subject = strings.Repeat("a", maxSubjectLength+1) })),
+			wantErr: ErrInvalidToken,
+		},
+	}
+	a, err := New(testSecret, newKeySet(t, "key", rsaKey), "issuer", "singsphere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := a.Authenticate(test.token)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && identity.ID != "alice" {
+				t.Errorf("Authenticate() = %q, want the subject %q", identity.ID, "alice")
+			}
+		})
+	}
+}
+
+func TestAuthenticateMethods(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.RegisteredClaims{Subject: "alice"}
+	hs256 := sign(t, jwt.SigningMethodHS256, testSecret, claims)
+	rs256 := sign(t, jwt.SigningMethodRS256, rsaKey, claims)
+	// The public key of the set used as an HMAC secret
+	confused := sign(t, jwt.SigningMethodHS256, rsaKey.PublicKey.N.Bytes(), claims)
+	tests := []struct {
+		name    string
+		secret  []byte
+		keys    bool
+		token   string
+		wantErr error
+	}{
+		{name: "HMAC with a secret", secret: testSecret, token: hs256},
+		{name: "HMAC without a secret", keys: true, token: hs256, wantErr: ErrInvalidToken},
+		{name: "HMAC keyed with the public key", keys: true, token: confused, wantErr: ErrInvalidToken},
+		{name: "RSA with a key set", keys: true, token: rs256},
+		{name: "RSA without a key set", secret: testSecret, token: rs256, wantErr: ErrInvalidToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var keys *KeySet
+			if test.keys {
+				keys = newKeySet(t, "", rsaKey)
+			}
+			a, err := New(test.secret, keys, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.Authenticate(test.token); !errors.Is(err, test.wantErr) {
+				t.Errorf("Authenticate() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+	if _, err := New(nil, nil, "", ""); !errors.Is(err, ErrNoKeys) {
+		t.Errorf("New() without keys error = %v, want %v", err, ErrNoKeys)
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		want   string
+	}{
+		{name: "header", header: "Bearer abc ", want: "abc"},
+		{name: "query", query: "?token=abc", want: "abc"},
+		{name: "header first", header: "Bearer abc", query: "?token=def", want: "abc"},
+		{name: "other scheme", header: "Basic abc", want: ""},
+		{name: "none", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ws"+test.query, nil)
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			if got := TokenFromRequest(req); got != test.want {
+				t.Errorf("TokenFromRequest() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateProfile(t *testing.T) {
+	// Claims are passed along as they are, the user's profile checks them
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   Identity
+	}{
+		{
+			name:   "profile",
+			claims: jwt.MapClaims{"name": " Alice ", "avatar": "https://example.com/a.png", "emoji": "🎤", "color": "#FF8800"},
+			want:   Identity{ID: "alice", Name: " Alice ", Avatar: "https://example.com/a.png", Emoji: "🎤", Color: "#FF8800"},
+		},
+		{
+			name:   "OpenID Connect picture",
+			claims: jwt.MapClaims{"picture": "https://example.com/p.png"},
+			want:   Identity{ID: "alice", Avatar: "https://example.com/p.png"},
+		},
+		{
+			name:   "avatar over picture",
+			claims: jwt.MapClaims{"avatar": "https://example.com/a.png", "picture": "https://example.com/p.png"},
+			want:   Identity{ID: "alice", Avatar: "https://example.com/a.png"},
+		},
+		{
+			name:   "unchecked",
+			claims: jwt.MapClaims{"avatar": "javascript:alert(1)", "color": "orange"},
+			want:   Identity{ID: "alice", Avatar: "javascript:alert(1)", Color: "orange"},
+		},
+	}
+	a, err := New(testSecret, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.claims["sub"] = "alice"
+			identity, err := a.Authenticate(sign(t, jwt.SigningMethodHS256, testSecret, test.claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *identity != test.want {
+				t.Errorf("Authenticate() = %+v, want %+v", *identity, test.want)
+			}
+		})
+	}
+}
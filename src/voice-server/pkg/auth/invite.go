@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Lifetime of invites unless another one is asked, and the longest allowed
+	DefaultInviteTTL = 24 * time.Hour
+	MaxInviteTTL     = 7 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidInvite = errors.New("invalid invite")
+	ErrInviteExpired = errors.New("this invite expired")
+)
+
+// Invite lets users join a private room without its password. Invites are signed so rooms needn't keep them,
+// only how many times each was used.
+type Invite struct {
+	ID        string
+	Room      string
+	ExpiresAt time.Time
+	Uses      int // how many users may join with it, unlimited if 0
+}
+
+// Invites issues and verifies invites, it is safe for concurrent use
+type Invites struct {
+	secret []byte
+}
+
+// inviteClaims are the claims of an invite token, the subject is the room
+type inviteClaims struct {
+	jwt.RegisteredClaims
+	Uses int `json:"uses,omitempty"`
+}
+
+// NewInvites creates invites signed with the given secret
+func NewInvites(secret []byte) *Invites {
+	return &Invites{secret: secret}
+}
+
+// InvitesFromEnv creates invites signed with INVITE_SECRET.
+// Without it, a random secret is used and invites become invalid when the server restarts.
+func InvitesFromEnv() (*Invites, error) {
+	secret := []byte(os.Getenv("INVITE_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return NewInvites(secret), nil
+}
+
+// Issue creates an invite to the given room, valid for the given duration and number of uses
+func (inv *Invites) Issue(room string, ttl time.Duration, uses int) (string, *Invite, error) {
+	if ttl <= 0 || ttl > MaxInviteTTL {
+		return "", nil, fmt.Errorf("%w: it may last up to %v", ErrInvalidInvite, MaxInviteTTL)
+	}
+	if uses < 0 {
+		return "", nil, fmt.Errorf("%w: negative number of uses", ErrInvalidInvite)
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	invite := &Invite{
+		ID:        hex.EncodeToString(random),
+		Room:      room,
+		ExpiresAt: now.Add(ttl).Truncate(time.Second),
+		Uses:      uses,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &inviteClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        invite.ID,
+			Subject:   room,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(invite.ExpiresAt),
+		},
+		Uses: uses,
+	}).SignedString(inv.secret)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, invite, nil
+}
+
+// Verify checks that a token is a valid invite to the given room, and returns it
+func (inv *Invites) Verify(token string, room string) (*Invite, error) {
+	var c inviteClaims
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired(), jwt.WithSubject(room))
+	_, err := parser.ParseWithClaims(token, &c, func(*jwt.Token) (interface{}, error) {
+		return inv.secret, nil
+	})
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrInviteExpired
+	}
+	if err != nil || c.ID == "" {
+		return nil, ErrInvalidInvite
+	}
+	return &Invite{
+		ID:        c.ID,
+		Room:      c.Subject,
+		ExpiresAt: c.ExpiresAt.Time,
+		Uses:      c.Uses,
+	}, nil
+}
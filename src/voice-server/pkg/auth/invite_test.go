@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestInvitesVerify(t *testing.T) {
+	invites := NewInvites([]byte("invite secret"))
+	token, issued, err := invites.Issue("room", time.Hour, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// forged returns an invite to the room signed by hand with the given method and secret
+	forged := func(method jwt.SigningMethod, secret []byte, claims inviteClaims) string {
+		claims.Subject = "room"
+		signed, err := jwt.NewWithClaims(method, &claims).SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	valid := jwt.RegisteredClaims{ID: "id", ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour))}
+	tests := []struct {
+		name    string
+		token   string
+		room    string
+		wantErr error
+	}{
+		{name: "issued", token: token, room: "room"},
+		{name: "other room", token: token, room: "other", wantErr: ErrInvalidInvite},
+		{name: "garbage", token: "invite", room: "room", wantErr: ErrInvalidInvite},
+		{
+			name:    "expired",
+			token:   forged(jwt.SigningMethodHS256, invites.secret, inviteClaims{RegisteredClaims: jwt.RegisteredClaims{ID: "id", ExpiresAt: jwt.NewNumericDate(now.Add(-time.Minute))}}),
+			room:    "room",
+			wantErr: ErrInviteExpired,
+		},
+		{
+			name:    "wrong secret",
+			token:   forged(jwt.SigningMethodHS256, []byte("other secret"), inviteClaims{RegisteredClaims: valid}),
+			room:    "room",
+			wantErr: ErrInvalidInvite,
+		},
+		{
+			name:    "wrong algorithm",
+			token:   forged(jwt.SigningMethodHS512, invites.secret, inviteClaims{RegisteredClaims: valid}),
+			room:    "room",
+			wantErr: ErrInvalidInvite,
+		},
+		{
+			name:    "no expiration",
+			token:   forged(jwt.SigningMethodHS256, invites.secret, inviteClaims{RegisteredClaims: jwt.RegisteredClaims{ID: "id"}}),
+			room:    "room",
+			wantErr: ErrInvalidInvite,
+		},
+		{
+			name:    "no id",
+			token:   forged(jwt.SigningMethodHS256, invites.secret, inviteClaims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: valid.ExpiresAt}}),
+			room:    "room",
+			wantErr: ErrInvalidInvite,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			invite, err := invites.Verify(test.token, test.room)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && *invite != *issued {
+				t.Errorf("Verify() = %+v, want %+v", *invite, *issued)
+			}
+		})
+	}
+}
+
+func TestInvitesIssue(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		uses    int
+		wantErr error
+	}{
+		{name: "longest", ttl: MaxInviteTTL, uses: 0},
+		{name: "single use", ttl: time.Minute, uses: 1},
+		{name: "no duration", ttl: 0, wantErr: ErrInvalidInvite},
+		{name: "too long", ttl: MaxInviteTTL + time.Second, wantErr: ErrInvalidInvite},
+		{name: "negative uses", ttl: time.Minute, uses: -1, wantErr: ErrInvalidInvite},
+	}
+	invites := NewInvites([]byte("invite secret"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, invite, err := invites.Issue("room", test.ttl, test.uses)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Issue() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && (invite.Room != "room" || invite.Uses != test.uses) {
+				t.Errorf("Issue() = %+v, want an invite to %q for %d uses", *invite, "room", test.uses)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Keys are fetched again after this long, so rotated keys are picked up
+	jwksRefreshPeriod = time.Hour
+	// A token signed with an unknown key fetches the set again, at most this often
+	jwksMinRefreshPeriod = time.Minute
+	jwksTimeout          = 10 * time.Second
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeySet holds the public keys of a JSON Web Key Set fetched from a URL, it is safe for concurrent use
+type KeySet struct {
+	url       string
+	client    *http.Client
+	lock      sync.Mutex
+	keys      map[string]crypto.PublicKey // keyed by key id
+	fetchedAt time.Time
+}
+
+// jwk is a JSON Web Key, only the fields of RSA and EC public keys are read
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewKeySet creates a key set fetched from the given URL, keys are fetched with the first token
+func NewKeySet(url string) *KeySet {
+	return &KeySet{
+		url:    url,
+		client: &http.Client{Timeout: jwksTimeout},
+		keys:   make(map[string]crypto.PublicKey),
+	}
+}
+
+// Key returns the key with the given id, an empty id matches the only key of a set holding a single one
+func (ks *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	key, found := ks.lookup(kid)
+	stale := time.Since(ks.fetchedAt) > jwksRefreshPeriod
+	if (!found && time.Since(ks.fetchedAt) > jwksMinRefreshPeriod) || stale {
+		if err := ks.fetch(); err != nil {
+			// Keys fetched before stay valid while the provider is unreachable
+			if !found {
+				return nil, err
+			}
+			return key, nil
+		}
+		key, found = ks.lookup(kid)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	return key, nil
+}
+
+// lookup returns the key with the given id, the lock must be held
+func (ks *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, found := ks.keys[kid]
+	return key, found
+}
+
+// fetch replaces the keys with the ones currently published, the lock must be held
+func (ks *KeySet) fetch() error {
+	// Failed fetches count too, so an unreachable provider isn't hammered
+	ks.fetchedAt = time.Now()
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return fmt.Errorf("fail to fetch key set: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fail to fetch key set: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("fail to decode key set: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped, the set may hold keys for other uses
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	ks.keys = keys
+	return nil
+}
+
+// publicKey decodes an RSA or EC public key
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,90 @@
+/*
+Package codec decodes and encodes Opus audio for the parts of the server which process
+samples instead of forwarding packets. It links against libopus, so it is only compiled in
+with the "opus" build tag, along with "nolibopusfile" since the Ogg helpers of the binding are
+unused; without it every constructor returns ErrUnavailable. The Dockerfile and the Makefile
+build with both tags.
+*/
+package codec
+
+import "errors"
+
+const (
+	SampleRate = 48000
+	Channels   = 2
+	// FrameSamples is the number of samples per channel in the 20 ms frames produced by encoders
+	FrameSamples = SampleRate / 50
+	// MaxFrameSamples is the number of samples per channel of the longest possible Opus packet, 120 ms
+	MaxFrameSamples = SampleRate * 120 / 1000
+	// MaxPacketSize bounds the size of an encoded packet
+	MaxPacketSize = 4000
+)
+
+// SilentFrame is a 20 ms CELT packet decoding to silence, it stands in for audio which mustn't be heard
+var SilentFrame = []byte{0xF8, 0xFF, 0xFE}
+
+// Samples per channel of the CELT frame sizes, longest first, along with the configuration of their TOC byte
+var celtFrames = []struct {
+	samples uint64
+	config  byte
+}{{960, 31}, {480, 30}, {240, 29}, {120, 28}}
+
+// Silence returns a CELT packet decoding to the given number of samples per channel of silence, so it can
+// replace a packet of any duration. Durations which aren't a multiple of 2.5 ms, or longer than 120 ms,
+// get SilentFrame.
+func Silence(samples uint64) []byte {
+	if samples == 0 || samples > MaxFrameSamples {
+		return SilentFrame
+	}
+	for _, frame := range celtFrames {
+		if samples%frame.samples != 0 {
+			continue
+		}
+		// The payload of the silent frames is the range coder's silence flag, whatever their size
+		count := samples / frame.samples
+		if count == 1 {
+			return []byte{frame.config << 3, 0xFF, 0xFE}
+		}
+		// Code 3 packet of count frames of the same size, see RFC 6716 section 3.2.5
+		packet := []byte{frame.config<<3 | 3, byte(count)}
+		for i := uint64(0); i < count; i++ {
+			packet = append(packet, 0xFF, 0xFE)
+		}
+		return packet
+	}
+	return SilentFrame
+}
+
+var (
+	ErrUnavailable = errors.New("opus codec unavailable, the server was built without the opus tag")
+	ErrBadPacket   = errors.New("invalid opus packet")
+)
+
+// PacketSamples computes the number of 48 kHz samples per channel in an Opus packet from its TOC byte,
+// see RFC 6716 section 3.1. It doesn't need libopus.
+func PacketSamples(packet []byte) (uint64, error) {
+	if len(packet) == 0 {
+		return 0, ErrBadPacket
+	}
+	config := packet[0] >> 3
+	var frameSamples int
+	switch {
+	case config < 12: // SILK-only: 10, 20, 40, 60 ms
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10, 20 ms
+		frameSamples = []int{480, 960}[config%2]
+	default: // CELT-only: 2.5, 5, 10, 20 ms
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, ErrBadPacket
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+	return uint64(frameSamples * frames), nil
+}
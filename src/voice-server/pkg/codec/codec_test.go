@@ -0,0 +1,70 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketSamples(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   uint64
+	}{
+		{name: "SILK 10 ms", packet: []byte{0 << 3}, want: 480},
+		{name: "SILK 60 ms", packet: []byte{3 << 3}, want: 2880},
+		{name: "hybrid 20 ms", packet: []byte{13 << 3}, want: 960},
+		{name: "CELT 2.5 ms", packet: []byte{28 << 3}, want: 120},
+		{name: "CELT 20 ms", packet: SilentFrame, want: 960},
+		{name: "two frames", packet: []byte{31<<3 | 1}, want: 1920},
+		{name: "two frames of different sizes", packet: []byte{30<<3 | 2}, want: 960},
+		{name: "arbitrary number of frames", packet: []byte{31<<3 | 3, 3}, want: 2880},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := PacketSamples(test.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("PacketSamples(%x) = %d, want %d", test.packet, got, test.want)
+			}
+		})
+	}
+	for _, packet := range [][]byte{nil, {31<<3 | 3}} {
+		if _, err := PacketSamples(packet); err != ErrBadPacket {
+			t.Errorf("PacketSamples(%x) error = %v, want %v", packet, err, ErrBadPacket)
+		}
+	}
+}
+
+func TestSilence(t *testing.T) {
+	tests := []struct {
+		samples uint64
+		want    uint64 // samples of the packet, the ones asked for unless CELT can't hold them
+	}{
+		{samples: 120, want: 120},
+		{samples: 480, want: 480},
+		{samples: 960, want: 960},
+		{samples: 1920, want: 1920},
+		{samples: 2880, want: 2880},
+		{samples: 5760, want: 5760},
+		{samples: 720, want: 720},
+		{samples: 100, want: 960},
+		{samples: 0, want: 960},
+		{samples: 6720, want: 960},
+	}
+	for _, test := range tests {
+		packet := Silence(test.samples)
+		got, err := PacketSamples(packet)
+		if err != nil {
+			t.Fatalf("Silence(%d) = %x: %v", test.samples, packet, err)
+		}
+		if got != test.want {
+			t.Errorf("Silence(%d) = %x lasting %d samples, want %d", test.samples, packet, got, test.want)
+		}
+	}
+	if packet := Silence(960); !bytes.Equal(packet, SilentFrame) {
+		t.Errorf("Silence(960) = %x, want %x", packet, SilentFrame)
+	}
+}
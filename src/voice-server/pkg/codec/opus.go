@@ -0,0 +1,54 @@
+//go:build opus
+
+package codec
+
+import (
+	"gopkg.in/hraban/opus.v2"
+)
+
+// Decoder decodes Opus packets into interleaved 16-bit stereo PCM
+type Decoder struct {
+	dec *opus.Decoder
+}
+
+// Encoder encodes interleaved 16-bit stereo PCM into Opus packets
+type Encoder struct {
+	enc *opus.Encoder
+}
+
+const Available = true
+
+func NewDecoder() (*Decoder, error) {
+	dec, err := opus.NewDecoder(SampleRate, Channels)
+	if err != nil {
+		return nil, err
+	}
+	return &Decoder{dec: dec}, nil
+}
+
+// Decode decodes the packet into pcm, and returns the number of samples per channel
+func (d *Decoder) Decode(packet []byte, pcm []int16) (int, error) {
+	return d.dec.Decode(packet, pcm)
+}
+
+// NewEncoder creates an encoder tuned for music at the given bitrate in bits per second
+func NewEncoder(bitrate int) (*Encoder, error) {
+	enc, err := opus.NewEncoder(SampleRate, Channels, opus.AppAudio)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.SetBitrate(bitrate); err != nil {
+		return nil, err
+	}
+	return &Encoder{enc: enc}, nil
+}
+
+// Encode encodes a whole frame of pcm, and returns the encoded packet
+func (e *Encoder) Encode(pcm []int16) ([]byte, error) {
+	packet := make([]byte, MaxPacketSize)
+	n, err := e.enc.Encode(pcm, packet)
+	if err != nil {
+		return nil, err
+	}
+	return packet[:n], nil
+}
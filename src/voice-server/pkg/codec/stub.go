@@ -0,0 +1,27 @@
+//go:build !opus
+
+package codec
+
+// Decoder is unavailable without the opus build tag
+type Decoder struct{}
+
+// Encoder is unavailable without the opus build tag
+type Encoder struct{}
+
+const Available = false
+
+func NewDecoder() (*Decoder, error) {
+	return nil, ErrUnavailable
+}
+
+func (d *Decoder) Decode(packet []byte, pcm []int16) (int, error) {
+	return 0, ErrUnavailable
+}
+
+func NewEncoder(bitrate int) (*Encoder, error) {
+	return nil, ErrUnavailable
+}
+
+func (e *Encoder) Encode(pcm []int16) ([]byte, error) {
+	return nil, ErrUnavailable
+}
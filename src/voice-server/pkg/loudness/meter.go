@@ -0,0 +1,145 @@
+/*
+This meter.go measures the integrated loudness of audio as specified by ITU-R BS.1770 and EBU R128:
+the audio is K-weighted, cut in overlapping 400 ms blocks, and blocks are gated before being averaged.
+*/
+package loudness
+
+import "math"
+
+const (
+	blockSubdivisions = 4      // 400 ms blocks made of 100 ms steps, so blocks overlap by 75%
+	absoluteGate      = -70.0  // LUFS
+	relativeGate      = -10.0  // LU below the loudness of the blocks above the absolute gate
+	silence           = -200.0 // LUFS reported for audio without any block above the gates
+)
+
+// biquad is a second order IIR filter in direct form I
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the pre-filter and the RLB filter of BS.1770, whose coefficients are given for 48 kHz
+func kWeighting() [2]biquad {
+	return [2]biquad{
+		{b0: 1.53512485958697, b1: -2.69169618940638, b2: 1.19839281085285, a1: -1.69065929318241, a2: 0.73248077421585},
+		{b0: 1, b1: -2, b2: 1, a1: -1.99004745483398, a2: 0.99007225036621},
+	}
+}
+
+// Meter measures the integrated loudness and the sample peak of 48 kHz interleaved PCM
+type Meter struct {
+	channels   int
+	filters    [][2]biquad // K-weighting filters of every channel
+	stepLen    int         // samples per channel in a 100 ms step
+	stepFill   int
+	stepEnergy float64
+	steps      []float64 // mean square of the last steps, to build the current block
+	blocks     []float64 // mean square of every block
+	peak       float64
+}
+
+// NewMeter creates a meter for 48 kHz audio with the given number of interleaved channels
+func NewMeter(channels int) *Meter {
+	filters := make([][2]biquad, channels)
+	for i := range filters {
+		filters[i] = kWeighting()
+	}
+	return &Meter{
+		channels: channels,
+		filters:  filters,
+		stepLen:  48000 / 10,
+	}
+}
+
+// Write feeds interleaved samples to the meter
+func (m *Meter) Write(pcm []int16) {
+	for i := 0; i+m.channels <= len(pcm); i += m.channels {
+		for c := 0; c < m.channels; c++ {
+			x := float64(pcm[i+c]) / 32768
+			if abs := math.Abs(x); abs > m.peak {
+				m.peak = abs
+			}
+			y := m.filters[c][0].process(x)
+			y = m.filters[c][1].process(y)
+			m.stepEnergy += y * y
+		}
+		m.stepFill++
+		if m.stepFill == m.stepLen {
+			m.endStep()
+		}
+	}
+}
+
+func (m *Meter) endStep() {
+	m.steps = append(m.steps, m.stepEnergy/float64(m.stepLen))
+	m.stepEnergy, m.stepFill = 0, 0
+	if len(m.steps) < blockSubdivisions {
+		return
+	}
+	m.steps = m.steps[len(m.steps)-blockSubdivisions:]
+	block := 0.0
+	for _, step := range m.steps {
+		block += step
+	}
+	m.blocks = append(m.blocks, block/blockSubdivisions)
+}
+
+// Integrated returns the gated loudness of all the audio written so far, in LUFS
+func (m *Meter) Integrated() float64 {
+	gated := func(threshold float64) (float64, int) {
+		sum, n := 0.0, 0
+		for _, block := range m.blocks {
+			if energyToLoudness(block) > threshold {
+				sum += block
+				n++
+			}
+		}
+		return sum, n
+	}
+	sum, n := gated(absoluteGate)
+	if n == 0 {
+		return silence
+	}
+	sum, n = gated(energyToLoudness(sum/float64(n)) + relativeGate)
+	if n == 0 {
+		return silence
+	}
+	return energyToLoudness(sum / float64(n))
+}
+
+// Peak returns the highest absolute sample value written so far, 1 being full scale
+func (m *Meter) Peak() float64 {
+	return m.peak
+}
+
+func energyToLoudness(energy float64) float64 {
+	if energy <= 0 {
+		return math.Inf(-1)
+	}
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// Gain returns the gain in dB bringing audio of the given loudness to the target loudness.
+// The gain is lowered if needed so the given peak doesn't clip.
+func Gain(loudness float64, peak float64, target float64) float64 {
+	gain := target - loudness
+	if peak > 0 {
+		if headroom := -20 * math.Log10(peak); gain > headroom {
+			gain = headroom
+		}
+	}
+	return gain
+}
+
+// DBToLinear converts a gain in dB into a linear factor
+func DBToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
+}
@@ -0,0 +1,285 @@
+/*
+Package mixer mixes the audio of a room on the server, as an alternative to forwarding every mic to
+every user. Mics and the backing track are decoded into buffers, and every 20 ms each listener gets
+one frame mixing all of them except its own mic, encoded on a single downstream track.
+*/
+package mixer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	frameLen      = codec.FrameSamples * codec.Channels
+	frameDuration = codec.FrameSamples * time.Second / codec.SampleRate
+	// Inputs only start being mixed once this much audio is buffered, to absorb network jitter
+	prebuffer = 3 * frameLen
+	// Inputs falling that far behind drop their oldest audio, so the delay never builds up
+	maxBuffered = 25 * frameLen
+	// Bitrate of the mix sent to every listener
+	mixBitrate = 96000
+	// The backing track is played a bit quieter than the voices, so singers stay on top of it
+	musicGain = 0.8
+	// Frames kept by every input, bounding the delays used to align singers with the music
+	maxLag = 25
+)
+
+var ErrListenerExists = errors.New("listener already added to the mixer")
+
+// input is the decoded audio of a mic or of the backing track, waiting to be mixed
+type input struct {
+	dec    *codec.Decoder
+	pcm    []int16 // decoding buffer
+	buf    []int16 // decoded samples not mixed yet
+	primed bool
+	frame  []int16   // samples taken for the current frame
+	past   [][]int16 // frames mixed lately, newest last, nil for silence
+	lag    int       // frames by which the input is delayed when mixed
+}
+
+func newInput() (*input, error) {
+	dec, err := codec.NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return &input{
+		dec:   dec,
+		pcm:   make([]int16, codec.MaxFrameSamples*codec.Channels),
+		frame: make([]int16, frameLen),
+	}, nil
+}
+
+func (in *input) write(packet []byte) error {
+	n, err := in.dec.Decode(packet, in.pcm)
+	if err != nil {
+		return err
+	}
+	in.buf = append(in.buf, in.pcm[:n*codec.Channels]...)
+	if len(in.buf) > maxBuffered {
+		in.buf = in.buf[len(in.buf)-maxBuffered:]
+	}
+	return nil
+}
+
+// take moves the samples of the next frame into in.frame, filling the missing ones with silence.
+// It returns false if the input has nothing to mix for this frame.
+func (in *input) take() bool {
+	if !in.primed && len(in.buf) < prebuffer {
+		return false
+	}
+	in.primed = true
+	n := copy(in.frame, in.buf)
+	for i := n; i < frameLen; i++ {
+		in.frame[i] = 0
+	}
+	in.buf = in.buf[n:]
+	if n < frameLen {
+		// The input ran dry, buffer again before mixing it
+		in.primed = false
+	}
+	return n > 0
+}
+
+// advance takes the next frame, and keeps it for later mixing
+func (in *input) advance() {
+	var frame []int16
+	if in.take() {
+		frame = append([]int16(nil), in.frame...)
+	}
+	in.past = append(in.past, frame)
+	if len(in.past) > maxLag+1 {
+		in.past = in.past[1:]
+	}
+}
+
+// at returns the frame taken lag frames ago, or nil if it was silent
+func (in *input) at(lag int) []int16 {
+	if lag >= len(in.past) {
+		return nil
+	}
+	return in.past[len(in.past)-1-lag]
+}
+
+// output is the downstream track of a listener
+type output struct {
+	track    *webrtc.TrackLocalStaticSample
+	enc      *codec.Encoder
+	mix      []int16
+	musicLag int // frames by which the music is delayed for this listener
+}
+
+// Mixer mixes mics and the backing track of a room for each of its listeners
+type Mixer struct {
+	lock    sync.Mutex
+	mics    map[string]*input // keyed by user id
+	music   *input
+	outputs map[string]*output // keyed by user id
+	sum     []int32            // voices of the current frame
+}
+
+// New creates a mixer, it fails with codec.ErrUnavailable if the server can't decode audio
+func New() (*Mixer, error) {
+	music, err := newInput()
+	if err != nil {
+		return nil, err
+	}
+	return &Mixer{
+		mics:    make(map[string]*input),
+		music:   music,
+		outputs: make(map[string]*output),
+		sum:     make([]int32, frameLen),
+	}, nil
+}
+
+// AddListener creates the track on which the given user receives the mix
+func (m *Mixer) AddListener(id string) (*webrtc.TrackLocalStaticSample, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exist := m.outputs[id]; exist {
+		return nil, ErrListenerExists
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "mix", "mixer-"+id)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := codec.NewEncoder(mixBitrate)
+	if err != nil {
+		return nil, err
+	}
+	m.outputs[id] = &output{
+		track: track,
+		enc:   enc,
+		mix:   make([]int16, frameLen),
+	}
+	return track, nil
+}
+
+// RemoveListener stops mixing for the given user, and drops its mic
+func (m *Mixer) RemoveListener(id string) {
+	m.lock.Lock()
+	delete(m.outputs, id)
+	delete(m.mics, id)
+	m.lock.Unlock()
+}
+
+// WriteMic feeds an Opus packet received from the given user's mic, packets of users who left are dropped
+func (m *Mixer) WriteMic(id string, packet []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, listening := m.outputs[id]; !listening {
+		return nil
+	}
+	mic, exist := m.mics[id]
+	if !exist {
+		var err error
+		if mic, err = newInput(); err != nil {
+			return err
+		}
+		m.mics[id] = mic
+	}
+	return mic.write(packet)
+}
+
+// WriteSample feeds an Opus sample of the backing track, so a hub can play into the mixer
+func (m *Mixer) WriteSample(sample media.Sample) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.music.write(sample.Data)
+}
+
+// Run mixes a frame every 20 ms until ctx is done
+func (m *Mixer) Run(ctx context.Context) {
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.mixFrame()
+		}
+	}
+}
+
+// SetDelays aligns the given user with the others: the music it hears is delayed by musicDelay,
+// and its voice is delayed by voiceDelay before being mixed for the others. Delays are rounded to frames.
+func (m *Mixer) SetDelays(id string, musicDelay time.Duration, voiceDelay time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if out, exist := m.outputs[id]; exist {
+		out.musicLag = delayToLag(musicDelay)
+	}
+	if mic, exist := m.mics[id]; exist {
+		mic.lag = delayToLag(voiceDelay)
+	}
+}
+
+func delayToLag(delay time.Duration) int {
+	lag := int((delay + frameDuration/2) / frameDuration)
+	if lag < 0 {
+		return 0
+	} else if lag > maxLag {
+		return maxLag
+	}
+	return lag
+}
+
+// mixFrame sums the voices once, then sends each listener the sum minus its own voice, plus the music
+func (m *Mixer) mixFrame() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := range m.sum {
+		m.sum[i] = 0
+	}
+	m.music.advance()
+	for _, mic := range m.mics {
+		mic.advance()
+		if frame := mic.at(mic.lag); frame != nil {
+			for i, sample := range frame {
+				m.sum[i] += int32(sample)
+			}
+		}
+	}
+	// Frames are sent even when silent, so the timestamps of the tracks keep following the clock
+	for id, out := range m.outputs {
+		var own []int16
+		if mic, exist := m.mics[id]; exist {
+			own = mic.at(mic.lag)
+		}
+		music := m.music.at(out.musicLag)
+		for i, sample := range m.sum {
+			if own != nil {
+				sample -= int32(own[i])
+			}
+			if music != nil {
+				sample += int32(float64(music[i]) * musicGain)
+			}
+			out.mix[i] = clamp(sample)
+		}
+		packet, err := out.enc.Encode(out.mix)
+		if err != nil {
+			log.Printf("mixer: fail to encode the mix of %s: %v\n", id, err)
+			continue
+		}
+		if err := out.track.WriteSample(media.Sample{Data: packet, Duration: frameDuration}); err != nil {
+			log.Printf("mixer: fail to send the mix to %s: %v\n", id, err)
+		}
+	}
+}
+
+func clamp(sample int32) int16 {
+	if sample > 32767 {
+		return 32767
+	} else if sample < -32768 {
+		return -32768
+	}
+	return int16(sample)
+}
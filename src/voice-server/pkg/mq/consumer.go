@@ -1,6 +1,7 @@
 package mq
 
 import (
+	"errors"
 	"log"
 	"os"
 	"strings"
@@ -11,11 +12,16 @@ import (
 type Consumer struct {
 	queue     amqp.Queue
 	channel   *amqp.Channel
-	requestCh chan string
+	requestCh chan<- string
 }
 
-// New creates a new consumer in the RabbitMQ instance
-func New(topic string, conn *amqp.Connection) (*Consumer, error) {
+var ErrNoConnection = errors.New("not connected to RabbitMQ")
+
+// New creates a new consumer in the RabbitMQ instance, consumed song names are pushed to requestCh
+func New(topic string, conn *amqp.Connection, requestCh chan<- string) (*Consumer, error) {
+	if conn == nil {
+		return nil, ErrNoConnection
+	}
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, err
@@ -36,7 +42,7 @@ func New(topic string, conn *amqp.Connection) (*Consumer, error) {
 	consumer := &Consumer{
 		queue:     q,
 		channel:   ch,
-		requestCh: make(chan string),
+		requestCh: requestCh,
 	}
 	consumer.subscribe(topic)
 	return consumer, nil
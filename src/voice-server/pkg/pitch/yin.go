@@ -0,0 +1,105 @@
+/*
+Package pitch estimates the fundamental frequency of monophonic audio such as a voice, with the YIN
+algorithm of de Cheveigné and Kawahara.
+*/
+package pitch
+
+import "math"
+
+const (
+	// Range of frequencies searched, covering singing voices
+	MinFrequency = 60.0
+	MaxFrequency = 1100.0
+	// Highest normalized difference accepted as periodic, lower is stricter
+	yinThreshold = 0.15
+	// Frames quieter than this RMS, 1 being full scale, are considered unvoiced
+	silenceRMS = 0.01
+)
+
+// Detector estimates the pitch of frames of samples, it reuses its buffers so it isn't safe for concurrent use
+type Detector struct {
+	sampleRate float64
+	minLag     int
+	maxLag     int
+	diff       []float64
+}
+
+// NewDetector creates a detector for audio at the given sample rate.
+// Frames passed to Detect must hold at least FrameSize samples.
+func NewDetector(sampleRate float64) *Detector {
+	minLag := int(sampleRate / MaxFrequency)
+	maxLag := int(math.Ceil(sampleRate / MinFrequency))
+	return &Detector{
+		sampleRate: sampleRate,
+		minLag:     minLag,
+		maxLag:     maxLag,
+		diff:       make([]float64, maxLag+2),
+	}
+}
+
+// FrameSize returns the fewest samples a frame needs, for the lowest frequency to repeat twice
+func (d *Detector) FrameSize() int {
+	return 2 * (d.maxLag + 1)
+}
+
+// Detect returns the fundamental frequency of the frame in Hz, or false if the frame is silent or unvoiced
+func (d *Detector) Detect(frame []float64) (float64, bool) {
+	if len(frame) < d.FrameSize() {
+		return 0, false
+	}
+	var energy float64
+	for _, s := range frame {
+		energy += s * s
+	}
+	if math.Sqrt(energy/float64(len(frame))) < silenceRMS {
+		return 0, false
+	}
+
+	// Difference function, then cumulative mean normalized difference
+	window := len(frame) - d.maxLag - 1
+	d.diff[0] = 1
+	var sum float64
+	for lag := 1; lag <= d.maxLag+1; lag++ {
+		var diff float64
+		for i := 0; i < window; i++ {
+			delta := frame[i] - frame[i+lag]
+			diff += delta * delta
+		}
+		sum += diff
+		if sum == 0 {
+			d.diff[lag] = 1
+		} else {
+			d.diff[lag] = diff * float64(lag) / sum
+		}
+	}
+
+	// First dip under the threshold, followed down to its local minimum
+	lag := -1
+	for l := d.minLag; l <= d.maxLag; l++ {
+		if d.diff[l] < yinThreshold {
+			for l+1 <= d.maxLag && d.diff[l+1] < d.diff[l] {
+				l++
+			}
+			lag = l
+			break
+		}
+	}
+	if lag < 0 {
+		return 0, false
+	}
+
+	// Parabolic interpolation around the minimum for a sub-sample period
+	period := float64(lag)
+	if lag > 0 && lag < d.maxLag+1 {
+		prev, cur, next := d.diff[lag-1], d.diff[lag], d.diff[lag+1]
+		if denom := prev - 2*cur + next; denom != 0 {
+			period += (prev - next) / (2 * denom)
+		}
+	}
+	return d.sampleRate / period, true
+}
+
+// FrequencyToMIDI converts a frequency in Hz into a fractional MIDI note number, A4 at 440 Hz is 69
+func FrequencyToMIDI(frequency float64) float64 {
+	return 69 + 12*math.Log2(frequency/440)
+}
@@ -0,0 +1,191 @@
+package recorder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	clipsDir = "clips"
+	// Name of the music in a ring, mics are named after their users
+	ringMusic = ""
+)
+
+var (
+	ErrNothingToClip      = errors.New("nothing was heard recently")
+	ErrMixdownUnavailable = errors.New("clips can't be mixed down without ffmpeg")
+)
+
+// Ring keeps the last packets of the music and of every mic of a room, so recent moments can be clipped.
+// It is safe for concurrent use.
+type Ring struct {
+	length  time.Duration
+	lock    sync.Mutex
+	sources map[string][]timedPacket // keyed by user id, ringMusic for the music
+	mics    micClock
+}
+
+// timedPacket is an Opus packet along with when it is due
+type timedPacket struct {
+	data []byte
+	at   time.Time
+}
+
+// NewRing creates a ring keeping the given duration of audio
+func NewRing(length time.Duration) *Ring {
+	return &Ring{
+		length:  length,
+		sources: make(map[string][]timedPacket),
+		mics:    newMicClock(),
+	}
+}
+
+// Length returns how much audio this ring keeps
+func (ring *Ring) Length() time.Duration {
+	return ring.length
+}
+
+// WriteMusic keeps a sample of the music due to play at the given time
+func (ring *Ring) WriteMusic(sample media.Sample, at time.Time) {
+	if len(sample.Data) == 0 {
+		return
+	}
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	ring.push(ringMusic, sample.Data, at)
+}
+
+// WriteMic keeps an RTP packet of the given user's mic, anchor is called until it places a packet of the user exactly
+func (ring *Ring) WriteMic(userID string, packet *rtp.Packet, anchor Anchor) {
+	if len(packet.Payload) == 0 || !validName(userID) {
+		return
+	}
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	ring.push(userID, packet.Payload, ring.mics.at(userID, packet, anchor))
+}
+
+// push appends a packet to a source and drops the packets which fell out of the ring, the lock must be held
+func (ring *Ring) push(source string, data []byte, at time.Time) {
+	packets := append(ring.sources[source], timedPacket{data: append([]byte{}, data...), at: at})
+	oldest := at.Add(-ring.length)
+	i := sort.Search(len(packets), func(i int) bool {
+		return !packets[i].at.Before(oldest)
+	})
+	// Reslicing lets append reallocate a smaller array once the current one is full
+	ring.sources[source] = packets[i:]
+}
+
+// snapshot copies the packets due within [from, to) of every source, sources which went quiet are dropped
+func (ring *Ring) snapshot(from time.Time, to time.Time) map[string][]timedPacket {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	snapshot := make(map[string][]timedPacket)
+	for source, packets := range ring.sources {
+		if len(packets) == 0 || packets[len(packets)-1].at.Before(to.Add(-ring.length)) {
+			delete(ring.sources, source)
+			delete(ring.mics, source)
+			continue
+		}
+		window := []timedPacket{}
+		for _, p := range packets {
+			if !p.at.Before(from) && p.at.Before(to) {
+				window = append(window, p)
+			}
+		}
+		if len(window) > 0 {
+			snapshot[source] = window
+		}
+	}
+	return snapshot
+}
+
+// Clip writes the last given duration of the ring into a single Ogg Opus file, and returns its id
+func (rec *Recorder) Clip(ctx context.Context, room string, ring *Ring, length time.Duration) (string, error) {
+	if !validName(room) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidName, room)
+	}
+	if length <= 0 || length > ring.length {
+		length = ring.length
+	}
+	to := time.Now()
+	from := to.Add(-length)
+	sources := ring.snapshot(from, to)
+	if len(sources) == 0 {
+		return "", ErrNothingToClip
+	}
+	if len(sources) > 1 && rec.ffmpeg == "" {
+		return "", ErrMixdownUnavailable
+	}
+	dir := filepath.Join(rec.dir, room, clipsDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(random)
+
+	// Every source is written to its own file first, all starting at the beginning of the clip
+	work, err := os.MkdirTemp(dir, id+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(work)
+	inputs := []string{}
+	var serial uint32
+	for source, packets := range sources {
+		serial++
+		input := filepath.Join(work, fmt.Sprintf("%d.ogg", serial))
+		if err := writeClipTrack(input, serial, from, packets); err != nil {
+			return "", fmt.Errorf("fail to write clip of %q: %w", source, err)
+		}
+		inputs = append(inputs, input)
+	}
+	output := filepath.Join(dir, id+".ogg")
+	if len(inputs) == 1 {
+		return id, os.Rename(inputs[0], output)
+	}
+	if err := mixFiles(ctx, rec.ffmpeg, inputs, output); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// writeClipTrack writes the packets of a source into an Ogg Opus file starting at the given time
+func writeClipTrack(path string, serial uint32, start time.Time, packets []timedPacket) error {
+	writer, err := newOggWriter(path, serial)
+	if err != nil {
+		return err
+	}
+	t := &track{writer: writer, start: start}
+	for _, p := range packets {
+		if err := t.write(p.data, p.at); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// ClipPath returns the path of a clip of the given room
+func (rec *Recorder) ClipPath(room string, id string) (string, error) {
+	for _, name := range []string{room, id} {
+		if !validName(name) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+		}
+	}
+	return filepath.Join(rec.dir, room, clipsDir, id+".ogg"), nil
+}
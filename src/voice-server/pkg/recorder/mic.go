@@ -0,0 +1,43 @@
+package recorder
+
+import (
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/pion/rtp"
+)
+
+// Anchor returns when the packet of a mic with the given RTP timestamp is due by the server's clock, and whether
+// the time comes from the mic's RTCP sender reports rather than from an estimate
+type Anchor func(timestamp uint32) (time.Time, bool)
+
+// micClock places the packets of mics on the server's clock, relative to an anchor by their RTP timestamps.
+// Sender reports only come a few seconds after a mic starts, so the first packet of a user is anchored with an
+// estimate, and the mic is anchored again once a report places a packet exactly. It isn't safe for concurrent use.
+type micClock map[string]*micAnchor // keyed by user id
+
+// micAnchor maps the RTP timestamps of a mic to the server's clock
+type micAnchor struct {
+	timestamp uint32
+	at        time.Time
+	exact     bool // whether the anchor comes from a sender report
+}
+
+func newMicClock() micClock {
+	return make(micClock)
+}
+
+// at returns when the given packet of the user's mic is due
+func (c micClock) at(userID string, packet *rtp.Packet, anchor Anchor) time.Time {
+	a, exist := c[userID]
+	if !exist || !a.exact {
+		at, exact := anchor(packet.Timestamp)
+		if !exist || exact {
+			a = &micAnchor{timestamp: packet.Timestamp, at: at, exact: exact}
+			c[userID] = a
+		}
+	}
+	// Signed difference, so timestamps wrapping around keep counting forward
+	elapsed := time.Duration(int32(packet.Timestamp-a.timestamp)) * time.Second / codec.SampleRate
+	return a.at.Add(elapsed)
+}
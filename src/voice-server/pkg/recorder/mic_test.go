@@ -0,0 +1,53 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestMicClock(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Anchors of the packets by timestamp, the estimate is 100 ms late until a sender report comes
+	estimated := func(timestamp uint32) (time.Time, bool) {
+		return base.Add(100 * time.Millisecond), false
+	}
+	reported := func(timestamp uint32) (time.Time, bool) {
+		return base.Add(time.Duration(timestamp-1000) * time.Second / 48000), true
+	}
+	tests := []struct {
+		timestamp uint32
+		anchor    Anchor
+		want      time.Duration // after base
+	}{
+		{timestamp: 1000, anchor: estimated, want: 100 * time.Millisecond},
+		{timestamp: 1960, anchor: estimated, want: 120 * time.Millisecond},
+		// The first report anchors the mic again
+		{timestamp: 2920, anchor: reported, want: 40 * time.Millisecond},
+		// Later estimates no longer move it
+		{timestamp: 3880, anchor: estimated, want: 60 * time.Millisecond},
+		{timestamp: 4840, anchor: reported, want: 80 * time.Millisecond},
+	}
+	clock := newMicClock()
+	for _, test := range tests {
+		got := clock.at("user", &rtp.Packet{Header: rtp.Header{Timestamp: test.timestamp}}, test.anchor)
+		if want := base.Add(test.want); !got.Equal(want) {
+			t.Errorf("packet %d due at %v, want %v", test.timestamp, got.Sub(base), test.want)
+		}
+	}
+}
+
+func TestMicClockWrapAround(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	anchor := func(timestamp uint32) (time.Time, bool) {
+		return base, true
+	}
+	clock := newMicClock()
+	clock.at("user", &rtp.Packet{Header: rtp.Header{Timestamp: 0xFFFFFF00}}, anchor)
+	// 960 samples later
+	got := clock.at("user", &rtp.Packet{Header: rtp.Header{Timestamp: 704}}, anchor)
+	if want := base.Add(20 * time.Millisecond); !got.Equal(want) {
+		t.Errorf("packet after the wrap around due at %v, want %v", got.Sub(base), 20*time.Millisecond)
+	}
+}
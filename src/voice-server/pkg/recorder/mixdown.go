@@ -0,0 +1,47 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Bitrate of mixdowns, they hold several voices and the music
+const mixBitrate = "128k"
+
+// mixFiles mixes the given Ogg Opus files into a single one with ffmpeg. The inputs are summed without
+// normalization so every track keeps its level.
+func mixFiles(ctx context.Context, ffmpeg string, inputs []string, output string) error {
+	if len(inputs) == 0 {
+		return errors.New("nothing to mix down")
+	}
+	partial := output + ".part"
+	defer os.Remove(partial)
+	args := []string{"-hide_banner", "-nostdin", "-nostats", "-y"}
+	for _, input := range inputs {
+		args = append(args, "-i", input)
+	}
+	args = append(args,
+		"-filter_complex", fmt.Sprintf("amix=inputs=%d:duration=longest:normalize=0", len(inputs)),
+		"-c:a", "libopus", "-b:a", mixBitrate, "-ar", "48000",
+		"-f", "ogg", partial,
+	)
+	out, err := exec.CommandContext(ctx, ffmpeg, args...).CombinedOutput()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return ErrMixdownUnavailable
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(lines) > 5 {
+			lines = lines[len(lines)-5:]
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.Join(lines, "; "))
+	}
+	return os.Rename(partial, output)
+}
@@ -0,0 +1,130 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+)
+
+const (
+	oggFlagFirst = 0x02
+	oggFlagLast  = 0x04
+	// Channels declared in the identification header, mono packets are valid in a stereo stream
+	oggChannels = 2
+)
+
+// oggCRCTable is the lookup table of the Ogg checksum, a CRC-32 with polynomial 0x04c11db7 without reflection
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// oggWriter writes Opus packets into an Ogg file, one packet per page. The last page is held back until
+// the next packet or Close, so it can be flagged as the end of the stream.
+type oggWriter struct {
+	file           *os.File
+	buf            *bufio.Writer
+	serial         uint32
+	sequence       uint32
+	granule        uint64
+	pending        []byte // packet of the last page, not written yet
+	pendingGranule uint64
+}
+
+func newOggWriter(path string, serial uint32) (*oggWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &oggWriter{
+		file:   file,
+		buf:    bufio.NewWriter(file),
+		serial: serial,
+	}
+	if err := w.writeHeaders(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// writeHeaders writes the identification and comment headers, each on its own page as RFC 7845 requires
+func (w *oggWriter) writeHeaders() error {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = oggChannels
+	binary.LittleEndian.PutUint32(head[12:], 48000)
+	if err := w.writePage(head, 0, oggFlagFirst); err != nil {
+		return err
+	}
+	vendor := "singsphere"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	return w.writePage(tags, 0, 0)
+}
+
+// writePacket appends a packet lasting the given number of 48 kHz samples
+func (w *oggWriter) writePacket(packet []byte, samples uint64) error {
+	if w.pending != nil {
+		if err := w.writePage(w.pending, w.pendingGranule, 0); err != nil {
+			return err
+		}
+	}
+	w.granule += samples
+	w.pending = append(w.pending[:0], packet...)
+	w.pendingGranule = w.granule
+	return nil
+}
+
+func (w *oggWriter) writePage(packet []byte, granule uint64, flags byte) error {
+	segments := len(packet)/255 + 1
+	page := make([]byte, 27+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.sequence)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = byte(len(packet) % 255)
+	copy(page[27+segments:], packet)
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+	w.sequence++
+	_, err := w.buf.Write(page)
+	return err
+}
+
+// Close writes the last page flagged as the end of the stream
+func (w *oggWriter) Close() error {
+	var err error
+	if w.pending != nil {
+		err = w.writePage(w.pending, w.pendingGranule, oggFlagLast)
+	}
+	if flushErr := w.buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,425 @@
+/*
+Package recorder records the performances of rooms to disk. Every mic and the backing track are written to
+their own Ogg Opus file, and all files of a take start at the same instant, with silence filling the gaps,
+so they stay aligned when played together. A take ends with each song, its tracks are then mixed down into
+a single file.
+*/
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	metadataFile = "recording.json"
+	musicFile    = "music.ogg"
+	mixFile      = "mix.ogg"
+	// Gaps shorter than this are left alone, the audio of a track is delayed by them instead
+	gapTolerance = 200 * time.Millisecond
+	// Longest mixdown before it is given up
+	mixdownTimeout = 10 * time.Minute
+)
+
+var (
+	ErrInvalidName = errors.New("invalid recording name")
+	ErrStopped     = errors.New("recording already stopped")
+)
+
+// Recorder creates recordings under a directory, one subdirectory per room
+type Recorder struct {
+	dir    string
+	ffmpeg string // path of ffmpeg, which mixes takes down, empty if unavailable
+}
+
+// Info describes a recording, it is stored next to its files
+type Info struct {
+	ID        string      `json:"id"`
+	Room      string      `json:"room"`
+	StartedAt time.Time   `json:"started_at"`
+	StoppedAt *time.Time  `json:"stopped_at,omitempty"` // nil while recording
+	Takes     []*TakeInfo `json:"takes"`
+}
+
+// TakeInfo describes a take of a recording, usually a single song
+type TakeInfo struct {
+	Name      string     `json:"name"`
+	Song      string     `json:"song,omitempty"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"` // nil while recording
+	Files     []string   `json:"files"`
+	Mix       string     `json:"mix,omitempty"` // file of the mixdown, empty until it is done
+}
+
+// New creates a recorder writing into dir, mixing takes down with the given ffmpeg. Takes aren't mixed down
+// if ffmpeg is empty.
+func New(dir string, ffmpeg string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir, ffmpeg: ffmpeg}, nil
+}
+
+// FromEnv creates a recorder writing into RECORDINGS_DIR, or a directory under the system temp dir
+func FromEnv() (*Recorder, error) {
+	dir := os.Getenv("RECORDINGS_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "singsphere-recordings")
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		log.Printf("recordings won't be mixed down: %v\n", err)
+		ffmpeg = ""
+	}
+	return New(dir, ffmpeg)
+}
+
+// validName tells whether name can be used as a single path element
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// Start starts recording the given room, its first take begins right away
+func (rec *Recorder) Start(room string) (*Recording, error) {
+	if !validName(room) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, room)
+	}
+	roomDir := filepath.Join(rec.dir, room)
+	if err := os.MkdirAll(roomDir, 0o755); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	id := now.UTC().Format("20060102-150405")
+	// Recordings started within the same second get a suffix
+	for i := 2; ; i++ {
+		err := os.Mkdir(filepath.Join(roomDir, id), 0o755)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		id = fmt.Sprintf("%s-%d", now.UTC().Format("20060102-150405"), i)
+	}
+	r := &Recording{
+		recorder: rec,
+		dir:      filepath.Join(roomDir, id),
+		info:     &Info{ID: id, Room: room, StartedAt: now, Takes: []*TakeInfo{}},
+		mics:     newMicClock(),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.openTake(now); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// List returns the recordings of the given room, most recent first
+func (rec *Recorder) List(room string) ([]*Info, error) {
+	if !validName(room) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, room)
+	}
+	entries, err := os.ReadDir(filepath.Join(rec.dir, room))
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Info{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	infos := []*Info{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(rec.dir, room, entry.Name(), metadataFile))
+		if err != nil {
+			continue
+		}
+		var info Info
+		if err := json.Unmarshal(data, &info); err != nil {
+			log.Printf("recording %s/%s: %v\n", room, entry.Name(), err)
+			continue
+		}
+		infos = append(infos, &info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.After(infos[j].StartedAt)
+	})
+	return infos, nil
+}
+
+// Path returns the path of a file of a recording's take, every name must be a single path element
+func (rec *Recorder) Path(room string, id string, take string, file string) (string, error) {
+	for _, name := range []string{room, id, take, file} {
+		if !validName(name) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+		}
+	}
+	return filepath.Join(rec.dir, room, id, take, file), nil
+}
+
+// Recording is a recording in progress, it is safe for concurrent use
+type Recording struct {
+	recorder *Recorder
+	dir      string
+	lock     sync.Mutex
+	info     *Info
+	take     *take
+	mics     micClock // kept across takes
+	stopped  bool
+}
+
+// take is the set of tracks being written
+type take struct {
+	info   *TakeInfo
+	dir    string
+	start  time.Time // when the tracks begin
+	music  *track    // nil until the backing track plays
+	mics   map[string]*track
+	serial uint32
+}
+
+// track is an Ogg Opus file of a take
+type track struct {
+	writer *oggWriter
+	start  time.Time
+}
+
+// ID returns the id of this recording
+func (r *Recording) ID() string {
+	return r.info.ID
+}
+
+// Info returns a copy of the description of this recording
+func (r *Recording) Info() *Info {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.copyInfo()
+}
+
+func (r *Recording) copyInfo() *Info {
+	info := *r.info
+	info.Takes = make([]*TakeInfo, len(r.info.Takes))
+	for i, t := range r.info.Takes {
+		takeInfo := *t
+		takeInfo.Files = append([]string{}, t.Files...)
+		info.Takes[i] = &takeInfo
+	}
+	return &info
+}
+
+// openTake begins a new take at the given time, the lock must be held
+func (r *Recording) openTake(at time.Time) error {
+	name := fmt.Sprintf("%03d", len(r.info.Takes)+1)
+	dir := filepath.Join(r.dir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	info := &TakeInfo{Name: name, StartedAt: at, Files: []string{}}
+	r.info.Takes = append(r.info.Takes, info)
+	r.take = &take{
+		info:   info,
+		dir:    dir,
+		start:  at,
+		mics:   make(map[string]*track),
+		serial: crc32.ChecksumIEEE([]byte(r.info.ID + name)),
+	}
+	return r.saveInfo()
+}
+
+// openTrack creates a file of the current take, the lock must be held
+func (r *Recording) openTrack(file string) (*track, error) {
+	t := r.take
+	t.serial++
+	writer, err := newOggWriter(filepath.Join(t.dir, file), t.serial)
+	if err != nil {
+		return nil, err
+	}
+	t.info.Files = append(t.info.Files, file)
+	if err := r.saveInfo(); err != nil {
+		log.Printf("recording %s: %v\n", r.info.ID, err)
+	}
+	return &track{writer: writer, start: t.start}, nil
+}
+
+// saveInfo writes the description of this recording next to its files, the lock must be held
+func (r *Recording) saveInfo() error {
+	data, err := json.MarshalIndent(r.info, "", "  ")
+	if err != nil {
+		return err
+	}
+	partial := filepath.Join(r.dir, metadataFile+".part")
+	if err := os.WriteFile(partial, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(partial, filepath.Join(r.dir, metadataFile))
+}
+
+// write appends a packet due to play at the given time, preceded by silence if the track fell behind
+func (t *track) write(packet []byte, at time.Time) error {
+	samples, err := codec.PacketSamples(packet)
+	if err != nil {
+		return err
+	}
+	due := at.Sub(t.start)
+	if due < 0 {
+		due = 0
+	}
+	dueSamples := uint64(due.Seconds() * codec.SampleRate)
+	if dueSamples > t.writer.granule+uint64(gapTolerance.Seconds()*codec.SampleRate) {
+		for t.writer.granule+codec.FrameSamples <= dueSamples {
+			if err := t.writer.writePacket(codec.SilentFrame, codec.FrameSamples); err != nil {
+				return err
+			}
+		}
+	}
+	return t.writer.writePacket(packet, samples)
+}
+
+// WriteMusic records a sample of the backing track due to play at the given time
+func (r *Recording) WriteMusic(sample media.Sample, at time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped || len(sample.Data) == 0 {
+		return
+	}
+	t := r.take
+	if t.music == nil {
+		music, err := r.openTrack(musicFile)
+		if err != nil {
+			log.Printf("recording %s: %v\n", r.info.ID, err)
+			return
+		}
+		t.music = music
+	}
+	if err := t.music.write(sample.Data, at); err != nil {
+		log.Printf("recording %s: music: %v\n", r.info.ID, err)
+	}
+}
+
+// WriteMic records an RTP packet of the given user's mic, anchor is called until it places a packet of the user exactly
+func (r *Recording) WriteMic(userID string, packet *rtp.Packet, anchor Anchor) {
+	if len(packet.Payload) == 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return
+	}
+	at := r.mics.at(userID, packet, anchor)
+	t := r.take
+	mic, exist := t.mics[userID]
+	if !exist {
+		if !validName(userID) {
+			return
+		}
+		var err error
+		if mic, err = r.openTrack("mic-" + userID + ".ogg"); err != nil {
+			log.Printf("recording %s: %v\n", r.info.ID, err)
+			return
+		}
+		t.mics[userID] = mic
+	}
+	if err := mic.write(packet.Payload, at); err != nil {
+		log.Printf("recording %s: mic %s: %v\n", r.info.ID, userID, err)
+	}
+}
+
+// MarkSong names the song of the current take
+func (r *Recording) MarkSong(song string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return
+	}
+	r.take.info.Song = song
+	if err := r.saveInfo(); err != nil {
+		log.Printf("recording %s: %v\n", r.info.ID, err)
+	}
+}
+
+// Split ends the current take, which is then mixed down in the background, and starts the next one
+func (r *Recording) Split() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return ErrStopped
+	}
+	now := time.Now()
+	r.closeTake(now)
+	return r.openTake(now)
+}
+
+// Stop ends the recording, its last take is mixed down in the background
+func (r *Recording) Stop() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return ErrStopped
+	}
+	r.stopped = true
+	now := time.Now()
+	r.info.StoppedAt = &now
+	r.closeTake(now)
+	return r.saveInfo()
+}
+
+// closeTake closes the files of the current take, the lock must be held
+func (r *Recording) closeTake(at time.Time) {
+	t := r.take
+	t.info.EndedAt = &at
+	tracks := []*track{}
+	if t.music != nil {
+		tracks = append(tracks, t.music)
+	}
+	for _, mic := range t.mics {
+		tracks = append(tracks, mic)
+	}
+	for _, track := range tracks {
+		if err := track.writer.Close(); err != nil {
+			log.Printf("recording %s: %v\n", r.info.ID, err)
+		}
+	}
+	if err := r.saveInfo(); err != nil {
+		log.Printf("recording %s: %v\n", r.info.ID, err)
+	}
+	if len(tracks) > 0 && r.recorder.ffmpeg != "" {
+		go r.mixdown(t)
+	}
+}
+
+// mixdown mixes all tracks of a closed take into a single file
+func (r *Recording) mixdown(t *take) {
+	inputs := make([]string, len(t.info.Files))
+	for i, file := range t.info.Files {
+		inputs[i] = filepath.Join(t.dir, file)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mixdownTimeout)
+	defer cancel()
+	if err := mixFiles(ctx, r.recorder.ffmpeg, inputs, filepath.Join(t.dir, mixFile)); err != nil {
+		log.Printf("recording %s: fail to mix take %s down: %v\n", r.info.ID, t.info.Name, err)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	t.info.Mix = mixFile
+	if err := r.saveInfo(); err != nil {
+		log.Printf("recording %s: %v\n", r.info.ID, err)
+	}
+}
@@ -14,15 +14,16 @@ var (
 	errInvalidPacket = errors.New("packet is nil")
 )
 
-// receiveTrackRTP receive mic track's rtp and sent to one channel
+// receiveTrackRTP receive mic track's rtp and sent to one channel, which is closed once the track ends
 func (node *RtcNode) receiveTrackRTP(track *webrtc.TrackRemote) {
+	defer close(node.RtpCh)
 	for {
 		rtp, _, err := track.ReadRTP()
 		if err != nil {
-			if err == io.EOF {
-				return
+			if err != io.EOF {
+				log.Printf("rtp err => %v", err)
 			}
-			log.Fatalf("rtp err => %v", err)
+			return
 		}
 		node.RtpCh <- rtp
 	}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"sync"
 
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
@@ -21,6 +22,9 @@ type RtcNode struct {
 	RtpCh              chan *rtp.Packet // Collect all rtp packets from senders' track
 	SendersLock        sync.RWMutex
 	Senders            map[webrtc.SSRC]*webrtc.RTPSender // all incoming tracks' senders
+	rtt                rttEstimator
+	micReportLock      sync.Mutex
+	micReport          *rtcp.SenderReport // latest sender report of the mic track, nil until received
 }
 
 // SignalChannels are a set of channels used for establishing WebRTC client-server connection
@@ -85,6 +89,7 @@ func New() (*RtcNode, error) {
 		node.MicTrack = tr
 		MicReadyCtxCancel()
 		go node.receiveTrackRTP(tr)
+		go node.watchSenderReports(r)
 	})
 	log.Println("PC connected")
 	return node, nil
@@ -0,0 +1,118 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Weight of a new measure in the smoothed round trip time
+	rttSmoothing = 0.2
+	// Seconds from the NTP epoch in 1900 to the unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+// rttEstimator smooths round trip time measures, so a single late report doesn't move the estimate much
+type rttEstimator struct {
+	lock sync.Mutex
+	rtt  time.Duration // 0 until measured
+}
+
+func (e *rttEstimator) add(measure time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.rtt == 0 {
+		e.rtt = measure
+		return
+	}
+	e.rtt += time.Duration(rttSmoothing * float64(measure-e.rtt))
+}
+
+func (e *rttEstimator) get() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.rtt
+}
+
+// RTT returns the smoothed round trip time to the client measured from RTCP reports, or 0 if unknown yet
+func (node *RtcNode) RTT() time.Duration {
+	return node.rtt.get()
+}
+
+// WatchRTCP reads the RTCP packets the client sends about the given sender until it is stopped, and
+// measures the round trip time from the receiver reports answering our sender reports
+func (node *RtcNode) WatchRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		now := ntpMiddle(time.Now())
+		for _, packet := range packets {
+			report, ok := packet.(*rtcp.ReceiverReport)
+			if !ok {
+				continue
+			}
+			for _, block := range report.Reports {
+				if block.LastSenderReport == 0 {
+					// No sender report received yet
+					continue
+				}
+				// Middle 32 bits of NTP timestamps count 1/65536 seconds
+				rtt := now - block.LastSenderReport - block.Delay
+				if rtt > 1<<31 {
+					continue
+				}
+				node.rtt.add(time.Duration(rtt) * time.Second / 65536)
+			}
+		}
+	}
+}
+
+// watchSenderReports keeps the latest sender report the client sends about its mic, until the receiver stops
+func (node *RtcNode) watchSenderReports(receiver *webrtc.RTPReceiver) {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			if report, ok := packet.(*rtcp.SenderReport); ok {
+				node.micReportLock.Lock()
+				node.micReport = report
+				node.micReportLock.Unlock()
+			}
+		}
+	}
+}
+
+// MicCaptureTime converts an RTP timestamp of the mic track to the time the audio was captured, by the
+// client's clock. It uses the latest sender report, and returns false until one is received.
+func (node *RtcNode) MicCaptureTime(timestamp uint32) (time.Time, bool) {
+	node.micReportLock.Lock()
+	report := node.micReport
+	node.micReportLock.Unlock()
+	if report == nil {
+		return time.Time{}, false
+	}
+	// Opus RTP timestamps always run at 48 kHz, the difference may be negative for packets older than the report
+	elapsed := time.Duration(int32(timestamp-report.RTPTime)) * time.Second / 48000
+	return ntpToTime(report.NTPTime).Add(elapsed), true
+}
+
+// ntpToTime converts a 64-bit NTP timestamp to a time
+func ntpToTime(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanos := (ntp & 0xFFFFFFFF) * uint64(time.Second) >> 32
+	return time.Unix(seconds, int64(nanos))
+}
+
+// ntpMiddle returns the middle 32 bits of the NTP timestamp of the given time, as used by RTCP reports
+func ntpMiddle(t time.Time) uint32 {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction>>16)
+}
@@ -0,0 +1,210 @@
+/*
+Package scoring rates how well a singer follows the reference melody of a song. The singer's Opus packets
+are decoded, their pitch is detected every few milliseconds and compared to the note expected at that
+point of the song. Like most karaoke games, octaves are ignored so everyone can sing in their own range.
+*/
+package scoring
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/pitch"
+)
+
+const (
+	// The voice is analyzed at a lower rate, which is plenty for its fundamental
+	downsample = 4
+	sampleRate = codec.SampleRate / downsample
+	// Pitch is detected every hop
+	hop     = sampleRate / 50
+	hopTime = time.Second / 50
+	// A detected pitch within this many semitones of the note counts as a hit
+	tolerance = 1.0
+	// Packets further than this from where the previous one ended start a new stretch, after a seek
+	maxDiscontinuity = 200 * time.Millisecond
+	// Highest score of a song
+	MaxScore = 100.0
+)
+
+// Note is a note of a reference melody
+type Note struct {
+	Start  time.Duration
+	End    time.Duration
+	Pitch  float64 // MIDI note number
+	Weight float64 // how much the note counts compared to others of the same duration, 1 if 0
+}
+
+// NoteScore is how well a note was sung
+type NoteScore struct {
+	Index    int
+	Pitch    float64 // expected, MIDI note number
+	Sung     float64 // median pitch sung, 0 if nothing was heard
+	Accuracy float64 // share of the note sung in tune, from 0 to 1
+}
+
+// Scorer scores a singer against a melody, it is safe for concurrent use
+type Scorer struct {
+	lock      sync.Mutex
+	notes     []Note // sorted by start
+	decoder   *codec.Decoder
+	detector  *pitch.Detector
+	pcm       []int16
+	samples   []float64     // mono samples waiting to be analyzed
+	samplesAt time.Duration // song position of the first waiting sample
+	next      time.Duration // song position where the previous packet ended, -1 before the first one
+	current   int           // first note not finished yet
+	tally     []tally       // per note
+	scores    []*NoteScore  // finished notes
+}
+
+// tally counts the pitch frames within a note
+type tally struct {
+	frames int
+	hits   int
+	sung   []float64
+}
+
+// New creates a scorer for the given melody, it fails if the server can't decode Opus
+func New(notes []Note) (*Scorer, error) {
+	decoder, err := codec.NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+	sorted := append([]Note{}, notes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	return &Scorer{
+		notes:    sorted,
+		decoder:  decoder,
+		detector: pitch.NewDetector(sampleRate),
+		pcm:      make([]int16, codec.MaxFrameSamples*codec.Channels),
+		next:     -1,
+		tally:    make([]tally, len(sorted)),
+	}, nil
+}
+
+// Write analyzes an Opus packet of the singer captured at the given song position,
+// and returns the notes which are over since the previous call
+func (s *Scorer) Write(packet []byte, pos time.Duration) ([]*NoteScore, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n, err := s.decoder.Decode(packet, s.pcm)
+	if err != nil {
+		return nil, err
+	}
+	if s.next < 0 || pos-s.next > maxDiscontinuity || s.next-pos > maxDiscontinuity {
+		s.samples, s.samplesAt = s.samples[:0], pos
+	}
+	s.next = pos + time.Duration(n)*time.Second/codec.SampleRate
+	// Downmix to mono while averaging consecutive samples, a crude low-pass filter before decimating
+	for i := 0; i+downsample <= n; i += downsample {
+		var sum float64
+		for j := i; j < i+downsample; j++ {
+			sum += float64(s.pcm[j*codec.Channels]) + float64(s.pcm[j*codec.Channels+1])
+		}
+		s.samples = append(s.samples, sum/(2*downsample*math.MaxInt16))
+	}
+
+	var finished []*NoteScore
+	frameSize := s.detector.FrameSize()
+	for len(s.samples) >= frameSize {
+		at := s.samplesAt + time.Duration(frameSize/2)*time.Second/sampleRate
+		finished = append(finished, s.finishBefore(at)...)
+		frequency, voiced := s.detector.Detect(s.samples[:frameSize])
+		s.count(at, frequency, voiced)
+		s.samples = s.samples[:copy(s.samples, s.samples[hop:])]
+		s.samplesAt += hopTime
+	}
+	return finished, nil
+}
+
+// count adds a pitch frame to the note playing at the given position, the lock must be held
+func (s *Scorer) count(at time.Duration, frequency float64, voiced bool) {
+	for i := s.current; i < len(s.notes) && s.notes[i].Start <= at; i++ {
+		if at >= s.notes[i].End {
+			continue
+		}
+		t := &s.tally[i]
+		t.frames++
+		if !voiced {
+			return
+		}
+		sung := pitch.FrequencyToMIDI(frequency)
+		t.sung = append(t.sung, sung)
+		if pitchClassDistance(sung, s.notes[i].Pitch) <= tolerance {
+			t.hits++
+		}
+		return
+	}
+}
+
+// finishBefore scores the notes which ended before the given position, the lock must be held
+func (s *Scorer) finishBefore(at time.Duration) []*NoteScore {
+	var finished []*NoteScore
+	for s.current < len(s.notes) && s.notes[s.current].End <= at {
+		finished = append(finished, s.finish(s.current))
+		s.current++
+	}
+	return finished
+}
+
+func (s *Scorer) finish(i int) *NoteScore {
+	t := s.tally[i]
+	score := &NoteScore{Index: i, Pitch: s.notes[i].Pitch}
+	if t.frames > 0 {
+		score.Accuracy = float64(t.hits) / float64(t.frames)
+	}
+	if len(t.sung) > 0 {
+		sort.Float64s(t.sung)
+		score.Sung = t.sung[len(t.sung)/2]
+	}
+	s.scores = append(s.scores, score)
+	return score
+}
+
+// Score returns the score of the notes finished so far, out of MaxScore. Notes weigh by their duration and weight.
+func (s *Scorer) Score() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.score()
+}
+
+func (s *Scorer) score() float64 {
+	var total, sung float64
+	for _, score := range s.scores {
+		note := s.notes[score.Index]
+		weight := note.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		weight *= (note.End - note.Start).Seconds()
+		total += weight
+		sung += weight * score.Accuracy
+	}
+	if total == 0 {
+		return 0
+	}
+	return MaxScore * sung / total
+}
+
+// Finish scores every note left once the song ended, and returns them along with the final score
+func (s *Scorer) Finish() ([]*NoteScore, float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var finished []*NoteScore
+	for ; s.current < len(s.notes); s.current++ {
+		finished = append(finished, s.finish(s.current))
+	}
+	return finished, s.score()
+}
+
+// pitchClassDistance returns how many semitones apart two pitches are, ignoring octaves
+func pitchClassDistance(a float64, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 12)
+	return math.Min(d, 12-d)
+}
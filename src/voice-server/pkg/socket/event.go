@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/Nahemah1022/singsphere-voice-server/stream"
 	"github.com/pion/webrtc/v3"
@@ -17,34 +18,219 @@ type EventBase struct {
 
 type InboundEvent struct {
 	EventBase
-	Offer     *webrtc.SessionDescription `json:"offer,omitempty"`
-	Answer    *webrtc.SessionDescription `json:"answer,omitempty"`
-	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Offer      *webrtc.SessionDescription `json:"offer,omitempty"`
+	Answer     *webrtc.SessionDescription `json:"answer,omitempty"`
+	Candidate  *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Song       *stream.Music              `json:"song,omitempty"`     // Song to enqueue
+	Position   int                        `json:"position,omitempty"` // Queue position to remove or move from
+	To         int                        `json:"to,omitempty"`       // Queue position to move to
+	Time       float64                    `json:"time,omitempty"`     // Playback position to seek to, crossfade duration, clip length, invite lifetime, or echoed ping time, in seconds
+	TimeSync   *TimeSyncWrap              `json:"time_sync,omitempty"`
+	UserID     string                     `json:"user,omitempty"`     // User targeted by the event, such as a hand to approve
+	Password   *string                    `json:"password,omitempty"` // Password of a private room, empty to remove it
+	Uses       int                        `json:"uses,omitempty"`     // How many users may join with an invite, unlimited if 0
+	Message    string                     `json:"message,omitempty"`  // Chat message
+	Reaction   string                     `json:"reaction,omitempty"` // Emoji reaction, such as "👏"
+	Profile    *ProfileWrap               `json:"profile,omitempty"`
+	ReceivedAt time.Time                  `json:"-"` // when the event was read from the websocket
 }
 
 type OutboundEvent struct {
 	EventBase
 	// Sender string `json:"sender,omitempty"` // Should be speficied if it is a broadcast event
-	Offer     *webrtc.SessionDescription `json:"offer,omitempty"`
-	Answer    *webrtc.SessionDescription `json:"answer,omitempty"`
-	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
-	User      *UserWrap                  `json:"user,omitempty"`
-	Room      *RoomWrap                  `json:"room,omitempty"`
+	Offer          *webrtc.SessionDescription `json:"offer,omitempty"`
+	Answer         *webrtc.SessionDescription `json:"answer,omitempty"`
+	Candidate      *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	User           *UserWrap                  `json:"user,omitempty"`
+	Room           *RoomWrap                  `json:"room,omitempty"`
+	Song           *stream.Music              `json:"song,omitempty"`
+	Queue          *QueueWrap                 `json:"queue,omitempty"`
+	Playback       *PlaybackWrap              `json:"playback,omitempty"`
+	Transcode      *TranscodeWrap             `json:"transcode,omitempty"`
+	Lyrics         *stream.Lyrics             `json:"lyrics,omitempty"`
+	LyricLine      *stream.LyricLine          `json:"lyric_line,omitempty"`
+	Crossfade      *float64                   `json:"crossfade,omitempty"`       // seconds
+	Time           float64                    `json:"time,omitempty"`            // Unix time in seconds of a ping
+	LoudnessTarget *float64                   `json:"loudness_target,omitempty"` // LUFS
+	TimeSync       *TimeSyncWrap              `json:"time_sync,omitempty"`
+	Schedule       *ScheduleWrap              `json:"schedule,omitempty"`
+	Recording      *RecordingWrap             `json:"recording,omitempty"`
+	Recordings     []*RecordingWrap           `json:"recordings,omitempty"`
+	Clip           *ClipWrap                  `json:"clip,omitempty"`
+	Score          *ScoreWrap                 `json:"score,omitempty"`
+	HandQueue      *HandQueueWrap             `json:"hand_queue,omitempty"`
+	Code           string                     `json:"code,omitempty"` // Reason of a join_error event, such as "wrong_password"
+	Invite         *InviteWrap                `json:"invite,omitempty"`
+	Chat           *ChatWrap                  `json:"chat,omitempty"`
+	Reactions      map[string]int             `json:"reactions,omitempty"` // How many of each reaction were sent lately
+	Summary        *SummaryWrap               `json:"summary,omitempty"`
 }
 
 // Public representation of a user
 type UserWrap struct {
-	ID    string `json:"id"`
-	Emoji string `json:"emoji"`
-	Mute  bool   `json:"mute"`
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Avatar     string `json:"avatar,omitempty"`
+	Emoji      string `json:"emoji"`
+	Color      string `json:"color,omitempty"`
+	Mute       bool   `json:"mute"`
+	Role       string `json:"role"` // "host", "singer" or "audience"
+	HandRaised bool   `json:"hand_raised"`
+	MuteLocked bool   `json:"mute_locked"` // muted by the host, who must release them before they can unmute
+}
+
+// Changes to the profile of a user, fields left out are kept and empty ones are cleared.
+// An empty emoji gives the user a random one instead.
+type ProfileWrap struct {
+	Name   *string `json:"name,omitempty"`
+	Emoji  *string `json:"emoji,omitempty"`
+	Avatar *string `json:"avatar,omitempty"`
+	Color  *string `json:"color,omitempty"`
 }
 
 // Public representation of a room
 type RoomWrap struct {
-	Users   []*UserWrap `json:"users"`
-	Name    string      `json:"name"`
-	Online  int         `json:"online"`
-	Playing *stream.Music
+	Users          []*UserWrap      `json:"users"`
+	Name           string           `json:"name"`
+	Mode           string           `json:"mode"` // "sfu" forwards every mic, "mcu" sends each user a single mixed track
+	Online         int              `json:"online"`
+	Playing        *PlaybackWrap    `json:"playing"`
+	Queue          *QueueWrap       `json:"queue"`
+	Crossfade      float64          `json:"crossfade"`       // seconds of overlap between consecutive songs
+	LoudnessTarget float64          `json:"loudness_target"` // LUFS songs are normalized to
+	Alignment      []*AlignmentWrap `json:"alignment"`
+	Recording      string           `json:"recording,omitempty"` // id of the recording in progress
+	HandQueue      *HandQueueWrap   `json:"hand_queue"`
+	Host           string           `json:"host"` // id of the host, empty if the room is empty
+	Locked         bool             `json:"locked"`
+	Private        bool             `json:"private"`
+	HasPassword    bool             `json:"has_password"`   // whether a private room takes a password, or only invites
+	Chat           []*ChatWrap      `json:"chat,omitempty"` // last chat messages, only in the snapshot sent on join
+}
+
+// Public representation of a user's latency, and of the offsets aligning them with the music, in milliseconds
+type AlignmentWrap struct {
+	UserID     string  `json:"user"`
+	RTT        float64 `json:"rtt"`
+	Singer     bool    `json:"singer"`
+	MusicDelay float64 `json:"music_delay"`
+	VoiceDelay float64 `json:"voice_delay"`
+}
+
+// Public representation of a song pending in a room's playlist
+type QueueItemWrap struct {
+	ID          string        `json:"id"`
+	Song        *stream.Music `json:"song"`
+	RequesterID string        `json:"requester,omitempty"`
+}
+
+// Public representation of the song playing in a room, and the playback state of its backing track
+type PlaybackWrap struct {
+	Song        *stream.Music `json:"song"`
+	RequesterID string        `json:"requester,omitempty"`
+	StartedAt   time.Time     `json:"started_at"`
+	Duration    float64       `json:"duration"` // seconds
+	Position    float64       `json:"position"` // seconds
+	Paused      bool          `json:"paused"`
+	Parts       []*PartWrap   `json:"parts,omitempty"` // who sings which part of a duet
+}
+
+// Public representation of the part of a duet a singer sings
+type PartWrap struct {
+	UserID string `json:"user"`
+	Part   int    `json:"part"` // 1 or 2, as P1 and P2 of the UltraStar file
+	Name   string `json:"name,omitempty"`
+}
+
+// Public representation of the progress of a song being converted to Opus
+type TranscodeWrap struct {
+	Song    string  `json:"song"`
+	Percent float64 `json:"percent"`
+}
+
+// Public representation of when the current song starts, for clients playing the backing track locally.
+// Times are unix milliseconds, the song starts at its beginning at StartAt, or started then if it is past.
+type ScheduleWrap struct {
+	Song         string  `json:"song"`
+	StartAt      float64 `json:"start_at"`                 // by the server's clock
+	LocalStartAt float64 `json:"local_start_at,omitempty"` // by the receiving client's clock, 0 if not synchronized yet
+	Paused       bool    `json:"paused"`
+}
+
+// Public representation of a recording of a room
+type RecordingWrap struct {
+	ID        string      `json:"id"`
+	Room      string      `json:"room"`
+	StartedAt time.Time   `json:"started_at"`
+	StoppedAt *time.Time  `json:"stopped_at,omitempty"` // nil while recording
+	Takes     []*TakeWrap `json:"takes"`
+}
+
+// Public representation of a take of a recording, usually a single song
+type TakeWrap struct {
+	Name      string     `json:"name"`
+	Song      string     `json:"song,omitempty"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"` // nil while recording
+	Files     []string   `json:"files"`              // downloadable under /api/rooms/{room}/recordings/{id}/{take}/
+	Mix       string     `json:"mix,omitempty"`      // file of the mixdown, empty until it is done
+}
+
+// Public representation of a clip of a room's last moments
+type ClipWrap struct {
+	ID  string `json:"id"`
+	URL string `json:"url"` // where the Ogg file can be downloaded
+}
+
+// Public representation of what happened during a song, sent once it ended
+type SummaryWrap struct {
+	Song      string             `json:"song"`
+	Reactions map[string]int     `json:"reactions"`        // how many of each reaction the audience sent
+	Scores    map[string]float64 `json:"scores,omitempty"` // final score of each singer, keyed by user id
+}
+
+// Public representation of a chat message
+type ChatWrap struct {
+	ID      int64     `json:"id"`
+	UserID  string    `json:"user"`
+	Name    string    `json:"name,omitempty"` // display name of the sender when they sent it
+	Message string    `json:"message"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// Public representation of the score of a singer, with the notes they finished since the previous one
+type ScoreWrap struct {
+	UserID string           `json:"user"`
+	Song   string           `json:"song"`
+	Notes  []*NoteScoreWrap `json:"notes"`
+	Score  float64          `json:"score"` // out of 100, over the notes finished so far
+	Final  bool             `json:"final"` // whether the song ended
+}
+
+// Public representation of how well a note of the melody was sung
+type NoteScoreWrap struct {
+	Index    int     `json:"index"`          // of the note among the notes the singer is scored against
+	Pitch    float64 `json:"pitch"`          // expected, MIDI note number
+	Sung     float64 `json:"sung,omitempty"` // median pitch sung, 0 if nothing was heard
+	Accuracy float64 `json:"accuracy"`       // share of the note sung in tune, from 0 to 1
+}
+
+// Public representation of the users waiting to get on stage, in the order they raised their hand
+type HandQueueWrap struct {
+	Users []string `json:"users"`
+}
+
+// Invite link to a private room
+type InviteWrap struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"` // websocket URL joining the room with the invite
+	ExpiresAt time.Time `json:"expires_at"`
+	Uses      int       `json:"uses,omitempty"` // how many users may join with it, unlimited if 0
+}
+
+// Public representation of a room's playlist
+type QueueWrap struct {
+	Items []*QueueItemWrap `json:"items"`
 }
 
 // SendEvent enocde event json body an sends it to write loop
@@ -53,8 +239,12 @@ func (ws *Websocket) Send(event *OutboundEvent) error {
 	if err != nil {
 		return err
 	}
-	ws.sendCh <- bytes
-	return nil
+	select {
+	case ws.sendCh <- bytes:
+		return nil
+	case <-ws.done:
+		return ErrClosed
+	}
 }
 
 // SendErr sends error in json format to web socket
@@ -64,10 +254,14 @@ func (ws *Websocket) SendError(err error) error {
 
 // receiveEvent decode inbound event raw bytes and push it to public channel for user access
 func (ws *Websocket) receiveEvent(eventRaw []byte) {
+	receivedAt := time.Now()
 	var event *InboundEvent
 	if err := json.Unmarshal(eventRaw, &event); err != nil {
 		log.Println(err)
 		return
 	}
+	if event != nil {
+		event.ReceivedAt = receivedAt
+	}
 	ws.InboundEventCh <- event
 }
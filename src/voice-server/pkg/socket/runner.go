@@ -2,6 +2,7 @@ package socket
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"net/http"
 	"sync"
@@ -16,6 +17,8 @@ type Websocket struct {
 	wg             sync.WaitGroup
 	InboundEventCh chan *InboundEvent // Public interface for parsed inbound messages
 	sendCh         chan []byte        // Buffered channel of outbound messages.
+	closeCh        chan []byte        // Close frame to send once the outbound messages are written
+	done           chan struct{}      // Closed once the websocket is closed, nothing can be sent anymore
 	closeHandler   func()
 }
 
@@ -30,6 +33,16 @@ const (
 	maxMessageSize = 51200
 )
 
+// Close codes telling clients why the server closed their websocket, in the range left to applications
+const (
+	CloseKicked       = 4000 // removed from the room by its host
+	CloseRejected     = 4001 // not allowed to join the room
+	CloseUnauthorized = 4002 // missing or invalid token
+)
+
+// ErrClosed is returned when sending on a websocket which was closed
+var ErrClosed = errors.New("websocket closed")
+
 var (
 	newline  = []byte{'\n'}
 	space    = []byte{' '}
@@ -58,16 +71,34 @@ func New(w http.ResponseWriter, r *http.Request, closeHandler func()) (*Websocke
 		stop:           false,
 		InboundEventCh: make(chan *InboundEvent, 16),
 		sendCh:         make(chan []byte, 256),
+		closeCh:        make(chan []byte, 1),
+		done:           make(chan struct{}),
 	}
 	log.Println("ws connected")
 	return ws, nil
 }
 
+// Reject upgrades the request only to send the given event and close the websocket with the given code,
+// so browsers, which can't read the response of a failed upgrade, learn why they were turned away
+func Reject(w http.ResponseWriter, r *http.Request, code int, event *OutboundEvent) error {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteJSON(event); err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, event.Desc))
+}
+
 // Run starts the readLoop and writeLoop of the websocket, and terminate until one of them ends
 func (ws *Websocket) Run(wsClose chan<- struct{}) {
 	defer func() {
 		ws.conn.Close()
-		close(ws.sendCh)
+		// Senders may still hold the websocket, so the outbound channel is left open for them to fail
+		close(ws.done)
 		close(ws.InboundEventCh)
 		wsClose <- struct{}{}
 	}()
@@ -77,6 +108,16 @@ func (ws *Websocket) Run(wsClose chan<- struct{}) {
 	ws.wg.Wait()
 }
 
+// Close closes the websocket from the server side once the events sent before are written,
+// the given code and reason are sent in the close frame
+func (ws *Websocket) Close(code int, reason string) {
+	select {
+	case ws.closeCh <- websocket.FormatCloseMessage(code, reason):
+	default:
+		// The websocket is already closing
+	}
+}
+
 // ReadLoop is a goroutine that should be fired once the owner is ready to receive message from websocket
 func (ws *Websocket) readLoop() {
 	defer func() {
@@ -107,13 +148,8 @@ func (ws *Websocket) writeLoop() {
 	}()
 	for {
 		select {
-		case message, ok := <-ws.sendCh:
+		case message := <-ws.sendCh:
 			ws.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				ws.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 			w, err := ws.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
@@ -122,6 +158,16 @@ func (ws *Websocket) writeLoop() {
 			if err := w.Close(); err != nil {
 				return
 			}
+		case message := <-ws.closeCh:
+			for pending := len(ws.sendCh); pending > 0; pending-- {
+				if err := ws.conn.WriteMessage(websocket.TextMessage, <-ws.sendCh); err != nil {
+					break
+				}
+			}
+			ws.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+			// Closing the connection ends the read loop too
+			ws.conn.Close()
+			return
 		case <-ticker.C:
 			ws.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := ws.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -0,0 +1,135 @@
+/*
+This timesync.go implements the time_sync exchange, an NTP-style request and response carried over the
+signaling websocket. Either side may send a request holding its transmit time; the responder echoes it
+along with its own receive and transmit times. Four timestamps give the offset between the two clocks,
+and the network delay which bounds the error of that offset.
+*/
+package socket
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimeSyncWrap is the payload of time_sync events, times are unix milliseconds
+type TimeSyncWrap struct {
+	Origin   float64 `json:"origin"`             // when the request was sent, by the requester's clock
+	Receive  float64 `json:"receive,omitempty"`  // when the request was received, by the responder's clock
+	Transmit float64 `json:"transmit,omitempty"` // when the response was sent, by the responder's clock
+}
+
+// IsResponse tells whether the payload answers a request, rather than being a request itself
+func (ts *TimeSyncWrap) IsResponse() bool {
+	return ts.Receive != 0 && ts.Transmit != 0
+}
+
+// UnixMillis converts a time to the unix milliseconds used in events
+func UnixMillis(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Millisecond)
+}
+
+// FromUnixMillis converts unix milliseconds used in events to a time
+func FromUnixMillis(ms float64) time.Time {
+	return time.Unix(0, int64(ms*float64(time.Millisecond)))
+}
+
+const (
+	// Exchanges kept to estimate a clock
+	clockSamples = 16
+	// Drift is only estimated once the exchanges kept span this long, shorter spans are dominated by jitter
+	minDriftSpan = 30 * time.Second
+)
+
+// clockSample is the outcome of one exchange
+type clockSample struct {
+	at     time.Time     // local time in the middle of the exchange
+	offset time.Duration // remote clock minus local clock
+	delay  time.Duration // round trip spent on the network
+}
+
+// ClockEstimator estimates the offset and drift of a remote clock from time_sync exchanges.
+// Exchanges with the shortest network delay are trusted most, as their offset is the least skewed.
+type ClockEstimator struct {
+	lock    sync.Mutex
+	samples []clockSample // newest last
+	drift   float64       // remote seconds gained per local second
+}
+
+// Add records an exchange initiated locally: the request was sent at origin, the remote side received it at
+// receive and answered at transmit, both by its own clock, and the response arrived at arrival
+func (e *ClockEstimator) Add(origin time.Time, receive time.Time, transmit time.Time, arrival time.Time) {
+	delay := arrival.Sub(origin) - transmit.Sub(receive)
+	if delay < 0 {
+		// Impossible unless timestamps are bogus
+		return
+	}
+	sample := clockSample{
+		at:     origin.Add(arrival.Sub(origin) / 2),
+		offset: (receive.Sub(origin) + transmit.Sub(arrival)) / 2,
+		delay:  delay,
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.samples = append(e.samples, sample)
+	if len(e.samples) > clockSamples {
+		e.samples = e.samples[1:]
+	}
+	e.drift = estimateDrift(e.samples)
+}
+
+// estimateDrift fits a line through the offsets of the best half of the samples
+func estimateDrift(samples []clockSample) float64 {
+	if len(samples) < 4 || samples[len(samples)-1].at.Sub(samples[0].at) < minDriftSpan {
+		return 0
+	}
+	best := append([]clockSample(nil), samples...)
+	sort.Slice(best, func(i, j int) bool { return best[i].delay < best[j].delay })
+	best = best[:len(best)/2]
+	origin := best[0].at
+	var sumX, sumY, sumXX, sumXY float64
+	for _, sample := range best {
+		x := sample.at.Sub(origin).Seconds()
+		y := sample.offset.Seconds()
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	n := float64(len(best))
+	denominator := n*sumXX - sumX*sumX
+	if math.Abs(denominator) < 1e-9 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// Offset returns the remote clock minus the local clock at the given local time, and whether it is known
+func (e *ClockEstimator) Offset(at time.Time) (time.Duration, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.samples) == 0 {
+		return 0, false
+	}
+	best := e.samples[0]
+	for _, sample := range e.samples[1:] {
+		if sample.delay < best.delay {
+			best = sample
+		}
+	}
+	return best.offset + time.Duration(e.drift*float64(at.Sub(best.at))), true
+}
+
+// Drift returns how fast the remote clock runs compared to the local one, in parts per million
+func (e *ClockEstimator) Drift() float64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.drift * 1e6
+}
+
+// ToRemote converts a local time to the remote clock, and tells whether the offset is known
+func (e *ClockEstimator) ToRemote(t time.Time) (time.Time, bool) {
+	offset, ok := e.Offset(t)
+	return t.Add(offset), ok
+}
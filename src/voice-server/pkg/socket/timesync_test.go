@@ -0,0 +1,125 @@
+package socket
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// exchange is a time_sync exchange initiated at a local time, with a remote clock ahead by offset
+type exchange struct {
+	at       time.Duration // since the beginning of the test
+	offset   time.Duration
+	outbound time.Duration // network delay of the request
+	inbound  time.Duration // network delay of the response
+}
+
+// addExchanges feeds the exchanges to the estimator, the remote side takes 1 ms to answer
+func addExchanges(e *ClockEstimator, start time.Time, exchanges []exchange) {
+	for _, x := range exchanges {
+		origin := start.Add(x.at)
+		receive := origin.Add(x.outbound + x.offset)
+		transmit := receive.Add(time.Millisecond)
+		arrival := transmit.Add(x.inbound - x.offset)
+		e.Add(origin, receive, transmit, arrival)
+	}
+}
+
+// repeatExchange returns n copies of the exchange, one every second
+func repeatExchange(x exchange, n int) []exchange {
+	exchanges := make([]exchange, n)
+	for i := range exchanges {
+		exchanges[i] = x
+		exchanges[i].at = time.Duration(i+1) * time.Second
+	}
+	return exchanges
+}
+
+func TestClockEstimatorOffset(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		want      time.Duration
+		wantKnown bool
+	}{
+		{name: "no exchange"},
+		{
+			name:      "symmetric delays",
+			exchanges: []exchange{{offset: 100 * ms, outbound: 10 * ms, inbound: 10 * ms}},
+			want:      100 * ms,
+			wantKnown: true,
+		},
+		{
+			name:      "asymmetric delays skew the offset by half their difference",
+			exchanges: []exchange{{offset: 100 * ms, outbound: 30 * ms, inbound: 10 * ms}},
+			want:      110 * ms,
+			wantKnown: true,
+		},
+		{
+			name: "the exchange with the shortest round trip is trusted",
+			exchanges: []exchange{
+				{at: 0, offset: -50 * ms, outbound: 200 * ms, inbound: 10 * ms},
+				{at: time.Second, offset: -50 * ms, outbound: 5 * ms, inbound: 5 * ms},
+				{at: 2 * time.Second, offset: -50 * ms, outbound: 10 * ms, inbound: 150 * ms},
+			},
+			want:      -50 * ms,
+			wantKnown: true,
+		},
+		{
+			name: "bogus timestamps are ignored",
+			exchanges: []exchange{
+				{at: 0, offset: 20 * ms, outbound: 10 * ms, inbound: 10 * ms},
+				{at: time.Second, offset: 500 * ms, outbound: -20 * ms, inbound: 5 * ms},
+			},
+			want:      20 * ms,
+			wantKnown: true,
+		},
+		{
+			name: "old exchanges are forgotten",
+			exchanges: append(
+				[]exchange{{at: 0, offset: 900 * ms, outbound: ms, inbound: ms}},
+				repeatExchange(exchange{offset: 30 * ms, outbound: 20 * ms, inbound: 20 * ms}, clockSamples)...,
+			),
+			want:      30 * ms,
+			wantKnown: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &ClockEstimator{}
+			start := time.Now()
+			addExchanges(e, start, test.exchanges)
+			got, known := e.Offset(start)
+			if known != test.wantKnown || got != test.want {
+				t.Errorf("Offset() = %v, %v, want %v, %v", got, known, test.want, test.wantKnown)
+			}
+		})
+	}
+}
+
+func TestClockEstimatorDrift(t *testing.T) {
+	tests := []struct {
+		name  string
+		every time.Duration
+		want  float64 // ppm
+	}{
+		{name: "long enough span", every: 10 * time.Second, want: 100},
+		{name: "span too short", every: time.Second, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The remote clock gains 100 µs every second
+			exchanges := []exchange{}
+			for i := 0; i < 8; i++ {
+				at := time.Duration(i) * test.every
+				exchanges = append(exchanges, exchange{at: at, offset: at / 10000, outbound: 10 * time.Millisecond, inbound: 10 * time.Millisecond})
+			}
+			e := &ClockEstimator{}
+			addExchanges(e, time.Now(), exchanges)
+			if got := e.Drift(); math.Abs(got-test.want) > 1 {
+				t.Errorf("Drift() = %v ppm, want %v", got, test.want)
+			}
+		})
+	}
+}
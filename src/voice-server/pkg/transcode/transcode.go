@@ -0,0 +1,350 @@
+/*
+This transcode.go converts songs uploaded in other formats into 48 kHz Opus in Ogg with ffmpeg.
+Results are cached on disk keyed by the hash of the input content, so a song is only converted once.
+The cache is bounded, the songs played the least recently are evicted first.
+*/
+package transcode
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress describes how far a transcoding job went
+type Progress struct {
+	Done  time.Duration // audio converted so far
+	Total time.Duration // duration of the input, 0 if unknown
+}
+
+// Percent returns the completion in percent, or 0 if the total is unknown
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	percent := float64(p.Done) / float64(p.Total) * 100
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+const (
+	// Size of the cache unless TRANSCODE_CACHE_MB says otherwise
+	defaultCacheSize = 2 << 30
+	// Longest conversion before it is given up
+	jobTimeout = 10 * time.Minute
+)
+
+// Transcoder converts audio with ffmpeg and caches the results
+type Transcoder struct {
+	ffmpeg    string
+	cacheDir  string
+	cacheSize int64 // bytes of converted songs kept in the cache
+	bitrate   string
+	jobsLock  sync.Mutex
+	jobs      map[string]*job // in flight jobs keyed by content hash
+}
+
+// job is a transcoding in progress, shared by every caller asking for the same content. It runs on
+// its own, so callers giving up don't cancel it for the others.
+type job struct {
+	done    chan struct{}
+	path    string
+	err     error
+	lock    sync.Mutex
+	reports map[int]func(Progress) // progress callbacks of the callers waiting for the job
+	nextID  int
+}
+
+type progressKey struct{}
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported audio format")
+	ErrFFmpegNotFound    = errors.New("ffmpeg not found")
+)
+
+// Formats which can be converted, keyed by file extension
+var formats = map[string]bool{
+	".mp3":  true,
+	".wav":  true,
+	".flac": true,
+	".aac":  true,
+	".m4a":  true,
+}
+
+var durationPattern = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+\.\d+)`)
+
+// New creates a transcoder which caches converted songs in cacheDir
+func New(cacheDir string) (*Transcoder, error) {
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Transcoder{
+		ffmpeg:    "ffmpeg",
+		cacheDir:  cacheDir,
+		cacheSize: defaultCacheSize,
+		bitrate:   "128k",
+		jobs:      make(map[string]*job),
+	}, nil
+}
+
+// FromEnv creates a transcoder caching into TRANSCODE_CACHE_DIR, or a directory under the system temp dir.
+// The cache holds up to TRANSCODE_CACHE_MB megabytes, 2 GB if unset.
+func FromEnv() (*Transcoder, error) {
+	cacheDir := os.Getenv("TRANSCODE_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "singsphere-transcode")
+	}
+	t, err := New(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if mb, err := strconv.ParseInt(os.Getenv("TRANSCODE_CACHE_MB"), 10, 64); err == nil && mb > 0 {
+		t.cacheSize = mb << 20
+	}
+	return t, nil
+}
+
+// Supported tells whether a song with the given name can be converted
+func Supported(name string) bool {
+	return formats[strings.ToLower(filepath.Ext(name))]
+}
+
+// WithProgress returns a context which makes Transcode report its progress to the given callback
+func WithProgress(ctx context.Context, report func(Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+func progressFrom(ctx context.Context) func(Progress) {
+	if report, ok := ctx.Value(progressKey{}).(func(Progress)); ok {
+		return report
+	}
+	return func(Progress) {}
+}
+
+// Transcode converts the given input into Ogg Opus, and returns the path of the converted file in the cache
+func (t *Transcoder) Transcode(ctx context.Context, name string, input io.Reader) (string, error) {
+	if !Supported(name) {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, name)
+	}
+	// Keep the input on disk while hashing it, ffmpeg needs a seekable input for some containers anyway
+	inputFile, err := os.CreateTemp(t.cacheDir, "input-*"+filepath.Ext(name))
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(inputFile, hash), input)
+	inputFile.Close()
+	if err != nil {
+		os.Remove(inputFile.Name())
+		return "", err
+	}
+	key := hex.EncodeToString(hash.Sum(nil))
+	output := filepath.Join(t.cacheDir, key+".ogg")
+	if _, err := os.Stat(output); err == nil {
+		os.Remove(inputFile.Name())
+		// The modification time tells when the song was last used, for the eviction
+		now := time.Now()
+		os.Chtimes(output, now, now)
+		return output, nil
+	}
+
+	t.jobsLock.Lock()
+	current, exist := t.jobs[key]
+	if !exist {
+		current = &job{done: make(chan struct{}), reports: make(map[int]func(Progress))}
+		t.jobs[key] = current
+	}
+	reportID := current.addReport(progressFrom(ctx))
+	t.jobsLock.Unlock()
+	if exist {
+		os.Remove(inputFile.Name())
+	} else {
+		go t.runJob(key, current, inputFile.Name(), output)
+	}
+	select {
+	case <-current.done:
+		return current.path, current.err
+	case <-ctx.Done():
+		current.removeReport(reportID)
+		return "", ctx.Err()
+	}
+}
+
+// runJob converts the input of a job, then removes it
+func (t *Transcoder) runJob(key string, current *job, input string, output string) {
+	defer os.Remove(input)
+	ctx, cancel := context.WithTimeout(WithProgress(context.Background(), current.report), jobTimeout)
+	defer cancel()
+	current.path = output
+	current.err = t.run(ctx, input, output)
+	if current.err != nil {
+		current.path = ""
+	} else if err := t.evict(output); err != nil {
+		log.Printf("fail to evict converted songs: %v\n", err)
+	}
+	t.jobsLock.Lock()
+	delete(t.jobs, key)
+	t.jobsLock.Unlock()
+	close(current.done)
+}
+
+// addReport registers the progress callback of a caller, and returns its id
+func (j *job) addReport(report func(Progress)) int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.nextID++
+	j.reports[j.nextID] = report
+	return j.nextID
+}
+
+// removeReport stops reporting the progress to a caller which gave up
+func (j *job) removeReport(id int) {
+	j.lock.Lock()
+	delete(j.reports, id)
+	j.lock.Unlock()
+}
+
+// report passes the progress on to every caller waiting for the job
+func (j *job) report(progress Progress) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, report := range j.reports {
+		report(progress)
+	}
+}
+
+// evict removes the converted songs used the least recently until the cache fits its size, keeping the given one
+func (t *Transcoder) evict(keep string) error {
+	paths, err := filepath.Glob(filepath.Join(t.cacheDir, "*.ogg"))
+	if err != nil {
+		return err
+	}
+	type cached struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	files := []cached{}
+	var total int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, cached{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if total <= t.cacheSize {
+			break
+		}
+		if file.path == keep {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= file.size
+	}
+	return nil
+}
+
+// run invokes ffmpeg, the output only appears in the cache once the conversion succeeded
+func (t *Transcoder) run(ctx context.Context, input string, output string) error {
+	partial := output + ".part"
+	defer os.Remove(partial)
+	cmd := exec.CommandContext(ctx, t.ffmpeg,
+		"-hide_banner", "-nostdin", "-nostats", "-y",
+		"-i", input,
+		"-vn", "-map_metadata", "0",
+		"-c:a", "libopus", "-b:a", t.bitrate, "-ar", "48000",
+		"-progress", "pipe:1",
+		"-f", "ogg", partial,
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return ErrFFmpegNotFound
+		}
+		return err
+	}
+
+	// ffmpeg prints the input duration on stderr, and the progress as key=value lines on stdout
+	var total time.Duration
+	var totalLock sync.Mutex
+	stderrTail := []string{}
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if match := durationPattern.FindStringSubmatch(line); match != nil {
+				totalLock.Lock()
+				total = parseTimestamp(match[1], match[2], match[3])
+				totalLock.Unlock()
+			}
+			stderrTail = append(stderrTail, line)
+			if len(stderrTail) > 5 {
+				stderrTail = stderrTail[1:]
+			}
+		}
+	}()
+	report := progressFrom(ctx)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if key != "out_time_us" {
+			continue
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		totalLock.Lock()
+		report(Progress{Done: time.Duration(us) * time.Microsecond, Total: total})
+		totalLock.Unlock()
+	}
+	<-stderrDone
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.Join(stderrTail, "; "))
+	}
+	return os.Rename(partial, output)
+}
+
+func parseTimestamp(hours string, minutes string, seconds string) time.Duration {
+	h, _ := strconv.Atoi(hours)
+	m, _ := strconv.Atoi(minutes)
+	s, _ := strconv.ParseFloat(seconds, 64)
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s*float64(time.Second))
+}
@@ -0,0 +1,249 @@
+/*
+This access.go decides who may join a room. Private rooms are hidden from the stats and only let their members in.
+Users become members by joining with the room's password or an invite, and stay members if they come back.
+*/
+package room
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Longest password, bcrypt ignores what follows
+const maxPasswordLength = 72
+
+var (
+	ErrPasswordRequired = errors.New("this room is private, a password or an invite is required")
+	ErrInviteRequired   = errors.New("this room is private, an invite is required")
+	ErrWrongPassword    = errors.New("wrong password")
+	ErrInviteUsedUp     = errors.New("this invite was used up")
+	ErrInvalidPassword  = fmt.Errorf("passwords may be up to %d bytes", maxPasswordLength)
+	ErrNotPrivate       = errors.New("this room isn't private")
+	ErrInvalidInviteTTL = errors.New("invalid invite duration")
+)
+
+// Credentials prove that a user may join a private room, either may be empty
+type Credentials struct {
+	Password string
+	Invite   string
+}
+
+// Codes of join_error events, for clients to tell why they were turned away
+var joinErrorCodes = []struct {
+	err  error
+	code string
+}{
+	{auth.ErrNoToken, "unauthorized"},
+	{auth.ErrInvalidToken, "unauthorized"},
+	{ErrRoomLocked, "room_locked"},
+	{ErrKicked, "kicked"},
+	{ErrUserAlreadyJoined, "already_joined"},
+	{ErrPasswordRequired, "password_required"},
+	{ErrInviteRequired, "invite_required"},
+	{ErrWrongPassword, "wrong_password"},
+	{ErrInvalidPassword, "wrong_password"},
+	{auth.ErrInvalidInvite, "invalid_invite"},
+	{auth.ErrInviteExpired, "invite_expired"},
+	{ErrInviteUsedUp, "invite_used_up"},
+}
+
+// JoinError returns the join_error event telling a user why they can't join a room
+func JoinError(err error) *socket.OutboundEvent {
+	code := "join_failed"
+	for _, c := range joinErrorCodes {
+		if errors.Is(err, c.err) {
+			code = c.code
+			break
+		}
+	}
+	return &socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "join_error", Desc: err.Error()},
+		Code:      code,
+	}
+}
+
+// ValidatePassword checks that the given password can protect a room
+func ValidatePassword(password string) error {
+	if len(password) > maxPasswordLength {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// hashPassword hashes a password, an empty password gives no hash
+func hashPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	if err := ValidatePassword(password); err != nil {
+		return nil, err
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// Private tells whether this room is hidden and only lets its members in
+func (r *Room) Private() bool {
+	r.accessLock.Lock()
+	defer r.accessLock.Unlock()
+	return r.private
+}
+
+// IsMember tells whether the given user may see this room, everyone may see public rooms
+func (r *Room) IsMember(id string) bool {
+	r.accessLock.Lock()
+	defer r.accessLock.Unlock()
+	return !r.private || r.members[id]
+}
+
+// Admit checks that the given user may join this room before they connect.
+// Users joining a private room with valid credentials become its members, its creator already is one.
+func (r *Room) Admit(id string, credentials Credentials) error {
+	if r.Locked() {
+		return ErrRoomLocked
+	}
+	r.accessLock.Lock()
+	defer r.accessLock.Unlock()
+	if r.kicked[id] {
+		return ErrKicked
+	}
+	if !r.private || r.members[id] {
+		return nil
+	}
+	if credentials.Invite != "" {
+		invite, err := r.invites.Verify(credentials.Invite, r.Name)
+		if err != nil {
+			return err
+		}
+		if invite.Uses > 0 && r.inviteUses[invite.ID] >= invite.Uses {
+			return ErrInviteUsedUp
+		}
+		r.inviteUses[invite.ID]++
+		r.members[id] = true
+		return nil
+	}
+	if r.password == nil {
+		return ErrInviteRequired
+	}
+	if credentials.Password == "" {
+		return ErrPasswordRequired
+	}
+	if bcrypt.CompareHashAndPassword(r.password, []byte(credentials.Password)) != nil {
+		return ErrWrongPassword
+	}
+	r.members[id] = true
+	return nil
+}
+
+// admit checks again that the given user may join once they are connected, the room may have changed meanwhile
+func (r *Room) admit(u *user.User) error {
+	if r.Locked() {
+		return ErrRoomLocked
+	}
+	r.accessLock.Lock()
+	defer r.accessLock.Unlock()
+	if r.kicked[u.ID] {
+		return ErrKicked
+	}
+	if r.private && !r.members[u.ID] {
+		if r.password == nil {
+			return ErrInviteRequired
+		}
+		return ErrPasswordRequired
+	}
+	return nil
+}
+
+// ban keeps the given user out of this room
+func (r *Room) ban(id string) {
+	r.accessLock.Lock()
+	defer r.accessLock.Unlock()
+	r.kicked[id] = true
+	delete(r.members, id)
+}
+
+// makePrivate hides this room, the users in it become its members. A nil password keeps the current one
+// and an empty one removes it, so only invites let users in.
+func (r *Room) makePrivate(host *user.User, password *string) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	r.accessLock.Lock()
+	if password != nil {
+		hash, err := hashPassword(*password)
+		if err != nil {
+			r.accessLock.Unlock()
+			return err
+		}
+		r.password = hash
+	}
+	r.private = true
+	for id := range r.users {
+		r.members[id] = true
+	}
+	r.accessLock.Unlock()
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "room_private"},
+		Room:      r.Wrap(),
+	}, nil)
+	return nil
+}
+
+// makePublic shows this room to everyone and lets anyone in
+func (r *Room) makePublic(host *user.User) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	r.accessLock.Lock()
+	r.private = false
+	r.password = nil
+	r.accessLock.Unlock()
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "room_public"},
+		Room:      r.Wrap(),
+	}, nil)
+	return nil
+}
+
+// createInvite sends the host an invite to this private room, lasting the given duration or a day if 0.
+// The invite lets the given number of users in, or any number if 0.
+func (r *Room) createInvite(host *user.User, ttl time.Duration, uses int) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	if !r.Private() {
+		return ErrNotPrivate
+	}
+	if ttl < 0 {
+		return ErrInvalidInviteTTL
+	}
+	if ttl == 0 {
+		ttl = auth.DefaultInviteTTL
+	}
+	token, invite, err := r.invites.Issue(r.Name, ttl, uses)
+	if err != nil {
+		return err
+	}
+	return host.SendEvent(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "invite"},
+		Invite: &socket.InviteWrap{
+			Token:     token,
+			URL:       fmt.Sprintf("/ws/%s?invite=%s", url.PathEscape(r.Name), url.QueryEscape(token)),
+			ExpiresAt: invite.ExpiresAt,
+			Uses:      invite.Uses,
+		},
+	})
+}
+
+// hasPassword tells whether this room is protected by a password
+func (r *Room) hasPassword() bool {
+	r.accessLock.Lock()
+	defer r.accessLock.Unlock()
+	return r.password != nil
+}
@@ -0,0 +1,166 @@
+package room
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+// newPrivateRoom returns a private room of the given member, protected by the given password unless it is empty
+func newPrivateRoom(t *testing.T, member string, password string) *Room {
+	t.Helper()
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Room{
+		Name:       "room",
+		invites:    auth.NewInvites([]byte("invite secret")),
+		private:    true,
+		password:   hash,
+		members:    map[string]bool{member: true},
+		inviteUses: map[string]int{},
+		kicked:     map[string]bool{},
+	}
+}
+
+// issueInvite returns an invite to the given room
+func issueInvite(t *testing.T, r *Room, room string, ttl time.Duration, uses int) string {
+	t.Helper()
+	token, _, err := r.invites.Issue(room, ttl, uses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAdmit(t *testing.T) {
+	withPassword := newPrivateRoom(t, "host", "secret")
+	withPassword.kicked["banned"] = true
+	withoutPassword := newPrivateRoom(t, "host", "")
+	public := &Room{Name: "room", kicked: map[string]bool{"banned": true}}
+	locked := newPrivateRoom(t, "host", "secret")
+	locked.locked.Store(true)
+	otherInvites := &Room{invites: auth.NewInvites([]byte("other secret"))}
+
+	tests := []struct {
+		name        string
+		room        *Room
+		id          string
+		credentials Credentials
+		wantErr     error
+	}{
+		{name: "public room", room: public, id: "guest"},
+		{name: "kicked from a public room", room: public, id: "banned", wantErr: ErrKicked},
+		{name: "member", room: withPassword, id: "host"},
+		{name: "locked", room: locked, id: "host", wantErr: ErrRoomLocked},
+		{name: "kicked", room: withPassword, id: "banned", credentials: Credentials{Password: "secret"}, wantErr: ErrKicked},
+		{name: "password", room: withPassword, id: "guest", credentials: Credentials{Password: "secret"}},
+		{name: "wrong password", room: withPassword, id: "guest", credentials: Credentials{Password: "guess"}, wantErr: ErrWrongPassword},
+		{name: "no password", room: withPassword, id: "guest", wantErr: ErrPasswordRequired},
+		{name: "no invite", room: withoutPassword, id: "guest", credentials: Credentials{Password: "secret"}, wantErr: ErrInviteRequired},
+		{name: "invite", room: withoutPassword, id: "guest", credentials: Credentials{Invite: issueInvite(t, withoutPassword, "room", time.Hour, 0)}},
+		{
+			name:        "invite instead of a password",
+			room:        withPassword,
+			id:          "guest",
+			credentials: Credentials{Password: "guess", Invite: issueInvite(t, withPassword, "room", time.Hour, 0)},
+		},
+		{
+			name:        "invite to another room",
+			room:        withoutPassword,
+			id:          "guest",
+			credentials: Credentials{Invite: issueInvite(t, withoutPassword, "other", time.Hour, 0)},
+			wantErr:     auth.ErrInvalidInvite,
+		},
+		{
+			name:        "invite of another server",
+			room:        withoutPassword,
+			id:          "guest",
+			credentials: Credentials{Invite: issueInvite(t, otherInvites, "room", time.Hour, 0)},
+			wantErr:     auth.ErrInvalidInvite,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			member := test.room.members[test.id]
+			err := test.room.Admit(test.id, test.credentials)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Admit(%q) error = %v, want %v", test.id, err, test.wantErr)
+			}
+			if err == nil && test.room.private && !member {
+				// Admitted users become members and come back without credentials
+				defer delete(test.room.members, test.id)
+				if err := test.room.Admit(test.id, Credentials{}); err != nil {
+					t.Errorf("Admit(%q) error = %v once a member", test.id, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmitInviteUses(t *testing.T) {
+	r := newPrivateRoom(t, "host", "")
+	invite := Credentials{Invite: issueInvite(t, r, "room", time.Hour, 2)}
+	steps := []struct {
+		id      string
+		wantErr error
+	}{
+		{id: "alice"},
+		// Members coming back don't use the invite again
+		{id: "alice"},
+		{id: "bob"},
+		{id: "carol", wantErr: ErrInviteUsedUp},
+	}
+	for _, step := range steps {
+		if err := r.Admit(step.id, invite); !errors.Is(err, step.wantErr) {
+			t.Errorf("Admit(%q) error = %v, want %v", step.id, err, step.wantErr)
+		}
+	}
+	if r.IsMember("carol") {
+		t.Error("carol became a member with an invite used up")
+	}
+	unlimited := Credentials{Invite: issueInvite(t, r, "room", time.Hour, 0)}
+	for _, id := range []string{"carol", "dave", "erin"} {
+		if err := r.Admit(id, unlimited); err != nil {
+			t.Errorf("Admit(%q) with an unlimited invite error = %v", id, err)
+		}
+	}
+}
+
+func TestAdmitFirstUser(t *testing.T) {
+	// Creators are members from the start, whoever joins a private room first needs credentials like everyone else
+	r := newPrivateRoom(t, "host", "secret")
+	delete(r.members, "host")
+	if err := r.Admit("guest", Credentials{}); !errors.Is(err, ErrPasswordRequired) {
+		t.Errorf("Admit() error = %v, want %v", err, ErrPasswordRequired)
+	}
+}
+
+func TestAdmitConnected(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		member   bool
+		wantErr  error
+	}{
+		{name: "member", password: "secret", member: true},
+		{name: "room with a password", password: "secret", wantErr: ErrPasswordRequired},
+		{name: "room joined with invites only", password: "", wantErr: ErrInviteRequired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The room was made private while the user connected
+			r := newPrivateRoom(t, "host", test.password)
+			if test.member {
+				r.members["guest"] = true
+			}
+			if err := r.admit(&user.User{ID: "guest"}); !errors.Is(err, test.wantErr) {
+				t.Errorf("admit() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+const (
+	// Messages kept by rooms for late joiners
+	chatHistoryLength = 100
+	// Longest chat message, in characters
+	maxChatLength = 500
+)
+
+var (
+	ErrEmptyChat   = errors.New("empty chat message")
+	ErrChatTooLong = fmt.Errorf("chat messages may be up to %d characters", maxChatLength)
+)
+
+// chat sends a message to everyone in this room, and keeps it for the users joining later
+func (r *Room) chat(u *user.User, message string) error {
+	message = strings.TrimSpace(message)
+	if message == "" || !utf8.ValidString(message) {
+		return ErrEmptyChat
+	}
+	if utf8.RuneCountInString(message) > maxChatLength {
+		return ErrChatTooLong
+	}
+	r.chatLock.Lock()
+	r.chatSeq++
+	chat := &socket.ChatWrap{
+		ID:      r.chatSeq,
+		UserID:  u.ID,
+		Name:    u.Profile().Name,
+		Message: message,
+		SentAt:  time.Now(),
+	}
+	r.chatHistory = append(r.chatHistory, chat)
+	if len(r.chatHistory) > chatHistoryLength {
+		// Reslicing lets append reallocate a smaller array once the current one is full
+		r.chatHistory = r.chatHistory[len(r.chatHistory)-chatHistoryLength:]
+	}
+	r.chatLock.Unlock()
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "chat"},
+		Chat:      chat,
+	}, nil)
+	return nil
+}
+
+// ChatHistory returns the last messages of this room, up to the given number or all the kept ones if 0, oldest first
+func (r *Room) ChatHistory(limit int) []*socket.ChatWrap {
+	r.chatLock.Lock()
+	defer r.chatLock.Unlock()
+	history := r.chatHistory
+	if limit > 0 && limit < len(history) {
+		history = history[len(history)-limit:]
+	}
+	return append([]*socket.ChatWrap{}, history...)
+}
@@ -0,0 +1,122 @@
+package room
+
+import (
+	"log"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+)
+
+/*
+A singer hears the music after the downlink delay, and their voice reaches the server after the uplink
+delay, so their voice comes back one round trip behind the music. Singers therefore get the music as soon
+as possible, while everybody else gets it delayed by the longest round trip among singers. The voices of
+singers closer to the server are delayed by the difference, so that all singers stay in step.
+*/
+
+const (
+	// Period at which offsets are updated from the latest round trip times
+	alignmentPeriod = time.Second
+	// Longest delay applied to the music, users further away than that are partially compensated
+	maxAlignment = 500 * time.Millisecond
+	// The music delay only changes when the round trip times move by more than this, each change is audible
+	alignmentHysteresis = 20 * time.Millisecond
+)
+
+// alignment is the latency measured for a user, and the offsets applied to align them
+type alignment struct {
+	rtt        time.Duration
+	singer     bool
+	musicDelay time.Duration // how late the user hears the music
+	voiceDelay time.Duration // how late the others hear the user's voice
+}
+
+// singers returns the users singing along with the music, that is the users on stage
+func (r *Room) singers() map[string]bool {
+	singers := map[string]bool{}
+	for id, u := range r.users {
+		if u.OnStage() {
+			singers[id] = true
+		}
+	}
+	return singers
+}
+
+// align updates the offsets of all users from their latest round trip times
+func (r *Room) align() {
+	singers := r.singers()
+	alignments := make(map[string]*alignment, len(r.users))
+	var lead time.Duration
+	for id, u := range r.users {
+		a := &alignment{rtt: u.RTT(), singer: singers[id]}
+		if a.singer && a.rtt > lead {
+			lead = a.rtt
+		}
+		alignments[id] = a
+	}
+	if lead > maxAlignment {
+		lead = maxAlignment
+	}
+	if diff := lead - r.leadDelay; diff < alignmentHysteresis && diff > -alignmentHysteresis && lead != 0 {
+		lead = r.leadDelay
+	}
+	r.leadDelay = lead
+
+	for id, a := range alignments {
+		if a.singer {
+			if a.rtt < lead {
+				a.voiceDelay = lead - a.rtt
+			}
+		} else {
+			a.musicDelay = lead
+		}
+		if r.mixer != nil {
+			r.mixer.SetDelays(id, a.musicDelay, a.voiceDelay)
+			continue
+		}
+		track := r.audioHub.DelayedTrack()
+		if a.singer {
+			track = r.audioHub.Track()
+		}
+		if err := r.users[id].SwitchMusicTrack(track); err != nil {
+			log.Printf("room %s: fail to switch the music track of %s: %v\n", r.Name, id, err)
+		}
+	}
+	if r.mixer == nil {
+		r.audioHub.SetListenerDelay(lead)
+	}
+	r.alignLock.Lock()
+	r.alignments = alignments
+	r.alignLock.Unlock()
+}
+
+// voiceDelay returns how late the voice of the given user is forwarded
+func (r *Room) voiceDelay(id string) time.Duration {
+	r.alignLock.RLock()
+	defer r.alignLock.RUnlock()
+	if a, exist := r.alignments[id]; exist {
+		return a.voiceDelay
+	}
+	return 0
+}
+
+// alignmentWrap returns the public latency report of all users
+func (r *Room) alignmentWrap() []*socket.AlignmentWrap {
+	r.alignLock.RLock()
+	defer r.alignLock.RUnlock()
+	wraps := []*socket.AlignmentWrap{}
+	for id, a := range r.alignments {
+		wraps = append(wraps, &socket.AlignmentWrap{
+			UserID:     id,
+			RTT:        milliseconds(a.rtt),
+			Singer:     a.singer,
+			MusicDelay: milliseconds(a.musicDelay),
+			VoiceDelay: milliseconds(a.voiceDelay),
+		})
+	}
+	return wraps
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
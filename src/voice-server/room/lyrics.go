@@ -0,0 +1,37 @@
+package room
+
+import (
+	"context"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/stream"
+)
+
+// Period at which the playback clock is checked against the lyrics
+const lyricsPollPeriod = 50 * time.Millisecond
+
+// followLyrics sends a lyric_line event whenever the backing track reaches another line, until ctx is done.
+// It follows the hub's playback position, so it stays aligned after a pause or a seek.
+func (r *Room) followLyrics(ctx context.Context, lyrics *stream.Lyrics) {
+	ticker := time.NewTicker(lyricsPollPeriod)
+	defer ticker.Stop()
+	current := -1
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			index := lyrics.LineAt(r.audioHub.Position())
+			if index == current || index < 0 {
+				current = index
+				continue
+			}
+			current = index
+			r.broadcast(&socket.OutboundEvent{
+				EventBase: socket.EventBase{Type: "lyric_line"},
+				LyricLine: lyrics.Lines[index],
+			}, nil)
+		}
+	}
+}
@@ -9,8 +9,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/mixer"
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/mq"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/recorder"
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
 	"github.com/Nahemah1022/singsphere-voice-server/stream"
 	"github.com/Nahemah1022/singsphere-voice-server/user"
@@ -23,33 +29,102 @@ type RoomsStats struct {
 }
 
 type RoomManager struct {
-	rooms  map[string]*Room
-	mqConn *amqp.Connection
+	rooms       map[string]*Room
+	mqConn      *amqp.Connection
+	mediaSource stream.MediaSource
+	crossfade   time.Duration // default overlap between consecutive songs
+	loudness    *stream.LoudnessCache
+	target      float64 // default loudness target of rooms, in LUFS
+	mode        string  // default mode of rooms
+	recorder    *recorder.Recorder
+	clipLength  time.Duration // audio kept by rooms to cut clips from
+	invites     *auth.Invites
+}
+
+// Options of a new room
+type Options struct {
+	Mode     string // ModeSFU or ModeMCU, the default mode if empty or invalid
+	Private  bool
+	Password string // password of a private room, if empty only invites let users in
+	Creator  string // id of the user creating the room, the first member of a private room
 }
 
 var ErrNotFound = errors.New("not found")
 
-// Get a room or create one if it does not exist
-func (rm *RoomManager) GetOrCreate(name string) *Room {
+// Get a room or create one with the given options if it does not exist, the password must be valid
+func (rm *RoomManager) GetOrCreate(name string, options Options) *Room {
 	if room, exist := rm.rooms[name]; exist {
 		return room
 	}
-	audioHub, err := stream.New(name)
+	mode := options.Mode
+	if mode != ModeSFU && mode != ModeMCU {
+		mode = rm.mode
+	}
+	audioHub, err := stream.New(name, rm.mediaSource, rm.loudness)
 	if err != nil {
 		panic(err)
 	}
-	consumer, err := mq.New(name, rm.mqConn)
+	audioHub.SetCrossfade(rm.crossfade)
+	audioHub.SetLoudnessTarget(rm.target)
+	var audioMixer *mixer.Mixer
+	if mode == ModeMCU {
+		if audioMixer, err = mixer.New(); err != nil {
+			// Forwarding still works without the codec, it only costs more bandwidth. The room reports
+			// the mode it really uses, so clients know they receive every mic.
+			log.Printf("room %s: fail to mix on the server, forwarding tracks instead: %v\n", name, err)
+			mode = ModeSFU
+		} else {
+			// The mixer runs while the room has users, see startMixer
+			audioHub.SetOutput(audioMixer)
+		}
+	}
+	songRequestCh := make(chan string)
+	consumer, err := mq.New(name, rm.mqConn, songRequestCh)
+	if err != nil {
+		// The room stays usable for voice chat even if song requests can't be consumed
+		log.Printf("room %s: fail to consume song requests: %v\n", name, err)
+	}
+	password, err := hashPassword(options.Password)
 	if err != nil {
 		panic(err)
 	}
+	var ring *recorder.Ring
+	if rm.recorder != nil {
+		ring = recorder.NewRing(rm.clipLength)
+		audioHub.AddTap(ring)
+	}
 	newRoom := &Room{
-		Name:          name,
-		users:         make(map[string]*user.User),
-		UserJoinCh:    make(chan *user.User),
-		UserLeaveCh:   make(chan *user.User),
-		audioHub:      audioHub,
-		SongRequestCh: make(chan string),
-		mqConsumer:    consumer,
+		Name:             name,
+		mode:             mode,
+		mixer:            audioMixer,
+		users:            make(map[string]*user.User),
+		joinOrder:        make(map[string]int64),
+		UserJoinCh:       make(chan *user.User),
+		UserLeaveCh:      make(chan *user.User),
+		UserRequestCh:    make(chan *user.Request),
+		audioHub:         audioHub,
+		SongRequestCh:    songRequestCh,
+		mqConsumer:       consumer,
+		playlist:         NewPlaylist(),
+		songLoadedCh:     make(chan *loadedSong),
+		songEndCh:        make(chan error),
+		prefetchedCh:     make(chan *prefetch),
+		snapshotCh:       make(chan chan *socket.RoomWrap),
+		recorder:         rm.recorder,
+		ring:             ring,
+		clipJobs:         make(chan struct{}, maxClipJobs),
+		invites:          rm.invites,
+		private:          options.Private,
+		password:         password,
+		members:          make(map[string]bool),
+		inviteUses:       make(map[string]int),
+		kicked:           make(map[string]bool),
+		reactionBuckets:  make(map[string]*reactionBucket),
+		pendingReactions: make(map[string]int),
+		songReactions:    make(map[string]int),
+	}
+	if options.Creator != "" {
+		newRoom.members[options.Creator] = true
 	}
 	rm.rooms[name] = newRoom
 	go newRoom.run()
@@ -64,31 +139,55 @@ func (rm *RoomManager) Get(name string) (*Room, error) {
 	return nil, ErrNotFound
 }
 
-// Get statistical metadata of all rooms
-func (rm *RoomManager) GetStats() RoomsStats {
+// Get statistical metadata of the rooms the given user may see, private rooms are only shown to their members
+func (rm *RoomManager) GetStats(userID string) RoomsStats {
 	stats := RoomsStats{
 		Rooms: []*socket.RoomWrap{},
 	}
 	for _, r := range rm.rooms {
-		if len(r.users) == 0 {
+		if !r.IsMember(userID) {
+			continue
+		}
+		snapshot := r.Snapshot()
+		if snapshot.Online == 0 {
 			continue
 		}
-		stats.Online += len(r.users)
-		stats.Rooms = append(stats.Rooms, r.Wrap())
+		stats.Online += snapshot.Online
+		stats.Rooms = append(stats.Rooms, snapshot)
 	}
 	return stats
 }
 
+// Snapshot returns the public representation of this room, it is built by the room's loop so it is
+// safe to call from other goroutines
+func (r *Room) Snapshot() *socket.RoomWrap {
+	reply := make(chan *socket.RoomWrap, 1)
+	r.snapshotCh <- reply
+	return <-reply
+}
+
+// Wrap returns the public representation of this room, it must only be called by the room's loop
 func (r *Room) Wrap() *socket.RoomWrap {
 	usersWrap := []*socket.UserWrap{}
 	for _, user := range r.users {
 		usersWrap = append(usersWrap, user.Wrap())
 	}
 	return &socket.RoomWrap{
-		Users:   usersWrap,
-		Name:    r.Name,
-		Online:  len(r.users),
-		Playing: nil,
+		Users:          usersWrap,
+		Name:           r.Name,
+		Mode:           r.mode,
+		Online:         len(r.users),
+		Playing:        r.playbackWrap(),
+		Queue:          r.playlist.Wrap(),
+		Crossfade:      r.audioHub.Crossfade().Seconds(),
+		LoudnessTarget: r.audioHub.LoudnessTarget(),
+		Alignment:      r.alignmentWrap(),
+		Recording:      r.recordingID(),
+		HandQueue:      r.handQueueWrap(),
+		Host:           r.hostID,
+		Locked:         r.Locked(),
+		Private:        r.Private(),
+		HasPassword:    r.hasPassword(),
 	}
 }
 
@@ -103,9 +202,57 @@ func NewRoomManager() *RoomManager {
 	if err != nil {
 		log.Println("fail to connect to RabbitMQ")
 	}
+	source, err := stream.SourceFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Consecutive songs are handed off back to back unless CROSSFADE_DURATION is set, e.g. "3s"
+	crossfade, _ := time.ParseDuration(os.Getenv("CROSSFADE_DURATION"))
+	if crossfade > 0 && !codec.Available {
+		// Songs would silently be handed off back to back instead
+		log.Fatalln("CROSSFADE_DURATION is set but", codec.ErrUnavailable)
+	}
+	loudness, err := stream.LoudnessCacheFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	mode := os.Getenv("ROOM_MODE")
+	if mode != ModeMCU {
+		mode = ModeSFU
+	}
+	if mode == ModeMCU && !codec.Available {
+		log.Fatalln("ROOM_MODE is mcu but", codec.ErrUnavailable)
+	}
+	target, err := strconv.ParseFloat(os.Getenv("LOUDNESS_TARGET"), 64)
+	if err != nil || ValidateLoudnessTarget(target) != nil {
+		target = stream.DefaultLoudnessTarget
+	}
+	rec, err := recorder.FromEnv()
+	if err != nil {
+		// Rooms still work, they just can't be recorded
+		log.Printf("fail to set up recordings: %v\n", err)
+		rec = nil
+	}
+	// Clips are cut from the last CLIP_DURATION of rooms, e.g. "45s"
+	clipLength, err := time.ParseDuration(os.Getenv("CLIP_DURATION"))
+	if err != nil || clipLength <= 0 {
+		clipLength = defaultClipLength
+	}
+	invites, err := auth.InvitesFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	return &RoomManager{
-		rooms:  make(map[string]*Room, 100),
-		mqConn: conn,
+		rooms:       make(map[string]*Room, 100),
+		mqConn:      conn,
+		mediaSource: source,
+		crossfade:   crossfade,
+		loudness:    loudness,
+		target:      target,
+		mode:        mode,
+		recorder:    rec,
+		clipLength:  clipLength,
+		invites:     invites,
 	}
 }
@@ -0,0 +1,107 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+var (
+	ErrRoomLocked    = errors.New("this room is locked")
+	ErrKicked        = errors.New("you were kicked out of this room")
+	ErrMuteLocked    = errors.New("the host muted you")
+	ErrSelfTarget    = errors.New("the host can't do this to themselves")
+	ErrNotMuteLocked = errors.New("this user wasn't muted by the host")
+)
+
+// Locked tells whether this room turns new users away
+func (r *Room) Locked() bool {
+	return r.locked.Load()
+}
+
+// otherTarget returns the user the host targets, who must be someone else
+func (r *Room) otherTarget(host *user.User, id string) (*user.User, error) {
+	if err := r.requireHost(host); err != nil {
+		return nil, err
+	}
+	if id == host.ID {
+		return nil, ErrSelfTarget
+	}
+	return r.target(id)
+}
+
+// kick disconnects a user, who can't join this room again
+func (r *Room) kick(host *user.User, id string) error {
+	u, err := r.otherTarget(host, id)
+	if err != nil {
+		return err
+	}
+	log.Printf("room %s: host %s kicked user %s\n", r.Name, host.ID, u.ID)
+	r.ban(u.ID)
+	// The user is removed at once, nothing is sent to them anymore while their connection closes
+	r.remove(u, &socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "user_kicked", Desc: fmt.Sprintf("user %s was kicked out", u.ID)},
+		User:      u.Wrap(),
+	})
+	u.Disconnect(socket.CloseKicked, ErrKicked.Error())
+	return nil
+}
+
+// forceMute mutes a user, who can't unmute themselves until the host releases them
+func (r *Room) forceMute(host *user.User, id string) error {
+	u, err := r.otherTarget(host, id)
+	if err != nil {
+		return err
+	}
+	u.SetMuteLocked(true)
+	r.setMuted(u, true)
+	return nil
+}
+
+// releaseMute lets a user muted by the host unmute themselves again, they stay muted until they do
+func (r *Room) releaseMute(host *user.User, id string) error {
+	u, err := r.otherTarget(host, id)
+	if err != nil {
+		return err
+	}
+	if !u.MuteLocked() {
+		return ErrNotMuteLocked
+	}
+	u.SetMuteLocked(false)
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "mute_released", Desc: fmt.Sprintf("user %s may unmute", u.ID)},
+		User:      u.Wrap(),
+	}, nil)
+	return nil
+}
+
+// setLocked opens or closes this room to new users
+func (r *Room) setLocked(host *user.User, locked bool) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	r.locked.Store(locked)
+	eventType := "room_unlocked"
+	if locked {
+		eventType = "room_locked"
+	}
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: eventType},
+		Room:      r.Wrap(),
+	}, nil)
+	return nil
+}
+
+// transferHost hands the host role to another user, the previous host stays on stage as a singer
+func (r *Room) transferHost(host *user.User, id string) error {
+	u, err := r.otherTarget(host, id)
+	if err != nil {
+		return err
+	}
+	r.setRole(host, user.RoleSinger)
+	r.setHost(u)
+	return nil
+}
@@ -0,0 +1,329 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/transcode"
+	"github.com/Nahemah1022/singsphere-voice-server/stream"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+var (
+	ErrNothingPlaying   = errors.New("no song is playing")
+	ErrInvalidCrossfade = errors.New("invalid crossfade duration")
+	ErrInvalidLoudness  = errors.New("invalid loudness target")
+)
+
+const (
+	// Longest overlap allowed between consecutive songs
+	maxCrossfade = 12 * time.Second
+	// Range of loudness targets rooms may use, in LUFS
+	minLoudnessTarget = -40.0
+	maxLoudnessTarget = -5.0
+)
+
+// enqueue appends the requested song to this room's playlist, and starts playing it if the room is idle
+func (r *Room) enqueue(music *stream.Music, requesterID string) {
+	log.Printf("room %s: enqueue song %s\n", r.Name, music.SongName)
+	r.playlist.Push(music, requesterID)
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "enqueue", Desc: fmt.Sprintf("song %s enqueued", music.SongName)},
+		Song:      music,
+	}, nil)
+	if r.current == nil {
+		r.playNext()
+		return
+	}
+	r.broadcastQueue()
+	r.prefetchNext()
+}
+
+// playNext pops the next song from the playlist and streams it through the room's audio hub.
+// The song is taken from the prefetch if it was already opened, so it follows the previous one without gaps.
+func (r *Room) playNext() {
+	var item *QueueItem
+	p := r.takePrefetch()
+	if p != nil {
+		item = p.item
+	} else {
+		item = r.playlist.Pop()
+	}
+	if item == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.current = item
+	r.startedAt = time.Now()
+	r.stopSong = cancel
+	r.broadcastQueue()
+	go func() {
+		defer cancel()
+		var song *stream.Song
+		var err error
+		if p != nil {
+			// The prefetch context keeps the song's stream alive, it is released once the song ends
+			defer p.cancel()
+			select {
+			case <-p.done:
+				song, err = p.song, p.err
+			case <-ctx.Done():
+				p.cancel()
+				<-p.done
+				if p.song != nil {
+					p.song.Close()
+				}
+				r.songEndCh <- ctx.Err()
+				return
+			}
+		} else {
+			song, err = r.loadSong(ctx, item)
+		}
+		if err != nil {
+			r.songEndCh <- err
+			return
+		}
+		// Songs following the previous one start right away, others are scheduled a bit later
+		startAt, continuous := r.audioHub.NextStart(song)
+		var at time.Time
+		if !continuous {
+			startAt = time.Now().Add(scheduleLead)
+			at = startAt
+		}
+		r.songLoadedCh <- &loadedSong{song: song, startAt: startAt}
+		if song.Lyrics != nil {
+			go r.followLyrics(ctx, song.Lyrics)
+		}
+		r.songEndCh <- r.audioHub.Play(ctx, song, at)
+	}()
+}
+
+// loadSong opens the song of the given item, songs in other formats are converted first
+func (r *Room) loadSong(ctx context.Context, item *QueueItem) (*stream.Song, error) {
+	// Let the room know how far the conversion went
+	ctx = transcode.WithProgress(ctx, func(progress transcode.Progress) {
+		r.broadcast(&socket.OutboundEvent{
+			EventBase: socket.EventBase{Type: "transcode_progress"},
+			Transcode: &socket.TranscodeWrap{
+				Song:    item.Music.SongName,
+				Percent: progress.Percent(),
+			},
+		}, nil)
+	})
+	return r.audioHub.Load(ctx, item.Music.SongName)
+}
+
+// songLoaded announces the current song once its metadata is known, right before it starts playing
+func (r *Room) songLoaded(loaded *loadedSong) {
+	song := loaded.song
+	r.current.Music = song.Music
+	r.lyrics = song.Lyrics
+	r.startedAt = loaded.startAt
+	r.scheduledAt = loaded.startAt
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "next_song", Desc: fmt.Sprintf("now playing %s", song.Music.SongName)},
+		Song:      song.Music,
+	}, nil)
+	if r.lyrics != nil {
+		r.broadcast(&socket.OutboundEvent{
+			EventBase: socket.EventBase{Type: "lyrics"},
+			Lyrics:    r.lyrics,
+		}, nil)
+	}
+	r.assignParts(song.Music)
+	if len(r.parts) > 0 {
+		r.broadcastPlayback("duet_parts")
+	}
+	r.startScoring(song)
+	r.syncScoreClock()
+	r.broadcastSchedule()
+	r.markRecordedSong(song.Music.SongName)
+	r.prefetchNext()
+}
+
+// songFailed reports to the whole room that the current song couldn't be streamed
+func (r *Room) songFailed(err error) {
+	log.Printf("room %s: fail to stream song: %v\n", r.Name, err)
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "song_error", Desc: fmt.Sprint(err)},
+		Song:      r.current.Music,
+	}, nil)
+}
+
+// skip stops the current song, the next one starts once the playback goroutine returns
+func (r *Room) skip(host *user.User) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	if r.current == nil {
+		return ErrNothingPlaying
+	}
+	r.stopSong()
+	return nil
+}
+
+// pause pauses the backing track for the whole room
+func (r *Room) pause(host *user.User) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	if err := r.audioHub.Pause(); err != nil {
+		return err
+	}
+	r.broadcastPlayback("paused")
+	r.reschedule(r.audioHub.Position())
+	return nil
+}
+
+// resume resumes the paused backing track for the whole room
+func (r *Room) resume(host *user.User) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	if err := r.audioHub.Resume(); err != nil {
+		return err
+	}
+	r.broadcastPlayback("resumed")
+	r.reschedule(r.audioHub.Position())
+	return nil
+}
+
+// seek moves the backing track to the given position, the hub applies it on its next tick
+func (r *Room) seek(host *user.User, pos time.Duration) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	if err := r.audioHub.Seek(pos); err != nil {
+		return err
+	}
+	playback := r.playbackWrap()
+	playback.Position = pos.Seconds()
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "seeked"},
+		Playback:  playback,
+	}, nil)
+	r.reschedule(pos)
+	return nil
+}
+
+// setCrossfade changes how long consecutive songs of this room overlap
+func (r *Room) setCrossfade(host *user.User, d time.Duration) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	if d < 0 || d > maxCrossfade {
+		return ErrInvalidCrossfade
+	}
+	if d > 0 && !codec.Available {
+		return codec.ErrUnavailable
+	}
+	r.audioHub.SetCrossfade(d)
+	crossfade := d.Seconds()
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "crossfade_updated"},
+		Crossfade: &crossfade,
+	}, nil)
+	return nil
+}
+
+// ValidateLoudnessTarget checks that songs can be normalized to the given loudness
+func ValidateLoudnessTarget(target float64) error {
+	if target < minLoudnessTarget || target > maxLoudnessTarget {
+		return fmt.Errorf("%w: %v LUFS is out of [%v, %v]", ErrInvalidLoudness, target, minLoudnessTarget, maxLoudnessTarget)
+	}
+	return nil
+}
+
+// SetLoudnessTarget overrides the loudness songs of this room are normalized to, from the next song loaded
+func (r *Room) SetLoudnessTarget(target float64) error {
+	if err := ValidateLoudnessTarget(target); err != nil {
+		return err
+	}
+	r.audioHub.SetLoudnessTarget(target)
+	r.broadcast(&socket.OutboundEvent{
+		EventBase:      socket.EventBase{Type: "loudness_target_updated"},
+		LoudnessTarget: &target,
+	}, nil)
+	return nil
+}
+
+// broadcastPlayback sends the now playing state to all users in this room
+func (r *Room) broadcastPlayback(eventType string) {
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: eventType},
+		Playback:  r.playbackWrap(),
+	}, nil)
+}
+
+// playbackWrap returns the public now playing state, or nil if the room is idle
+func (r *Room) playbackWrap() *socket.PlaybackWrap {
+	item := r.current
+	if item == nil {
+		return nil
+	}
+	duration := r.audioHub.Duration()
+	// Copy the song so its duration can be filled in without touching the queued item
+	music := *item.Music
+	if music.Duration == 0 {
+		music.Duration = int(duration.Seconds())
+	}
+	return &socket.PlaybackWrap{
+		Song:        &music,
+		RequesterID: item.RequesterID,
+		StartedAt:   r.startedAt,
+		Duration:    duration.Seconds(),
+		Position:    r.audioHub.Position().Seconds(),
+		Paused:      r.audioHub.Paused(),
+		Parts:       r.partsWrap(),
+	}
+}
+
+// removeQueued drops the pending song at the given position
+func (r *Room) removeQueued(host *user.User, pos int) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	if _, err := r.playlist.Remove(pos); err != nil {
+		return err
+	}
+	r.broadcastQueue()
+	r.prefetchNext()
+	return nil
+}
+
+// moveQueued reorders the pending song at position from to position to
+func (r *Room) moveQueued(host *user.User, from int, to int) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	if err := r.playlist.Move(from, to); err != nil {
+		return err
+	}
+	r.broadcastQueue()
+	r.prefetchNext()
+	return nil
+}
+
+// clearQueue drops all pending songs, the current song keeps playing
+func (r *Room) clearQueue(host *user.User) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	r.playlist.Clear()
+	r.broadcastQueue()
+	r.prefetchNext()
+	return nil
+}
+
+// broadcastQueue sends the up-to-date playlist to all users in this room
+func (r *Room) broadcastQueue() {
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "queue_updated"},
+		Queue:     r.playlist.Wrap(),
+	}, nil)
+}
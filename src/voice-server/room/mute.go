@@ -0,0 +1,35 @@
+package room
+
+import (
+	"fmt"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+	"github.com/pion/rtp"
+)
+
+// setMuted mutes or unmutes the mic of a user and tells the room
+func (r *Room) setMuted(u *user.User, muted bool) {
+	u.SetMuted(muted)
+	eventType, desc := "user_unmute", fmt.Sprintf("user %s unmuted", u.ID)
+	if muted {
+		eventType, desc = "user_mute", fmt.Sprintf("user %s muted", u.ID)
+	}
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: eventType, Desc: desc},
+		User:      u.Wrap(),
+	}, nil)
+}
+
+// silenced returns a copy of the packet carrying silence instead of the user's voice. Its sequence number,
+// timestamp and duration are kept, so the stream stays continuous for the receivers.
+func silenced(packet *rtp.Packet) *rtp.Packet {
+	payload := codec.SilentFrame
+	if samples, err := codec.PacketSamples(packet.Payload); err == nil {
+		payload = codec.Silence(samples)
+	}
+	silent := &rtp.Packet{Header: packet.Header.Clone(), Payload: payload}
+	silent.Padding, silent.PaddingSize = false, 0
+	return silent
+}
@@ -0,0 +1,137 @@
+package room
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/stream"
+)
+
+// QueueItem is a song waiting in a room's playlist
+type QueueItem struct {
+	ID          string
+	Music       *stream.Music
+	RequesterID string // empty if the song was requested through the message queue
+}
+
+// Playlist keeps the ordered songs pending in a room, position 0 is the next one to be played
+type Playlist struct {
+	items  []*QueueItem
+	nextID uint64
+	lock   sync.RWMutex
+}
+
+var ErrInvalidPosition = errors.New("invalid queue position")
+
+func NewPlaylist() *Playlist {
+	return &Playlist{
+		items: []*QueueItem{},
+	}
+}
+
+// Push appends a song to the end of the playlist
+func (p *Playlist) Push(music *stream.Music, requesterID string) *QueueItem {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.nextID++
+	item := &QueueItem{
+		ID:          strconv.FormatUint(p.nextID, 10),
+		Music:       music,
+		RequesterID: requesterID,
+	}
+	p.items = append(p.items, item)
+	return item
+}
+
+// Pop removes and returns the first song of the playlist, or nil if it is empty
+func (p *Playlist) Pop() *QueueItem {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.items) == 0 {
+		return nil
+	}
+	item := p.items[0]
+	p.items = p.items[1:]
+	return item
+}
+
+// Peek returns the first song of the playlist without removing it, or nil if it is empty
+func (p *Playlist) Peek() *QueueItem {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if len(p.items) == 0 {
+		return nil
+	}
+	return p.items[0]
+}
+
+// Remove removes the song at the given position
+func (p *Playlist) Remove(pos int) (*QueueItem, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if pos < 0 || pos >= len(p.items) {
+		return nil, ErrInvalidPosition
+	}
+	item := p.items[pos]
+	p.items = append(p.items[:pos], p.items[pos+1:]...)
+	return item, nil
+}
+
+// Take removes the given song wherever it is in the playlist, it returns false if it isn't there
+func (p *Playlist) Take(item *QueueItem) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, queued := range p.items {
+		if queued == item {
+			p.items = append(p.items[:i], p.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Move moves the song at position from to position to, shifting the songs in between
+func (p *Playlist) Move(from int, to int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if from < 0 || from >= len(p.items) || to < 0 || to >= len(p.items) {
+		return ErrInvalidPosition
+	}
+	item := p.items[from]
+	p.items = append(p.items[:from], p.items[from+1:]...)
+	p.items = append(p.items[:to], append([]*QueueItem{item}, p.items[to:]...)...)
+	return nil
+}
+
+// Clear drops all pending songs
+func (p *Playlist) Clear() {
+	p.lock.Lock()
+	p.items = []*QueueItem{}
+	p.lock.Unlock()
+}
+
+func (p *Playlist) Len() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.items)
+}
+
+func (item *QueueItem) Wrap() *socket.QueueItemWrap {
+	return &socket.QueueItemWrap{
+		ID:          item.ID,
+		Song:        item.Music,
+		RequesterID: item.RequesterID,
+	}
+}
+
+func (p *Playlist) Wrap() *socket.QueueWrap {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	itemsWrap := []*socket.QueueItemWrap{}
+	for _, item := range p.items {
+		itemsWrap = append(itemsWrap, item.Wrap())
+	}
+	return &socket.QueueWrap{Items: itemsWrap}
+}
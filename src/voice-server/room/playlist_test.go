@@ -0,0 +1,108 @@
+package room
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Nahemah1022/singsphere-voice-server/stream"
+)
+
+// newTestPlaylist returns a playlist of the given songs, in order
+func newTestPlaylist(songs ...string) *Playlist {
+	p := NewPlaylist()
+	for _, song := range songs {
+		p.Push(&stream.Music{SongName: song}, "")
+	}
+	return p
+}
+
+// songsOf returns the names of the songs pending in the playlist
+func songsOf(p *Playlist) []string {
+	songs := []string{}
+	for _, item := range p.Wrap().Items {
+		songs = append(songs, item.Song.SongName)
+	}
+	return songs
+}
+
+func TestPlaylistMove(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int
+		want     []string
+		wantErr  error
+	}{
+		{name: "forward", from: 0, to: 2, want: []string{"b", "c", "a"}},
+		{name: "backward", from: 2, to: 0, want: []string{"c", "a", "b"}},
+		{name: "in place", from: 1, to: 1, want: []string{"a", "b", "c"}},
+		{name: "negative from", from: -1, to: 0, wantErr: ErrInvalidPosition},
+		{name: "negative to", from: 0, to: -1, wantErr: ErrInvalidPosition},
+		{name: "from past the end", from: 3, to: 0, wantErr: ErrInvalidPosition},
+		{name: "to past the end", from: 0, to: 3, wantErr: ErrInvalidPosition},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPlaylist("a", "b", "c")
+			err := p.Move(test.from, test.to)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Move(%d, %d) error = %v, want %v", test.from, test.to, err, test.wantErr)
+			}
+			want := test.want
+			if err != nil {
+				// A refused move leaves the playlist as it was
+				want = []string{"a", "b", "c"}
+			}
+			if got := songsOf(p); !reflect.DeepEqual(got, want) {
+				t.Errorf("songs = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPlaylistRemove(t *testing.T) {
+	tests := []struct {
+		name     string
+		pos      int
+		want     []string
+		wantSong string
+		wantErr  error
+	}{
+		{name: "first", pos: 0, want: []string{"b", "c"}, wantSong: "a"},
+		{name: "middle", pos: 1, want: []string{"a", "c"}, wantSong: "b"},
+		{name: "last", pos: 2, want: []string{"a", "b"}, wantSong: "c"},
+		{name: "negative", pos: -1, want: []string{"a", "b", "c"}, wantErr: ErrInvalidPosition},
+		{name: "past the end", pos: 3, want: []string{"a", "b", "c"}, wantErr: ErrInvalidPosition},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPlaylist("a", "b", "c")
+			item, err := p.Remove(test.pos)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Remove(%d) error = %v, want %v", test.pos, err, test.wantErr)
+			}
+			if err == nil && item.Music.SongName != test.wantSong {
+				t.Errorf("Remove(%d) = %q, want %q", test.pos, item.Music.SongName, test.wantSong)
+			}
+			if got := songsOf(p); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("songs = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlaylistClear(t *testing.T) {
+	p := newTestPlaylist("a", "b")
+	p.Clear()
+	if p.Len() != 0 || p.Pop() != nil {
+		t.Fatalf("a cleared playlist still holds %q", songsOf(p))
+	}
+	if _, err := p.Remove(0); !errors.Is(err, ErrInvalidPosition) {
+		t.Errorf("Remove(0) on a cleared playlist error = %v, want %v", err, ErrInvalidPosition)
+	}
+	// Songs queued afterwards don't reuse the ids of the cleared ones
+	item := p.Push(&stream.Music{SongName: "c"}, "")
+	if item.ID != "3" {
+		t.Errorf("id of a song queued after clearing = %q, want %q", item.ID, "3")
+	}
+}
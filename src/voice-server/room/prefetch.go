@@ -0,0 +1,88 @@
+package room
+
+import (
+	"context"
+	"log"
+
+	"github.com/Nahemah1022/singsphere-voice-server/stream"
+)
+
+// prefetch is the next queued song being opened ahead of time, so it starts right when the current one ends
+type prefetch struct {
+	item      *QueueItem
+	song      *stream.Song
+	err       error
+	done      chan struct{} // closed once song or err is set
+	cancel    context.CancelFunc
+	committed bool // the hub already started fading into the song, it must be played next
+}
+
+// prefetchNext opens the song at the head of the playlist and hands it to the audio hub, if it isn't already.
+// It is called whenever the current song or the head of the playlist changes.
+func (r *Room) prefetchNext() {
+	if r.current == nil {
+		return
+	}
+	head := r.playlist.Peek()
+	if r.prefetch != nil && (r.prefetch.item == head || r.prefetch.committed) {
+		return
+	}
+	if !r.discardPrefetch() || head == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prefetch{
+		item:   head,
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	r.prefetch = p
+	go func() {
+		p.song, p.err = r.loadSong(ctx, head)
+		close(p.done)
+		r.prefetchedCh <- p
+	}()
+}
+
+// prefetched hands a loaded song to the audio hub, unless the playlist changed in the meantime
+func (r *Room) prefetched(p *prefetch) {
+	if r.prefetch != p || p.err != nil {
+		return
+	}
+	if err := r.audioHub.SetNext(p.song); err != nil {
+		log.Printf("room %s: fail to queue song %s: %v\n", r.Name, p.item.Music.SongName, err)
+	}
+}
+
+// discardPrefetch drops the prefetched song. It returns false if the hub already started fading into it,
+// the song is kept in that case.
+func (r *Room) discardPrefetch() bool {
+	p := r.prefetch
+	if p == nil {
+		return true
+	}
+	if err := r.audioHub.SetNext(nil); err != nil {
+		p.committed = true
+		return false
+	}
+	r.prefetch = nil
+	p.cancel()
+	go func() {
+		<-p.done
+		if p.song != nil {
+			p.song.Close()
+		}
+	}()
+	return true
+}
+
+// takePrefetch returns the prefetched song if it is the one to be played next, and takes its item off the playlist
+func (r *Room) takePrefetch() *prefetch {
+	p := r.prefetch
+	if p == nil || (p.item != r.playlist.Peek() && !p.committed) {
+		return nil
+	}
+	r.playlist.Take(p.item)
+	r.prefetch = nil
+	return p
+}
@@ -0,0 +1,39 @@
+package room
+
+import (
+	"errors"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+var ErrEmptyProfile = errors.New("empty profile")
+
+// updateProfile applies the changes a user made to their profile, and shows everyone the result
+func (r *Room) updateProfile(u *user.User, changes *socket.ProfileWrap) error {
+	if changes == nil {
+		return ErrEmptyProfile
+	}
+	profile := u.Profile()
+	for _, change := range []struct {
+		value *string
+		field *string
+	}{
+		{changes.Name, &profile.Name},
+		{changes.Emoji, &profile.Emoji},
+		{changes.Avatar, &profile.Avatar},
+		{changes.Color, &profile.Color},
+	} {
+		if change.value != nil {
+			*change.field = *change.value
+		}
+	}
+	if err := u.SetProfile(profile); err != nil {
+		return err
+	}
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "user_updated"},
+		User:      u.Wrap(),
+	}, nil)
+	return nil
+}
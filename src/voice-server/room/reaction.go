@@ -0,0 +1,97 @@
+package room
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+const (
+	// Reactions are counted over this period, then broadcast at once
+	reactionPeriod = 500 * time.Millisecond
+	// Each user may send a burst of reactions, then a few per second
+	reactionBurst = 10
+	reactionRate  = 3.0
+)
+
+// Reactions the audience may send, applause being the first
+var reactions = map[string]bool{
+	"👏": true, "❤️": true, "🔥": true, "😂": true, "😮": true,
+	"🎉": true, "👍": true, "🙌": true, "🎤": true, "⭐": true,
+}
+
+var (
+	ErrInvalidReaction  = errors.New("unknown reaction")
+	ErrTooManyReactions = errors.New("too many reactions, slow down")
+)
+
+// reactionBucket limits the reactions of a user, as a token bucket
+type reactionBucket struct {
+	tokens float64
+	at     time.Time // when the tokens were counted
+}
+
+// react counts a reaction of the given user, it is broadcast with the others of the period
+func (r *Room) react(u *user.User, reaction string) error {
+	if !reactions[reaction] {
+		return ErrInvalidReaction
+	}
+	if !r.allowReaction(u.ID, time.Now()) {
+		return ErrTooManyReactions
+	}
+	r.pendingReactions[reaction]++
+	if r.current != nil {
+		r.songReactions[reaction]++
+	}
+	return nil
+}
+
+// allowReaction takes a token from the bucket of the given user, it tells whether they had one left
+func (r *Room) allowReaction(id string, now time.Time) bool {
+	bucket, exist := r.reactionBuckets[id]
+	if !exist {
+		bucket = &reactionBucket{tokens: reactionBurst, at: now}
+		r.reactionBuckets[id] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.at).Seconds() * reactionRate
+	if bucket.tokens > reactionBurst {
+		bucket.tokens = reactionBurst
+	}
+	bucket.at = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// dropFullBuckets forgets the buckets which refilled, a user who left and came back can't reset theirs sooner
+func (r *Room) dropFullBuckets(now time.Time) {
+	for id, bucket := range r.reactionBuckets {
+		if bucket.tokens+now.Sub(bucket.at).Seconds()*reactionRate >= reactionBurst {
+			delete(r.reactionBuckets, id)
+		}
+	}
+}
+
+// flushReactions broadcasts how many of each reaction were sent during the period which ended
+func (r *Room) flushReactions() {
+	if len(r.pendingReactions) == 0 {
+		return
+	}
+	counts := r.pendingReactions
+	r.pendingReactions = make(map[string]int)
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "reaction"},
+		Reactions: counts,
+	}, nil)
+}
+
+// takeSongReactions returns how many of each reaction were sent during the song which ended, and resets them
+func (r *Room) takeSongReactions() map[string]int {
+	counts := r.songReactions
+	r.songReactions = make(map[string]int)
+	return counts
+}
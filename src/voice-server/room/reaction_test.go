@@ -0,0 +1,120 @@
+package room
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+func TestAllowReaction(t *testing.T) {
+	// A burst of ten is allowed, then a token comes back every third of a second
+	burst := []bool{}
+	for i := 0; i < reactionBurst; i++ {
+		burst = append(burst, true)
+	}
+	tests := []struct {
+		name  string
+		after time.Duration // since the burst, for the reactions following it
+		want  []bool
+	}{
+		{name: "right after the burst", after: 0, want: []bool{false}},
+		{name: "before a token came back", after: 300 * time.Millisecond, want: []bool{false}},
+		{name: "one token came back", after: 400 * time.Millisecond, want: []bool{true, false}},
+		{name: "a few tokens came back", after: time.Second, want: []bool{true, true, true, false}},
+		{name: "refilled", after: time.Minute, want: append(append([]bool{}, burst...), false)},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Room{reactionBuckets: make(map[string]*reactionBucket)}
+			got := []bool{}
+			for range burst {
+				got = append(got, r.allowReaction("alice", start))
+			}
+			if !reflect.DeepEqual(got, burst) {
+				t.Fatalf("burst allowed = %v, want %v", got, burst)
+			}
+			got = []bool{}
+			for range test.want {
+				got = append(got, r.allowReaction("alice", start.Add(test.after)))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("allowed = %v, want %v", got, test.want)
+			}
+			// Every user has their own bucket
+			if !r.allowReaction("bob", start.Add(test.after)) {
+				t.Error("bob is limited by alice's reactions")
+			}
+		})
+	}
+}
+
+func TestReact(t *testing.T) {
+	tests := []struct {
+		name      string
+		reactions []string
+		playing   bool
+		wantErr   error
+		wantCount map[string]int
+		wantSong  map[string]int
+	}{
+		{name: "between songs", reactions: []string{"👏", "👏", "🔥"}, wantCount: map[string]int{"👏": 2, "🔥": 1}, wantSong: map[string]int{}},
+		{name: "during a song", reactions: []string{"❤️"}, playing: true, wantCount: map[string]int{"❤️": 1}, wantSong: map[string]int{"❤️": 1}},
+		{name: "unknown", reactions: []string{"💩"}, wantErr: ErrInvalidReaction, wantCount: map[string]int{}, wantSong: map[string]int{}},
+		{name: "empty", reactions: []string{""}, wantErr: ErrInvalidReaction, wantCount: map[string]int{}, wantSong: map[string]int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Room{
+				reactionBuckets:  make(map[string]*reactionBucket),
+				pendingReactions: make(map[string]int),
+				songReactions:    make(map[string]int),
+			}
+			if test.playing {
+				r.current = &QueueItem{}
+			}
+			for _, reaction := range test.reactions {
+				if err := r.react(&user.User{ID: "alice"}, reaction); !errors.Is(err, test.wantErr) {
+					t.Errorf("react(%q) error = %v, want %v", reaction, err, test.wantErr)
+				}
+			}
+			if !reflect.DeepEqual(r.pendingReactions, test.wantCount) {
+				t.Errorf("pending reactions = %v, want %v", r.pendingReactions, test.wantCount)
+			}
+			if got := r.takeSongReactions(); !reflect.DeepEqual(got, test.wantSong) {
+				t.Errorf("song reactions = %v, want %v", got, test.wantSong)
+			}
+		})
+	}
+}
+
+func TestDropFullBuckets(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name     string
+		reacted  int           // reactions sent at start
+		after    time.Duration // when buckets are dropped
+		wantKept bool
+	}{
+		{name: "refilling", reacted: reactionBurst, after: time.Second, wantKept: true},
+		{name: "refilled", reacted: reactionBurst, after: 4 * time.Second, wantKept: false},
+		{name: "one reaction refilling", reacted: 1, after: 0, wantKept: true},
+		{name: "one reaction refilled", reacted: 1, after: 400 * time.Millisecond, wantKept: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Room{reactionBuckets: make(map[string]*reactionBucket)}
+			for i := 0; i < test.reacted; i++ {
+				r.allowReaction("alice", start)
+			}
+			r.dropFullBuckets(start.Add(test.after))
+			// A bucket kept until it refills is still there if its user leaves and comes back
+			if _, kept := r.reactionBuckets["alice"]; kept != test.wantKept {
+				t.Errorf("bucket kept = %v, want %v", kept, test.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/recorder"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+	"github.com/pion/rtp"
+)
+
+var (
+	ErrRecordingUnavailable = errors.New("recordings are unavailable")
+	ErrAlreadyRecording     = errors.New("this room is already being recorded")
+	ErrNotRecording         = errors.New("this room isn't being recorded")
+	ErrInvalidClipLength    = errors.New("invalid clip length")
+	ErrClipBusy             = errors.New("clips of this room are already being cut, try again later")
+)
+
+const (
+	// Audio kept by rooms to cut clips from, unless CLIP_DURATION is set
+	defaultClipLength = 30 * time.Second
+	// Longest a clip may take to be written
+	clipTimeout = time.Minute
+	// Clips cut at once in a room, each one runs ffmpeg
+	maxClipJobs = 2
+)
+
+// StartRecording starts recording the mics and the backing track of this room, a new take begins with each song
+func (r *Room) StartRecording() (*socket.RecordingWrap, error) {
+	if r.recorder == nil {
+		return nil, ErrRecordingUnavailable
+	}
+	r.recordLock.Lock()
+	if r.recording != nil {
+		r.recordLock.Unlock()
+		return nil, ErrAlreadyRecording
+	}
+	recording, err := r.recorder.Start(r.Name)
+	if err != nil {
+		r.recordLock.Unlock()
+		return nil, err
+	}
+	r.recording = recording
+	r.recordLock.Unlock()
+	r.audioHub.AddTap(recording)
+	log.Printf("room %s: start recording %s\n", r.Name, recording.ID())
+	info := recordingWrap(recording.Info())
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "recording_started"},
+		Recording: info,
+	}, nil)
+	return info, nil
+}
+
+// StopRecording stops the recording of this room, its last take is mixed down in the background
+func (r *Room) StopRecording() (*socket.RecordingWrap, error) {
+	r.recordLock.Lock()
+	recording := r.recording
+	r.recording = nil
+	r.recordLock.Unlock()
+	if recording == nil {
+		return nil, ErrNotRecording
+	}
+	r.audioHub.RemoveTap(recording)
+	if err := recording.Stop(); err != nil {
+		return nil, err
+	}
+	log.Printf("room %s: stop recording %s\n", r.Name, recording.ID())
+	info := recordingWrap(recording.Info())
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "recording_stopped"},
+		Recording: info,
+	}, nil)
+	return info, nil
+}
+
+// Recordings lists the recordings of this room, most recent first
+func (r *Room) Recordings() ([]*socket.RecordingWrap, error) {
+	if r.recorder == nil {
+		return nil, ErrRecordingUnavailable
+	}
+	infos, err := r.recorder.List(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]*socket.RecordingWrap, 0, len(infos))
+	for _, info := range infos {
+		recordings = append(recordings, recordingWrap(info))
+	}
+	return recordings, nil
+}
+
+// recordingWrap returns the public representation of a recording
+func recordingWrap(info *recorder.Info) *socket.RecordingWrap {
+	takes := make([]*socket.TakeWrap, 0, len(info.Takes))
+	for _, take := range info.Takes {
+		takes = append(takes, &socket.TakeWrap{
+			Name:      take.Name,
+			Song:      take.Song,
+			StartedAt: take.StartedAt,
+			EndedAt:   take.EndedAt,
+			Files:     take.Files,
+			Mix:       take.Mix,
+		})
+	}
+	return &socket.RecordingWrap{
+		ID:        info.ID,
+		Room:      info.Room,
+		StartedAt: info.StartedAt,
+		StoppedAt: info.StoppedAt,
+		Takes:     takes,
+	}
+}
+
+// RecordingPath returns the path of a file of one of this room's recordings
+func (r *Room) RecordingPath(id string, take string, file string) (string, error) {
+	if r.recorder == nil {
+		return "", ErrRecordingUnavailable
+	}
+	return r.recorder.Path(r.Name, id, take, file)
+}
+
+// currentRecording returns the recording in progress, or nil
+func (r *Room) currentRecording() *recorder.Recording {
+	r.recordLock.Lock()
+	defer r.recordLock.Unlock()
+	return r.recording
+}
+
+// recordingID returns the id of the recording in progress, or an empty string
+func (r *Room) recordingID() string {
+	if recording := r.currentRecording(); recording != nil {
+		return recording.ID()
+	}
+	return ""
+}
+
+// markRecordedSong names the take being recorded after the song which starts
+func (r *Room) markRecordedSong(song string) {
+	if recording := r.currentRecording(); recording != nil {
+		recording.MarkSong(song)
+	}
+}
+
+// splitRecording ends the take being recorded once its song ended
+func (r *Room) splitRecording() {
+	if recording := r.currentRecording(); recording != nil {
+		if err := recording.Split(); err != nil {
+			log.Printf("room %s: fail to split recording: %v\n", r.Name, err)
+		}
+	}
+}
+
+// recordMic keeps a packet of the given user's mic for clips, and records it if the room is being recorded
+func (r *Room) recordMic(u *user.User, packet *rtp.Packet) {
+	anchor := func(timestamp uint32) (time.Time, bool) {
+		return micMusicTime(u, timestamp)
+	}
+	if r.ring != nil {
+		r.ring.WriteMic(u.ID, packet, anchor)
+	}
+	if recording := r.currentRecording(); recording != nil {
+		recording.WriteMic(u.ID, packet, anchor)
+	}
+}
+
+// clip cuts the last moments of this room into a file in the background, the user gets its id once it is written.
+// The clip lasts the given duration, or as long as the room keeps if it is 0. It fails with ErrClipBusy while
+// maxClipJobs clips are being cut.
+func (r *Room) clip(u *user.User, length time.Duration) error {
+	if r.ring == nil {
+		return ErrRecordingUnavailable
+	}
+	if length < 0 {
+		return ErrInvalidClipLength
+	}
+	select {
+	case r.clipJobs <- struct{}{}:
+	default:
+		return ErrClipBusy
+	}
+	go func() {
+		defer func() { <-r.clipJobs }()
+		ctx, cancel := context.WithTimeout(context.Background(), clipTimeout)
+		defer cancel()
+		id, err := r.recorder.Clip(ctx, r.Name, r.ring, length)
+		if err != nil {
+			log.Printf("room %s: fail to clip: %v\n", r.Name, err)
+			u.SendError(err)
+			return
+		}
+		u.SendEvent(&socket.OutboundEvent{
+			EventBase: socket.EventBase{Type: "clip"},
+			Clip: &socket.ClipWrap{
+				ID:  id,
+				URL: fmt.Sprintf("/api/rooms/%s/clips/%s", url.PathEscape(r.Name), id),
+			},
+		})
+	}()
+	return nil
+}
+
+// ClipPath returns the path of one of this room's clips
+func (r *Room) ClipPath(id string) (string, error) {
+	if r.recorder == nil {
+		return "", ErrRecordingUnavailable
+	}
+	return r.recorder.ClipPath(r.Name, id)
+}
+
+// micMusicTime returns when the backing track the user heard while capturing the given mic packet was sent.
+// The capture time comes from the mic's RTCP sender reports, and the music reached the user half a round trip
+// before. Without reports, the packet is taken as captured along with the music sent half a round trip before
+// it arrived, and false is returned.
+func micMusicTime(u *user.User, timestamp uint32) (time.Time, bool) {
+	oneWay := u.RTT() / 2
+	captured, ok := u.MicCaptureTime(timestamp)
+	if !ok {
+		return time.Now().Add(-oneWay), false
+	}
+	return captured.Add(-oneWay), true
+}
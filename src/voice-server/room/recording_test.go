@@ -0,0 +1,26 @@
+package room
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/recorder"
+)
+
+func TestClipBusy(t *testing.T) {
+	r := &Room{
+		Name:     "room",
+		ring:     recorder.NewRing(time.Second),
+		clipJobs: make(chan struct{}, maxClipJobs),
+	}
+	for i := 0; i < maxClipJobs; i++ {
+		r.clipJobs <- struct{}{}
+	}
+	if err := r.clip(nil, 0); !errors.Is(err, ErrClipBusy) {
+		t.Errorf("clip() while %d clips are cut error = %v, want %v", maxClipJobs, err, ErrClipBusy)
+	}
+	if err := r.clip(nil, -time.Second); !errors.Is(err, ErrInvalidClipLength) {
+		t.Errorf("clip() of a negative length error = %v, want %v", err, ErrInvalidClipLength)
+	}
+}
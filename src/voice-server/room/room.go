@@ -1,33 +1,92 @@
 package room
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/mixer"
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/mq"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/recorder"
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
 	"github.com/Nahemah1022/singsphere-voice-server/stream"
 	"github.com/Nahemah1022/singsphere-voice-server/user"
 )
 
 type Room struct {
-	Name          string
-	users         map[string]*user.User
-	userLock      sync.RWMutex
-	UserJoinCh    chan *user.User
-	UserLeaveCh   chan *user.User
-	SongRequestCh chan string
-	mqConsumer    *mq.Consumer
-	audioHub      *stream.AudioHub
+	Name             string
+	mode             string             // ModeSFU or ModeMCU
+	mixer            *mixer.Mixer       // mixes the room's audio in ModeMCU, nil otherwise
+	stopMixing       context.CancelFunc // stops the mixer once the room is empty, nil while it isn't running
+	users            map[string]*user.User
+	userLock         sync.RWMutex
+	UserJoinCh       chan *user.User
+	UserLeaveCh      chan *user.User
+	UserRequestCh    chan *user.Request
+	SongRequestCh    chan string
+	mqConsumer       *mq.Consumer
+	audioHub         *stream.AudioHub
+	playlist         *Playlist
+	current          *QueueItem                 // song being streamed, nil if the room is idle
+	startedAt        time.Time                  // when the current song started
+	stopSong         context.CancelFunc         // stops streaming the current song
+	lyrics           *stream.Lyrics             // lyrics of the current song, nil if it has none
+	scheduledAt      time.Time                  // when the beginning of the current song is due, for clients playing it locally
+	songLoadedCh     chan *loadedSong           // notified by the playback goroutine once a song's metadata is read
+	songEndCh        chan error                 // notified by the playback goroutine once a song ends
+	prefetch         *prefetch                  // next song opened ahead of time, nil if none
+	prefetchedCh     chan *prefetch             // notified once a prefetched song is opened
+	snapshotCh       chan chan *socket.RoomWrap // requests of snapshots from outside the room's loop
+	leadDelay        time.Duration              // delay of the music behind the singers
+	alignLock        sync.RWMutex
+	alignments       map[string]*alignment // keyed by user id
+	recorder         *recorder.Recorder    // nil if recordings are unavailable
+	recordLock       sync.Mutex
+	recording        *recorder.Recording // recording in progress, nil if none
+	ring             *recorder.Ring      // last moments of the room to cut clips from, nil if recordings are unavailable
+	clipJobs         chan struct{}       // slots of the clips being cut, bounding them to maxClipJobs
+	scores           scoreboard
+	parts            map[string]int   // part of the current duet sung by each singer, keyed by user id
+	hands            []string         // ids of the users waiting to get on stage, in order
+	hostID           string           // id of the user moderating the room, empty if the room is empty
+	joinOrder        map[string]int64 // rank at which each user joined, keyed by user id
+	joinSeq          int64            // rank of the last user who joined
+	locked           atomic.Bool      // whether new users are turned away
+	invites          *auth.Invites
+	chatLock         sync.Mutex
+	chatHistory      []*socket.ChatWrap         // last messages, oldest first
+	chatSeq          int64                      // id of the last message
+	reactionBuckets  map[string]*reactionBucket // keyed by user id
+	pendingReactions map[string]int             // reactions of the current period, keyed by reaction
+	songReactions    map[string]int             // reactions of the current song, keyed by reaction
+	accessLock       sync.Mutex                 // guards the fields below, read while users connect
+	private          bool                       // whether only members may see and join the room
+	password         []byte                     // bcrypt hash of the password of a private room, nil if only invites let users in
+	members          map[string]bool            // ids of the users admitted into the private room
+	inviteUses       map[string]int             // how many users joined with each invite, keyed by invite id
+	kicked           map[string]bool            // ids of the users the host kicked out, they can't come back
 }
 
 var (
 	ErrUserAlreadyJoined = errors.New("user already joined this room")
 	ErrUserNotExist      = errors.New("user not in this room")
+	ErrNotImplemented    = errors.New("not implemented")
 )
 
+// Modes of rooms, either forwarding every mic to every user, or mixing them on the server
+const (
+	ModeSFU = "sfu"
+	ModeMCU = "mcu"
+)
+
+// Period of now_playing events sent while a song is playing
+const nowPlayingPeriod = 5 * time.Second
+
 // broadcast broadcasts event to all users in this room except the given user
 func (r *Room) broadcast(event *socket.OutboundEvent, u *user.User) error {
 	r.userLock.Lock()
@@ -44,45 +103,99 @@ func (r *Room) broadcast(event *socket.OutboundEvent, u *user.User) error {
 // join joins the given user to this room
 func (r *Room) join(u *user.User) error {
 	if _, exist := r.users[u.ID]; exist {
+		// Users are identified by their token, the same user may connect from another tab
+		r.reject(u, ErrUserAlreadyJoined)
 		return ErrUserAlreadyJoined
 	}
+	if err := r.admit(u); err != nil {
+		r.reject(u, err)
+		return err
+	}
+	if r.host() == nil {
+		// Whoever opens the room hosts it
+		r.hostID = u.ID
+		u.SetRole(user.RoleHost)
+	}
+	// Late joiners catch up on the conversation
+	snapshot := r.Wrap()
+	snapshot.Chat = r.ChatHistory(0)
 	u.SendEvent(&socket.OutboundEvent{
 		EventBase: socket.EventBase{Type: "room"},
-		Room:      r.Wrap(),
+		Room:      snapshot,
 	})
+	if r.lyrics != nil {
+		// Late joiners get the lyrics of the song already playing
+		u.SendEvent(&socket.OutboundEvent{
+			EventBase: socket.EventBase{Type: "lyrics"},
+			Lyrics:    r.lyrics,
+		})
+	}
+	r.sendSchedule(u)
 	r.broadcast(&socket.OutboundEvent{
 		EventBase: socket.EventBase{Type: "user_join", Desc: fmt.Sprintf("user %s joined this room", u.ID)},
 		User:      u.Wrap(),
 	}, nil)
+	r.startMixer()
 	r.userLock.Lock()
 	if err := r.acceptRoomTracks(u); err != nil {
 		log.Println(err)
 	}
 	r.users[u.ID] = u
 	r.userLock.Unlock()
+	r.joinSeq++
+	r.joinOrder[u.ID] = r.joinSeq
 	go r.attachMicTrack(u)
 	log.Println("New user joined room:", r.Name)
 	return nil
 }
 
+// reject tells the given user why they can't join this room and disconnects them
+func (r *Room) reject(u *user.User, err error) {
+	u.SendEvent(JoinError(err))
+	u.Disconnect(socket.CloseRejected, err.Error())
+}
+
 // leave removes the given user from this room
 func (r *Room) leave(u *user.User) error {
-	if _, exist := r.users[u.ID]; !exist {
+	// A rejected connection of a user already in the room shares their id
+	if joined, exist := r.users[u.ID]; !exist || joined != u {
 		return ErrUserNotExist
 	}
-	r.userLock.Lock()
-	delete(r.users, u.ID)
-	r.userLock.Unlock()
-	r.broadcast(&socket.OutboundEvent{
+	r.remove(u, &socket.OutboundEvent{
 		EventBase: socket.EventBase{Type: "user_leave", Desc: fmt.Sprintf("user %s left this room", u.ID)},
 		User:      u.Wrap(),
-	}, nil)
-	go r.removeMicTrack(u)
+	})
 	log.Println("user leave room:", r.Name)
 	return nil
 }
 
+// remove takes the given user off this room, its stage and its mixer, then tells the others with the given event
+func (r *Room) remove(u *user.User, event *socket.OutboundEvent) {
+	r.userLock.Lock()
+	delete(r.users, u.ID)
+	r.userLock.Unlock()
+	r.broadcast(event, nil)
+	if u.HandRaised() {
+		r.dropHand(u.ID)
+		r.broadcastHands("hand_lowered", u)
+	}
+	if len(r.users) == 0 {
+		// An empty room is open again for whoever comes next
+		r.locked.Store(false)
+		r.stopMixer()
+	}
+	delete(r.joinOrder, u.ID)
+	r.electHost()
+	go r.removeMicTrack(u)
+}
+
 func (r *Room) run() {
+	nowPlayingTicker := time.NewTicker(nowPlayingPeriod)
+	defer nowPlayingTicker.Stop()
+	alignmentTicker := time.NewTicker(alignmentPeriod)
+	defer alignmentTicker.Stop()
+	reactionTicker := time.NewTicker(reactionPeriod)
+	defer reactionTicker.Stop()
 	for {
 		select {
 		case u := <-r.UserJoinCh:
@@ -93,8 +206,148 @@ func (r *Room) run() {
 			if err := r.leave(u); err != nil {
 				log.Println(err)
 			}
+		case req := <-r.UserRequestCh:
+			if err := r.handleRequest(req); err != nil {
+				req.User.SendError(err)
+			}
 		case song := <-r.SongRequestCh:
-			log.Println("consume song ", song)
+			r.enqueue(&stream.Music{SongName: song}, "")
+		case loaded := <-r.songLoadedCh:
+			r.songLoaded(loaded)
+		case p := <-r.prefetchedCh:
+			r.prefetched(p)
+		case reply := <-r.snapshotCh:
+			reply <- r.Wrap()
+		case err := <-r.songEndCh:
+			if err != nil && !errors.Is(err, context.Canceled) {
+				r.songFailed(err)
+			}
+			scores := r.finishScoring()
+			r.broadcast(&socket.OutboundEvent{
+				EventBase: socket.EventBase{Type: "song_ended"},
+				Playback:  r.playbackWrap(),
+				Summary: &socket.SummaryWrap{
+					Song:      r.current.Music.SongName,
+					Reactions: r.takeSongReactions(),
+					Scores:    scores,
+				},
+			}, nil)
+			r.splitRecording()
+			r.current = nil
+			r.lyrics = nil
+			r.parts = nil
+			r.scheduledAt = time.Time{}
+			r.playNext()
+		case <-reactionTicker.C:
+			r.flushReactions()
+			r.dropFullBuckets(time.Now())
+		case <-alignmentTicker.C:
+			r.align()
+		case <-nowPlayingTicker.C:
+			if r.current != nil {
+				r.broadcastPlayback("now_playing")
+			}
+		}
+	}
+}
+
+// handleRequest handles an inbound event that the given user forwards to this room
+func (r *Room) handleRequest(req *user.Request) error {
+	if _, exist := r.users[req.User.ID]; !exist {
+		return ErrUserNotExist
+	}
+	event := req.Event
+	switch event.Type {
+	case "enqueue":
+		if event.Song == nil || event.Song.SongName == "" {
+			return errors.New("empty song")
+		}
+		r.enqueue(&stream.Music{SongName: event.Song.SongName}, req.User.ID)
+		return nil
+	case "skip":
+		return r.skip(req.User)
+	case "queue_remove":
+		return r.removeQueued(req.User, event.Position)
+	case "queue_move":
+		return r.moveQueued(req.User, event.Position, event.To)
+	case "queue_clear":
+		return r.clearQueue(req.User)
+	case "pause":
+		return r.pause(req.User)
+	case "resume":
+		return r.resume(req.User)
+	case "seek":
+		return r.seek(req.User, time.Duration(event.Time*float64(time.Second)))
+	case "set_crossfade":
+		return r.setCrossfade(req.User, time.Duration(event.Time*float64(time.Second)))
+	case "recording_start":
+		// As over REST, where only admins may, recordings are only started and stopped by the host
+		if err := r.requireHost(req.User); err != nil {
+			return err
+		}
+		_, err := r.StartRecording()
+		return err
+	case "recording_stop":
+		if err := r.requireHost(req.User); err != nil {
+			return err
+		}
+		_, err := r.StopRecording()
+		return err
+	case "clip":
+		return r.clip(req.User, time.Duration(event.Time*float64(time.Second)))
+	case "mute":
+		r.setMuted(req.User, true)
+		return nil
+	case "unmute":
+		if req.User.MuteLocked() {
+			return ErrMuteLocked
+		}
+		r.setMuted(req.User, false)
+		return nil
+	case "kick":
+		return r.kick(req.User, event.UserID)
+	case "force_mute":
+		return r.forceMute(req.User, event.UserID)
+	case "release_mute":
+		return r.releaseMute(req.User, event.UserID)
+	case "lock_room":
+		return r.setLocked(req.User, true)
+	case "unlock_room":
+		return r.setLocked(req.User, false)
+	case "transfer_host":
+		return r.transferHost(req.User, event.UserID)
+	case "profile":
+		return r.updateProfile(req.User, event.Profile)
+	case "reaction":
+		return r.react(req.User, event.Reaction)
+	case "chat":
+		return r.chat(req.User, event.Message)
+	case "make_private":
+		return r.makePrivate(req.User, event.Password)
+	case "make_public":
+		return r.makePublic(req.User)
+	case "create_invite":
+		return r.createInvite(req.User, time.Duration(event.Time*float64(time.Second)), event.Uses)
+	case "raise_hand":
+		return r.raiseHand(req.User)
+	case "lower_hand":
+		return r.lowerHand(req.User)
+	case "approve_hand":
+		return r.approveHand(req.User, event.UserID)
+	case "deny_hand":
+		return r.denyHand(req.User, event.UserID)
+	case "leave_stage":
+		return r.leaveStage(req.User)
+	case "recording_list":
+		recordings, err := r.Recordings()
+		if err != nil {
+			return err
 		}
+		req.User.SendEvent(&socket.OutboundEvent{
+			EventBase:  socket.EventBase{Type: "recordings"},
+			Recordings: recordings,
+		})
+		return nil
 	}
+	return ErrNotImplemented
 }
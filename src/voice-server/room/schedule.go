@@ -0,0 +1,58 @@
+package room
+
+import (
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/stream"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+// Songs starting from silence are scheduled that far ahead, so every client gets the schedule in time
+const scheduleLead = time.Second
+
+// loadedSong is a song ready to be played, along with when its beginning is due by the server's clock
+type loadedSong struct {
+	song    *stream.Song
+	startAt time.Time
+}
+
+// scheduleWrap returns the schedule of the current song, converted to the given user's clock
+func (r *Room) scheduleWrap(u *user.User) *socket.ScheduleWrap {
+	schedule := &socket.ScheduleWrap{
+		Song:    r.current.Music.SongName,
+		StartAt: socket.UnixMillis(r.scheduledAt),
+		Paused:  r.audioHub.Paused(),
+	}
+	if local, ok := u.ClientTime(r.scheduledAt); ok {
+		schedule.LocalStartAt = socket.UnixMillis(local)
+	}
+	return schedule
+}
+
+// sendSchedule tells the given user when the current song starts, if a song is playing
+func (r *Room) sendSchedule(u *user.User) {
+	if r.current == nil || r.scheduledAt.IsZero() {
+		return
+	}
+	u.SendEvent(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "song_scheduled"},
+		Schedule:  r.scheduleWrap(u),
+	})
+}
+
+// reschedule moves the start of the current song so that it is at the given position now, after a pause or a
+// seek, and tells every user. Each user gets the schedule converted to their own clock.
+func (r *Room) reschedule(pos time.Duration) {
+	r.scheduledAt = time.Now().Add(-pos)
+	r.syncScoreClock()
+	r.broadcastSchedule()
+}
+
+func (r *Room) broadcastSchedule() {
+	r.userLock.Lock()
+	defer r.userLock.Unlock()
+	for _, u := range r.users {
+		r.sendSchedule(u)
+	}
+}
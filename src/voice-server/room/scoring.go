@@ -0,0 +1,228 @@
+package room
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/scoring"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/stream"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+	"github.com/pion/rtp"
+)
+
+// Golden notes count that many times more than regular ones, as in UltraStar
+const goldenWeight = 2.0
+
+// scoreboard scores the singers of the current song, it is shared with the goroutines reading mics
+type scoreboard struct {
+	lock    sync.Mutex
+	song    string
+	melody  *stream.Melody // of the song, nil if it has none
+	start   time.Time      // when the beginning of the song is due, by the server's clock
+	paused  bool
+	scorers map[string]*scoring.Scorer // keyed by user id, empty if the song has no melody
+}
+
+// startScoring starts scoring the singers of the song which starts against its melody
+func (r *Room) startScoring(song *stream.Song) {
+	r.scores.lock.Lock()
+	defer r.scores.lock.Unlock()
+	r.scores.song = song.Music.SongName
+	r.scores.melody = song.Melody
+	r.scores.scorers = map[string]*scoring.Scorer{}
+	if song.Melody == nil {
+		return
+	}
+	singers := r.singers()
+	for id := range singers {
+		scorer, err := scoring.New(melodyNotes(song.Melody, r.parts[id]))
+		if err != nil {
+			// Songs are still sung without the codec, singers are told they won't get a score
+			log.Printf("room %s: fail to score %s: %v\n", r.Name, song.Music.SongName, err)
+			r.scores.scorers = map[string]*scoring.Scorer{}
+			r.scoringFailed(singers, song.Music, err)
+			return
+		}
+		r.scores.scorers[id] = scorer
+	}
+}
+
+// scoreLateSinger starts scoring a user who got on stage while a song plays, from the notes still to come
+func (r *Room) scoreLateSinger(u *user.User) {
+	if r.current == nil {
+		return
+	}
+	r.scores.lock.Lock()
+	defer r.scores.lock.Unlock()
+	if r.scores.melody == nil || r.scores.scorers == nil || r.scores.scorers[u.ID] != nil {
+		return
+	}
+	// Notes already sung would count as missed
+	pos := r.audioHub.Position()
+	notes := []scoring.Note{}
+	for _, note := range melodyNotes(r.scores.melody, r.parts[u.ID]) {
+		if note.Start >= pos {
+			notes = append(notes, note)
+		}
+	}
+	scorer, err := scoring.New(notes)
+	if err != nil {
+		log.Printf("room %s: fail to score %s: %v\n", r.Name, u.ID, err)
+		r.scoringFailed(map[string]bool{u.ID: true}, r.current.Music, err)
+		return
+	}
+	r.scores.scorers[u.ID] = scorer
+}
+
+// scoringFailed tells the given singers that the song being played can't be scored
+func (r *Room) scoringFailed(singers map[string]bool, music *stream.Music, err error) {
+	event := &socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "score_error", Desc: fmt.Sprintf("this song can't be scored: %v", err)},
+		Song:      music,
+	}
+	for id := range singers {
+		if u, exist := r.users[id]; exist {
+			u.SendEvent(event)
+		}
+	}
+}
+
+// melodyNotes returns the notes of the melody a singer of the given part is scored against
+func melodyNotes(melody *stream.Melody, part int) []scoring.Note {
+	notes := []scoring.Note{}
+	for _, note := range melody.Notes {
+		if !note.Pitched() || (part != 0 && note.Part != 0 && note.Part != part) {
+			continue
+		}
+		weight := 1.0
+		if note.Kind == stream.NoteGolden {
+			weight = goldenWeight
+		}
+		notes = append(notes, scoring.Note{
+			Start:  time.Duration(note.Time * float64(time.Second)),
+			End:    time.Duration((note.Time + note.Duration) * float64(time.Second)),
+			Pitch:  note.Pitch,
+			Weight: weight,
+		})
+	}
+	return notes
+}
+
+// assignParts gives each singer on stage a part of the song if it is a duet, the requester sings the first one
+func (r *Room) assignParts(music *stream.Music) {
+	r.parts = map[string]int{}
+	if music.Karaoke == nil || len(music.Karaoke.Parts) == 0 {
+		return
+	}
+	onStage := r.singers()
+	singers := []string{}
+	for id := range onStage {
+		if id != r.current.RequesterID {
+			singers = append(singers, id)
+		}
+	}
+	sort.Strings(singers)
+	if onStage[r.current.RequesterID] {
+		singers = append([]string{r.current.RequesterID}, singers...)
+	}
+	for i, id := range singers {
+		r.parts[id] = i%len(music.Karaoke.Parts) + 1
+	}
+}
+
+// partsWrap returns the parts of the singers of the current duet, or nil if it isn't one
+func (r *Room) partsWrap() []*socket.PartWrap {
+	if len(r.parts) == 0 {
+		return nil
+	}
+	parts := []*socket.PartWrap{}
+	names := r.current.Music.Karaoke.Parts
+	for id, part := range r.parts {
+		parts = append(parts, &socket.PartWrap{UserID: id, Part: part, Name: names[part-1]})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Part < parts[j].Part
+	})
+	return parts
+}
+
+// syncScoreClock follows the schedule of the current song, so mic packets are compared to the right notes
+func (r *Room) syncScoreClock() {
+	r.scores.lock.Lock()
+	defer r.scores.lock.Unlock()
+	r.scores.start, r.scores.paused = r.scheduledAt, r.audioHub.Paused()
+}
+
+// scoreMic scores a packet of the given user's mic if they are singing, and sends the notes they finished
+func (r *Room) scoreMic(u *user.User, packet *rtp.Packet) {
+	r.scores.lock.Lock()
+	scorer, song, start, paused := r.scores.scorers[u.ID], r.scores.song, r.scores.start, r.scores.paused
+	r.scores.lock.Unlock()
+	if scorer == nil || paused || len(packet.Payload) == 0 {
+		return
+	}
+	at, _ := micMusicTime(u, packet.Timestamp)
+	pos := at.Sub(start)
+	if pos < 0 {
+		return
+	}
+	notes, err := scorer.Write(packet.Payload, pos)
+	if err != nil {
+		log.Printf("room %s: fail to score %s: %v\n", r.Name, u.ID, err)
+		return
+	}
+	if len(notes) == 0 {
+		return
+	}
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "score"},
+		Score: &socket.ScoreWrap{
+			UserID: u.ID,
+			Song:   song,
+			Notes:  noteScoresWrap(notes),
+			Score:  scorer.Score(),
+		},
+	}, nil)
+}
+
+// noteScoresWrap returns the public representation of the given note scores
+func noteScoresWrap(scores []*scoring.NoteScore) []*socket.NoteScoreWrap {
+	notes := make([]*socket.NoteScoreWrap, 0, len(scores))
+	for _, score := range scores {
+		notes = append(notes, &socket.NoteScoreWrap{
+			Index:    score.Index,
+			Pitch:    score.Pitch,
+			Sung:     score.Sung,
+			Accuracy: score.Accuracy,
+		})
+	}
+	return notes
+}
+
+// finishScoring sends the final score of every singer once the song ended, and returns them keyed by user id
+func (r *Room) finishScoring() map[string]float64 {
+	r.scores.lock.Lock()
+	scorers, song := r.scores.scorers, r.scores.song
+	r.scores.scorers = nil
+	r.scores.lock.Unlock()
+	finals := make(map[string]float64, len(scorers))
+	for id, scorer := range scorers {
+		notes, score := scorer.Finish()
+		finals[id] = score
+		r.broadcast(&socket.OutboundEvent{
+			EventBase: socket.EventBase{Type: "score", Desc: "final score"},
+			Score: &socket.ScoreWrap{
+				UserID: id,
+				Song:   song,
+				Notes:  noteScoresWrap(notes),
+				Score:  score,
+				Final:  true,
+			},
+		}, nil)
+	}
+	return finals
+}
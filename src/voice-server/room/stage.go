@@ -0,0 +1,180 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+)
+
+/*
+Only the users on stage, the host and the singers, are heard by the room. The audience raise their hand to
+get on stage, and wait in a queue until the host approves or denies them.
+*/
+
+var (
+	ErrNotHost           = errors.New("only the host may do this")
+	ErrNotAudience       = errors.New("only the audience may raise their hand")
+	ErrHandNotRaised     = errors.New("this user didn't raise their hand")
+	ErrNotSinger         = errors.New("only singers may leave the stage")
+	ErrTargetNotInRoom   = errors.New("no such user in this room")
+	ErrHandAlreadyRaised = errors.New("hand already raised")
+)
+
+// host returns the host of this room, or nil if it has none
+func (r *Room) host() *user.User {
+	return r.users[r.hostID]
+}
+
+// target returns the user an event is about
+func (r *Room) target(id string) (*user.User, error) {
+	u, exist := r.users[id]
+	if !exist {
+		return nil, fmt.Errorf("%w: %q", ErrTargetNotInRoom, id)
+	}
+	return u, nil
+}
+
+// requireHost checks that the given user hosts this room
+func (r *Room) requireHost(u *user.User) error {
+	if u.ID != r.hostID {
+		return ErrNotHost
+	}
+	return nil
+}
+
+// raiseHand puts the given user in the queue of users asking to get on stage
+func (r *Room) raiseHand(u *user.User) error {
+	if u.Role() != user.RoleAudience {
+		return ErrNotAudience
+	}
+	if u.HandRaised() {
+		return ErrHandAlreadyRaised
+	}
+	u.SetHandRaised(true)
+	r.hands = append(r.hands, u.ID)
+	r.broadcastHands("hand_raised", u)
+	return nil
+}
+
+// lowerHand takes the given user out of the queue
+func (r *Room) lowerHand(u *user.User) error {
+	if !u.HandRaised() {
+		return ErrHandNotRaised
+	}
+	u.SetHandRaised(false)
+	r.dropHand(u.ID)
+	r.broadcastHands("hand_lowered", u)
+	return nil
+}
+
+// approveHand lets the host bring a user of the queue on stage
+func (r *Room) approveHand(host *user.User, id string) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	u, err := r.target(id)
+	if err != nil {
+		return err
+	}
+	if !u.HandRaised() {
+		return ErrHandNotRaised
+	}
+	r.dropHand(u.ID)
+	r.setRole(u, user.RoleSinger)
+	return nil
+}
+
+// denyHand lets the host take a user out of the queue
+func (r *Room) denyHand(host *user.User, id string) error {
+	if err := r.requireHost(host); err != nil {
+		return err
+	}
+	u, err := r.target(id)
+	if err != nil {
+		return err
+	}
+	return r.lowerHand(u)
+}
+
+// leaveStage brings a singer back to the audience
+func (r *Room) leaveStage(u *user.User) error {
+	if u.Role() != user.RoleSinger {
+		return ErrNotSinger
+	}
+	r.setRole(u, user.RoleAudience)
+	return nil
+}
+
+// setRole changes the role of a user and tells the room, users getting on stage during a song start being scored
+func (r *Room) setRole(u *user.User, role user.Role) {
+	log.Printf("room %s: user %s is now %s\n", r.Name, u.ID, role)
+	u.SetRole(role)
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "role_changed", Desc: fmt.Sprintf("user %s is now %s", u.ID, role)},
+		User:      u.Wrap(),
+	}, nil)
+	if u.OnStage() {
+		// Singers getting on stage during a song are scored too, or told why they can't be
+		r.scoreLateSinger(u)
+	}
+}
+
+// electHost gives the room a new host once the previous one left, singers come first, then whoever joined first
+func (r *Room) electHost() {
+	if len(r.users) == 0 || r.host() != nil {
+		return
+	}
+	candidates := make([]*user.User, 0, len(r.users))
+	for _, u := range r.users {
+		candidates = append(candidates, u)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.OnStage() != b.OnStage() {
+			return a.OnStage()
+		}
+		return r.joinOrder[a.ID] < r.joinOrder[b.ID]
+	})
+	r.setHost(candidates[0])
+}
+
+// setHost makes the given user host this room
+func (r *Room) setHost(u *user.User) {
+	if u.HandRaised() {
+		r.dropHand(u.ID)
+		r.broadcastHands("hand_lowered", u)
+	}
+	r.hostID = u.ID
+	r.setRole(u, user.RoleHost)
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "host_changed", Desc: fmt.Sprintf("user %s now hosts this room", u.ID)},
+		User:      u.Wrap(),
+	}, nil)
+}
+
+// dropHand removes a user from the queue
+func (r *Room) dropHand(id string) {
+	for i, hand := range r.hands {
+		if hand == id {
+			r.hands = append(r.hands[:i], r.hands[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *Room) broadcastHands(eventType string, u *user.User) {
+	r.broadcast(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: eventType},
+		User:      u.Wrap(),
+		HandQueue: r.handQueueWrap(),
+	}, nil)
+}
+
+// handQueueWrap returns the users waiting to get on stage, in order
+func (r *Room) handQueueWrap() *socket.HandQueueWrap {
+	return &socket.HandQueueWrap{Users: append([]string{}, r.hands...)}
+}
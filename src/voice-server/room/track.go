@@ -1,20 +1,32 @@
 package room
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/Nahemah1022/singsphere-voice-server/user"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
 // acceptRoomTracks adds all user's mic track in this room to the given user
 func (r *Room) acceptRoomTracks(u *user.User) error {
+	if r.mixer != nil {
+		return r.acceptMixTrack(u)
+	}
+	// The music track is shared by the whole room, so late joiners hear the song currently playing.
+	// Users start as listeners, singers are switched to the music ahead once aligned.
+	if err := u.AcceptMusicTrack(r.audioHub.DelayedTrack()); err != nil {
+		log.Println("ERROR Add music track", err)
+		return err
+	}
 	for _, roomUser := range r.users {
 		micTrack, err := roomUser.GetMicTrack()
 		if err != nil {
-			log.Println(err)
-			return err
+			// Their mic is still negotiating, attachMicTrack sends it to everyone once it is ready
+			continue
 		}
 		if err := u.AcceptMicTrack(micTrack); err != nil {
 			log.Println("ERROR Add remote track", err)
@@ -23,11 +35,62 @@ func (r *Room) acceptRoomTracks(u *user.User) error {
 	}
 	// To enable the newly attached mic track, we re-send the offer again
 	if err := u.SendOffer(); err != nil {
-		panic(err)
+		log.Println("ERROR Send offer", err)
+		return err
+	}
+	return nil
+}
+
+// acceptMixTrack adds the track carrying the room mixed by the server to the given user
+func (r *Room) acceptMixTrack(u *user.User) error {
+	mixTrack, err := r.mixer.AddListener(u.ID)
+	if err != nil {
+		return err
+	}
+	if err := u.AcceptMixTrack(mixTrack); err != nil {
+		log.Println("ERROR Add mix track", err)
+		return err
+	}
+	// Other users keep their single track, only the newcomer needs an offer
+	if err := u.SendOffer(); err != nil {
+		log.Println("ERROR Send offer", err)
+		return err
 	}
 	return nil
 }
 
+// startMixer runs the mixer of this room if it has one, until the room is empty again
+func (r *Room) startMixer() {
+	if r.mixer == nil || r.stopMixing != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, r.stopMixing = context.WithCancel(context.Background())
+	go r.mixer.Run(ctx)
+}
+
+// stopMixer stops the mixer of this room once nobody is left to listen
+func (r *Room) stopMixer() {
+	if r.stopMixing != nil {
+		r.stopMixing()
+		r.stopMixing = nil
+	}
+}
+
+// others returns the users of this room but the given one, it is safe to call from other goroutines than the room's loop
+func (r *Room) others(u *user.User) []*user.User {
+	r.userLock.RLock()
+	defer r.userLock.RUnlock()
+	others := make([]*user.User, 0, len(r.users))
+	for _, roomUser := range r.users {
+		// skip the user himself
+		if roomUser.ID != u.ID {
+			others = append(others, roomUser)
+		}
+	}
+	return others
+}
+
 // attachMicTrack adds the given user's mic track to all users in this room
 func (r *Room) attachMicTrack(u *user.User) error {
 	<-u.MicReadyCtx.Done()
@@ -35,18 +98,19 @@ func (r *Room) attachMicTrack(u *user.User) error {
 	if err != nil {
 		return err
 	}
-	for _, roomUser := range r.users {
-		// skip the user himself
-		if u.ID == roomUser.ID {
-			continue
-		}
+	if r.mixer != nil {
+		go r.mixMicTrack(u)
+		return nil
+	}
+	for _, roomUser := range r.others(u) {
 		if err := roomUser.AcceptMicTrack(micTrack); err != nil {
 			log.Println("ERROR Add remote track", err)
 			return err
 		}
 		// To enable the newly attached mic track, we re-send the offer again
 		if err := roomUser.SendOffer(); err != nil {
-			panic(err)
+			log.Println("ERROR Send offer", err)
+			return err
 		}
 	}
 	go r.broadcastMicTrack(u, micTrack.SSRC())
@@ -55,45 +119,92 @@ func (r *Room) attachMicTrack(u *user.User) error {
 
 // removeMicTrack removes the given user's mic track from all user's sender in this room
 func (r *Room) removeMicTrack(u *user.User) error {
+	if r.mixer != nil {
+		r.mixer.RemoveListener(u.ID)
+		return nil
+	}
 	<-u.MicReadyCtx.Done()
 	micTrack, err := u.GetMicTrack()
 	if err != nil {
 		return err
 	}
-	for _, roomUser := range r.users {
-		// skip the user himself
-		if u.ID == roomUser.ID {
-			continue
-		}
+	for _, roomUser := range r.others(u) {
 		if err := roomUser.RemoveSender(micTrack.SSRC()); err != nil {
 			log.Println("ERROR Remove sender track", err)
 			return err
 		}
 		if err := roomUser.SendOffer(); err != nil {
-			panic(err)
+			log.Println("ERROR Send offer", err)
+			return err
 		}
 	}
 	return nil
 }
 
-// broadcastMicTrack broadcasts incoming RTP packets from the given user's mic to all room users
+// broadcastMicTrack broadcasts incoming RTP packets from the given user's mic to all room users, until the mic is closed.
+// Packets are held for the user's voice delay, so singers stay in step with each other.
 func (r *Room) broadcastMicTrack(u *user.User, micTrackSSRC webrtc.SSRC) {
 	log.Println("Start Broadcasting")
+	queue := make(chan delayedPacket, micQueueLen)
+	go func() {
+		for delayed := range queue {
+			time.Sleep(time.Until(delayed.due))
+			for _, roomUser := range r.others(u) {
+				err := roomUser.WriteRTP(delayed.packet, micTrackSSRC)
+				if err != nil {
+					// panic(err)
+					fmt.Println(err)
+				}
+			}
+		}
+	}()
+	defer close(queue)
 	for {
 		rtp, err := u.ReadRTP()
 		if err != nil {
-			panic(err)
+			log.Printf("user %s: stop broadcasting: %v\n", u.ID, err)
+			return
 		}
-		for _, roomUser := range r.users {
-			// skip the user himself
-			if u.ID == roomUser.ID {
-				continue
-			}
-			err := roomUser.WriteRTP(rtp, micTrackSSRC)
-			if err != nil {
-				// panic(err)
-				fmt.Println(err)
-			}
+		due := time.Now().Add(r.voiceDelay(u.ID))
+		// Only the stage is heard, the audience's mics stay open so they can get on stage at once.
+		// Silence keeps the timestamps of the user's stream continuous for the receivers.
+		if !u.OnStage() || u.Muted() {
+			queue <- delayedPacket{packet: silenced(rtp), due: due}
+			continue
+		}
+		r.recordMic(u, rtp)
+		r.scoreMic(u, rtp)
+		queue <- delayedPacket{packet: rtp, due: due}
+	}
+}
+
+// delayedPacket is a mic packet held until its due time
+type delayedPacket struct {
+	packet *rtp.Packet
+	due    time.Time
+}
+
+// Mic packets waiting to be forwarded, enough for the longest voice delay
+const micQueueLen = 256
+
+// mixMicTrack feeds incoming RTP packets from the given user's mic to the room's mixer, until the mic is closed
+func (r *Room) mixMicTrack(u *user.User) {
+	log.Println("Start Mixing")
+	// The mic closes whenever the user leaves, the others keep hearing the room without them
+	defer r.mixer.RemoveListener(u.ID)
+	for {
+		rtp, err := u.ReadRTP()
+		if err != nil {
+			log.Printf("user %s: stop mixing: %v\n", u.ID, err)
+			return
+		}
+		if len(rtp.Payload) == 0 || !u.OnStage() || u.Muted() {
+			continue
+		}
+		r.recordMic(u, rtp)
+		r.scoreMic(u, rtp)
+		if err := r.mixer.WriteMic(u.ID, rtp.Payload); err != nil {
+			fmt.Println(err)
 		}
 	}
 }
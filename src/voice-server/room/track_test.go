@@ -0,0 +1,80 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/mixer"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/rtc"
+	"github.com/Nahemah1022/singsphere-voice-server/user"
+	"github.com/pion/rtp"
+)
+
+// newTestUser creates a user without a websocket, packets sent on the returned node reach their mic
+func newTestUser(t *testing.T, id string) (*user.User, *rtc.RtcNode) {
+	t.Helper()
+	node, err := rtc.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Ternimate() })
+	return user.New(nil, nil, nil, nil, node, &auth.Identity{ID: id}), node
+}
+
+func TestMixMicTrackClosed(t *testing.T) {
+	m, err := mixer.New()
+	if errors.Is(err, codec.ErrUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(running)
+	}()
+	r := &Room{Name: "room", mixer: m}
+	leaving, leavingNode := newTestUser(t, "leaving")
+	staying, stayingNode := newTestUser(t, "staying")
+	for _, u := range []*user.User{leaving, staying} {
+		u.SetRole(user.RoleSinger)
+		u.SetMuted(false)
+		if _, err := m.AddListener(u.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mixing := make(chan struct{})
+	go func() {
+		r.mixMicTrack(staying)
+		close(mixing)
+	}()
+
+	// Disconnecting closes the mic, mixing it stops without bringing the room down
+	close(leavingNode.RtpCh)
+	r.mixMicTrack(leaving)
+	if _, err := m.AddListener(leaving.ID); err != nil {
+		t.Errorf("the user who left still gets the mix: %v", err)
+	}
+
+	stayingNode.RtpCh <- &rtp.Packet{Payload: codec.SilentFrame}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-running:
+		t.Fatal("the mixer stopped once a mic closed")
+	case <-mixing:
+		t.Fatal("the mic of the user who stayed stopped being mixed")
+	default:
+	}
+	if _, err := m.AddListener(staying.ID); !errors.Is(err, mixer.ErrListenerExists) {
+		t.Errorf("AddListener(%q) error = %v, want %v, the user who stayed must still get the mix", staying.ID, err, mixer.ErrListenerExists)
+	}
+	close(stayingNode.RtpCh)
+	<-mixing
+}
@@ -0,0 +1,118 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// The outgoing song is decoded a bit before the fade starts, so its decoder is warmed up
+const crossfadePreroll = 200 * time.Millisecond
+
+// crossfader blends the end of a song into the beginning of the next one. Both songs are decoded,
+// mixed with linear gain ramps and encoded again, frame by frame.
+type crossfader struct {
+	from   *Song
+	to     *Song
+	enc    *pcmEncoder
+	start  time.Duration // position of from at which the fade starts
+	length time.Duration
+	toPCM  []int16 // decoded samples of to, not mixed yet
+	mixed  []int16
+}
+
+// newCrossfader creates a crossfader encoding with the given encoder, or a new one if nil
+func newCrossfader(from *Song, to *Song, enc *pcmEncoder, start time.Duration, length time.Duration) (*crossfader, error) {
+	if !codec.Available {
+		return nil, codec.ErrUnavailable
+	}
+	if enc == nil {
+		var err error
+		if enc, err = newPCMEncoder(); err != nil {
+			return nil, err
+		}
+	}
+	return &crossfader{
+		from:   from,
+		to:     to,
+		enc:    enc,
+		start:  start,
+		length: length,
+	}, nil
+}
+
+// step consumes the next packet of the outgoing song, and returns the samples ready to be sent.
+// It returns io.EOF along with the last samples once the outgoing song ends, the samples of the
+// incoming song decoded but not mixed yet are then left to be played with it.
+func (f *crossfader) step() ([]media.Sample, error) {
+	pos := f.from.position
+	packet, duration, pcm, err := f.from.nextPCM()
+	if errors.Is(err, io.EOF) {
+		samples, flushErr := f.flush()
+		if flushErr != nil {
+			return nil, flushErr
+		}
+		f.to.leftover = append(f.to.leftover, f.toPCM...)
+		return samples, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pos+duration <= f.start && f.from.gain == 1 && f.enc.missing() == 0 {
+		// Still warming up, the packet is sent as is
+		return []media.Sample{{Data: packet, Duration: duration}}, nil
+	}
+	f.mixed = f.mixed[:0]
+	for i := 0; i+1 < len(pcm); i += codec.Channels {
+		gain := float64(pos+samplesToDuration(uint64(i/codec.Channels))-f.start) / float64(f.length)
+		if gain < 0 {
+			gain = 0
+		} else if gain > 1 {
+			gain = 1
+		}
+		left, right, err := f.nextToSample()
+		if err != nil {
+			return nil, err
+		}
+		f.mixed = append(f.mixed, mixSample(pcm[i], left, gain), mixSample(pcm[i+1], right, gain))
+	}
+	return f.enc.push(f.mixed)
+}
+
+// nextToSample returns the next stereo sample of the incoming song, silence once it ends
+func (f *crossfader) nextToSample() (int16, int16, error) {
+	for len(f.toPCM) == 0 {
+		_, _, pcm, err := f.to.nextPCM()
+		if errors.Is(err, io.EOF) {
+			return 0, 0, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		f.toPCM = append(f.toPCM[:0], pcm...)
+	}
+	left, right := f.toPCM[0], f.toPCM[1]
+	f.toPCM = f.toPCM[2:]
+	return left, right, nil
+}
+
+// flush completes the last frame with the incoming song, so no mixed audio is left behind
+func (f *crossfader) flush() ([]media.Sample, error) {
+	missing := f.enc.missing()
+	fill := make([]int16, 0, missing*codec.Channels)
+	for i := 0; i < missing; i++ {
+		left, right, err := f.nextToSample()
+		if err != nil {
+			return nil, err
+		}
+		fill = append(fill, left, right)
+	}
+	return f.enc.push(fill)
+}
+
+func mixSample(from int16, to int16, gain float64) int16 {
+	return clampSample(float64(from)*(1-gain) + float64(to)*gain)
+}
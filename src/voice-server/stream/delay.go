@@ -0,0 +1,79 @@
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// delayLine sends samples on a track once a delay elapsed, so listeners hear the music in step with
+// singers whose voices come back from further away
+type delayLine struct {
+	track *webrtc.TrackLocalStaticSample
+	lock  sync.Mutex
+	delay time.Duration
+	queue chan delayedSample
+}
+
+type delayedSample struct {
+	sample media.Sample
+	due    time.Time
+}
+
+// Samples waiting in a delay line, enough for the longest alignment delay
+const delayLineLen = 256
+
+func newDelayLine(track *webrtc.TrackLocalStaticSample) *delayLine {
+	d := &delayLine{
+		track: track,
+		queue: make(chan delayedSample, delayLineLen),
+	}
+	go d.run()
+	return d
+}
+
+// WriteSample queues a sample, it is sent once the current delay elapsed
+func (d *delayLine) WriteSample(sample media.Sample) error {
+	d.lock.Lock()
+	due := time.Now().Add(d.delay)
+	d.lock.Unlock()
+	// The caller may reuse the buffer before the sample is sent
+	sample.Data = append([]byte(nil), sample.Data...)
+	d.queue <- delayedSample{sample: sample, due: due}
+	return nil
+}
+
+func (d *delayLine) setDelay(delay time.Duration) {
+	d.lock.Lock()
+	d.delay = delay
+	d.lock.Unlock()
+}
+
+func (d *delayLine) getDelay() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.delay
+}
+
+func (d *delayLine) run() {
+	for delayed := range d.queue {
+		time.Sleep(time.Until(delayed.due))
+		// Errors only mean no peer is bound to the track yet
+		d.track.WriteSample(delayed.sample)
+	}
+}
+
+// teeOutput sends every sample on the lead track right away, and on the delayed track later
+type teeOutput struct {
+	lead    *webrtc.TrackLocalStaticSample
+	delayed *delayLine
+}
+
+func (t *teeOutput) WriteSample(sample media.Sample) error {
+	if err := t.lead.WriteSample(sample); err != nil {
+		return err
+	}
+	return t.delayed.WriteSample(sample)
+}
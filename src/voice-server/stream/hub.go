@@ -1,73 +1,414 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
-	"github.com/pion/webrtc/v3/pkg/media/oggreader"
 )
 
 type AudioHub struct {
-	audioTrack *webrtc.TrackLocalStaticSample
+	audioTrack *webrtc.TrackLocalStaticSample // heard by singers as soon as possible
+	delayed    *delayLine                     // heard by listeners, in step with the singers' voices
+	output     SampleWriter                   // where the audio goes, the tracks unless the room mixes on the server
+	taps       []Tap                          // receive a copy of the audio
 	roomName   string
+	source     MediaSource
+	lock       sync.Mutex
+	streaming  bool
+	paused     bool
+	position   time.Duration  // playback position of the audio sent so far
+	duration   time.Duration  // total duration of the current audio
+	seekTo     *time.Duration // pending seek request, consumed by the streaming loop
+	next       *Song          // song queued right after the current one
+	fading     bool           // whether the current song started fading into next
+	crossfade  time.Duration
+	// Songs are normalized towards loudnessTarget, their measured loudness is kept in the cache
+	loudness       *LoudnessCache
+	loudnessTarget float64
+	// Pacing clock, kept across songs so that consecutive songs are handed off without gaps.
+	// Only Play writes it, holding the lock so NextStart can read it from other goroutines.
+	clockStart time.Time
+	sent       time.Duration // audio sent since clockStart
+	lastWrite  time.Time
 }
 
-// New creates a new audio hub for the given room
-func New(roomName string) (*AudioHub, error) {
+const (
+	// Packets are sent slightly ahead of the wall clock, so receivers' jitter buffers never run dry
+	sendAhead = 40 * time.Millisecond
+	// A song played within this delay after the previous one continues its pacing clock
+	handoffTolerance = 100 * time.Millisecond
+)
+
+// SampleWriter receives the audio of a hub, such as its track or a mixer
+type SampleWriter interface {
+	WriteSample(sample media.Sample) error
+}
+
+// Tap receives a copy of the audio of a hub, along with when each sample is due to play
+type Tap interface {
+	WriteMusic(sample media.Sample, at time.Time)
+}
+
+var (
+	ErrNotStreaming    = errors.New("no audio is streaming")
+	ErrAlreadyFading   = errors.New("the current song already started fading into the next one")
+	ErrSeekWhileFading = errors.New("can't seek while crossfading")
+)
+
+// New creates a new audio hub for the given room, songs are read from the given source.
+// The loudness cache may be nil, songs are then measured every time they are loaded.
+func New(roomName string, source MediaSource, loudness *LoudnessCache) (*AudioHub, error) {
 	audioTrack, audioTrackErr := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "music", "hub")
 	if audioTrackErr != nil {
 		return nil, audioTrackErr
 	}
+	delayedTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "music", "hub-delayed")
+	if err != nil {
+		return nil, err
+	}
+	delayed := newDelayLine(delayedTrack)
 	hub := &AudioHub{
-		audioTrack: audioTrack,
-		roomName:   roomName,
+		audioTrack:     audioTrack,
+		delayed:        delayed,
+		output:         &teeOutput{lead: audioTrack, delayed: delayed},
+		roomName:       roomName,
+		source:         source,
+		loudness:       loudness,
+		loudnessTarget: DefaultLoudnessTarget,
 	}
 	return hub, nil
 }
 
-// StreamAudioFile starts to stream the given audio file in this hub
-func (hub *AudioHub) StreamAudioFile(filepath string) {
-	file, err := os.Open(filepath)
-	if err != nil {
-		log.Println(err)
-		return
+// Track returns the local track that carries this hub's audio, it can be attached to any number of peer connections
+func (hub *AudioHub) Track() *webrtc.TrackLocalStaticSample {
+	return hub.audioTrack
+}
+
+// DelayedTrack returns the track carrying this hub's audio after the listener delay
+func (hub *AudioHub) DelayedTrack() *webrtc.TrackLocalStaticSample {
+	return hub.delayed.track
+}
+
+// SetListenerDelay delays the audio of DelayedTrack behind Track by the given duration
+func (hub *AudioHub) SetListenerDelay(delay time.Duration) {
+	hub.delayed.setDelay(delay)
+}
+
+// ListenerDelay returns how far DelayedTrack is behind Track
+func (hub *AudioHub) ListenerDelay() time.Duration {
+	return hub.delayed.getDelay()
+}
+
+// SetOutput sends the audio of this hub to the given writer instead of its track, it must be called before playing
+func (hub *AudioHub) SetOutput(output SampleWriter) {
+	hub.output = output
+}
+
+// AddTap sends a copy of the audio of this hub to the given tap
+func (hub *AudioHub) AddTap(tap Tap) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	// Copy on write, the streaming loop keeps using the slice it read
+	hub.taps = append(append([]Tap{}, hub.taps...), tap)
+}
+
+// RemoveTap stops sending the audio of this hub to the given tap
+func (hub *AudioHub) RemoveTap(tap Tap) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	taps := []Tap{}
+	for _, t := range hub.taps {
+		if t != tap {
+			taps = append(taps, t)
+		}
 	}
-	ogg, _, oggErr := oggreader.NewWith(file)
-	if oggErr != nil {
-		panic(oggErr)
+	hub.taps = taps
+}
+
+// Pause stops sending audio without tearing down the track, the position is kept until Resume
+func (hub *AudioHub) Pause() error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if !hub.streaming {
+		return ErrNotStreaming
 	}
-	// Keep track of last granule, the difference is the amount of samples in the buffer
-	var lastGranule uint64
+	hub.paused = true
+	return nil
+}
 
+// Resume continues sending audio from where it was paused
+func (hub *AudioHub) Resume() error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if !hub.streaming {
+		return ErrNotStreaming
+	}
+	hub.paused = false
+	return nil
+}
+
+// Seek requests the streaming loop to jump to the given position of the current audio
+func (hub *AudioHub) Seek(pos time.Duration) error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if !hub.streaming {
+		return ErrNotStreaming
+	}
+	// The duration is unknown for sources which can't be probed, the streaming loop checks the range then
+	if pos < 0 || (hub.duration > 0 && pos >= hub.duration) {
+		return errSeekOutOfRange
+	}
+	hub.seekTo = &pos
+	return nil
+}
+
+// Position returns the playback position of the current audio
+func (hub *AudioHub) Position() time.Duration {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return hub.position
+}
+
+// SetNext queues the song played right after the current one, so it can be crossfaded into. A nil song
+// cancels the queued one. It fails once the current song started fading into the queued one.
+func (hub *AudioHub) SetNext(song *Song) error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.fading {
+		return ErrAlreadyFading
+	}
+	hub.next = song
+	return nil
+}
+
+// SetCrossfade sets how long consecutive songs overlap, 0 hands them off back to back
+func (hub *AudioHub) SetCrossfade(d time.Duration) {
+	hub.lock.Lock()
+	hub.crossfade = d
+	hub.lock.Unlock()
+}
+
+// Crossfade returns how long consecutive songs overlap
+func (hub *AudioHub) Crossfade() time.Duration {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return hub.crossfade
+}
+
+// Duration returns the total duration of the current audio, or 0 if it is unknown
+func (hub *AudioHub) Duration() time.Duration {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return hub.duration
+}
+
+// Paused tells whether the current audio is paused
+func (hub *AudioHub) Paused() bool {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return hub.paused
+}
+
+// NextStart returns when the beginning of the given song is due if it is played right away: right after the
+// audio already sent if the previous song just ended, so songs stay gapless, or now otherwise. It is in the
+// past for a song already started by a crossfade. The bool tells whether the song continues the previous one.
+// It may be called while a song plays, though its result only holds once the song ended.
+func (hub *AudioHub) NextStart(song *Song) (time.Time, bool) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if time.Since(hub.lastWrite) > handoffTolerance {
+		return time.Now(), false
+	}
+	return hub.clockStart.Add(hub.sent - song.position), true
+}
+
+// Play streams the given song in this hub, and blocks until the whole song is sent or ctx is cancelled.
+// The song is closed once it ends. If the song was queued with SetNext, it continues from where the
+// crossfade left it. Unless at is zero, the song starts at the given time, so clients playing the song
+// on their own can start with it.
+func (hub *AudioHub) Play(ctx context.Context, song *Song, at time.Time) error {
+	defer song.Close()
+	if !at.IsZero() {
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	hub.lock.Lock()
+	hub.streaming, hub.paused, hub.seekTo = true, false, nil
+	hub.position, hub.duration = song.position, song.Duration()
+	if hub.next == song {
+		hub.next = nil
+	}
+	hub.fading = false
+	// Keep the pacing clock if the previous song just ended, so the handoff is gapless
+	resync := time.Since(hub.lastWrite) > handoffTolerance
+	if !at.IsZero() {
+		hub.clockStart, hub.sent = at, song.position
+		resync = false
+	}
+	hub.lock.Unlock()
+	defer func() {
+		hub.lock.Lock()
+		hub.streaming, hub.paused, hub.seekTo = false, false, nil
+		hub.lock.Unlock()
+	}()
+
+	// Songs whose volume is adjusted, or which continue a crossfade, are decoded and encoded again
+	var enc *pcmEncoder
+	if song.gain != 1 || len(song.leftover) > 0 {
+		var err error
+		if enc, err = newPCMEncoder(); err != nil {
+			log.Printf("room %s: fail to normalize: %v\n", hub.roomName, err)
+			song.gain, song.leftover = 1, nil
+		}
+	}
+	var fader *crossfader
 	// It is important to use a time.Ticker instead of time.Sleep because
 	// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
 	// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
 	ticker := time.NewTicker(time.Millisecond * 20)
-	for ; true; <-ticker.C {
-		pageData, pageHeader, oggErr := ogg.ParseNextPage()
-		if errors.Is(oggErr, io.EOF) {
-			log.Println("All audio pages parsed and sent")
-			return
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
-		if oggErr != nil {
-			log.Println(oggErr)
-			return
+		hub.lock.Lock()
+		paused, seekTo, crossfade, taps := hub.paused, hub.seekTo, hub.crossfade, hub.taps
+		hub.seekTo = nil
+		hub.lock.Unlock()
+
+		if seekTo != nil {
+			if fader != nil {
+				log.Printf("room %s: %v\n", hub.roomName, ErrSeekWhileFading)
+			} else if err := song.seek(*seekTo); err != nil {
+				log.Printf("room %s: fail to seek: %v\n", hub.roomName, err)
+			} else {
+				hub.setPosition(song.position)
+			}
+		}
+		if paused {
+			resync = true
+			continue
+		}
+		if resync {
+			hub.lock.Lock()
+			hub.clockStart, hub.sent = time.Now(), 0
+			hub.lock.Unlock()
+			resync = false
 		}
 
-		// The amount of samples is the difference between the last and current timestamp
-		sampleCount := float64(pageHeader.GranulePosition - lastGranule)
-		lastGranule = pageHeader.GranulePosition
-		sampleDuration := time.Duration((sampleCount/48000)*1000) * time.Millisecond
+		for hub.sent < time.Since(hub.clockStart)+sendAhead {
+			fadeStart := song.Duration() - crossfade
+			if fader == nil && crossfade > 0 && song.Duration() > 0 && song.position >= fadeStart-crossfadePreroll {
+				if next := hub.startFading(); next != nil {
+					var err error
+					if fader, err = newCrossfader(song, next, enc, fadeStart, crossfade); err != nil {
+						// Without a codec the songs are still handed off back to back
+						log.Printf("room %s: fail to crossfade: %v\n", hub.roomName, err)
+						hub.lock.Lock()
+						hub.fading, hub.crossfade = false, 0
+						hub.lock.Unlock()
+						crossfade = 0
+					}
+				}
+			}
 
-		if oggErr = hub.audioTrack.WriteSample(media.Sample{Data: pageData, Duration: sampleDuration}); oggErr != nil {
-			log.Println(oggErr)
-			return
+			var samples []media.Sample
+			var err error
+			if fader != nil {
+				samples, err = fader.step()
+			} else if enc != nil {
+				samples, err = hub.nextEncoded(song, enc)
+			} else {
+				var packet []byte
+				var duration time.Duration
+				packet, duration, err = song.nextAudio()
+				if err == nil {
+					song.measure(packet, duration)
+				}
+				samples = []media.Sample{{Data: packet, Duration: duration}}
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			var written time.Duration
+			for _, sample := range samples {
+				if sample.Data == nil {
+					continue
+				}
+				if err := hub.output.WriteSample(sample); err != nil {
+					return err
+				}
+				for _, tap := range taps {
+					tap.WriteMusic(sample, hub.clockStart.Add(hub.sent+written))
+				}
+				written += sample.Duration
+			}
+			hub.advance(written)
+			if errors.Is(err, io.EOF) {
+				log.Printf("room %s: all audio pages parsed and sent\n", hub.roomName)
+				hub.saveLoudness(song)
+				return nil
+			}
+			hub.setPosition(song.position)
+		}
+	}
+}
+
+// nextEncoded decodes the next packet of the song, and returns the packets encoded again once processed
+func (hub *AudioHub) nextEncoded(song *Song, enc *pcmEncoder) ([]media.Sample, error) {
+	if len(song.leftover) > 0 {
+		leftover := song.leftover
+		song.leftover = nil
+		return enc.push(leftover)
+	}
+	_, _, pcm, err := song.nextPCM()
+	if errors.Is(err, io.EOF) {
+		samples, err := enc.flush()
+		if err != nil {
+			return nil, err
 		}
+		return samples, io.EOF
 	}
+	if err != nil {
+		return nil, err
+	}
+	return enc.push(pcm)
+}
+
+// startFading locks in the queued song as the one the current song fades into, it returns nil if there is none
+func (hub *AudioHub) startFading() *Song {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.next == nil {
+		return nil
+	}
+	hub.fading = true
+	return hub.next
+}
+
+// advance moves the pacing clock past audio of the given duration which was just written
+func (hub *AudioHub) advance(d time.Duration) {
+	hub.lock.Lock()
+	hub.sent += d
+	hub.lastWrite = time.Now()
+	hub.lock.Unlock()
+}
+
+func (hub *AudioHub) setPosition(pos time.Duration) {
+	hub.lock.Lock()
+	hub.position = pos
+	hub.lock.Unlock()
 }
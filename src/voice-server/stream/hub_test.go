@@ -0,0 +1,98 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// testSong returns an Ogg Opus song of the given number of silent 20 ms CELT packets
+func testSong(packets int) []byte {
+	head := append([]byte(opusIDSignature), 1, 2, 0, 0, 0x80, 0xBB, 0, 0, 0, 0, 0)
+	tags := append([]byte(opusCommentSignature), make([]byte, 8)...)
+	song := oggPageBytes(0, 0, [][]byte{head}, nil)
+	song = append(song, oggPageBytes(0, 0, [][]byte{tags}, nil)...)
+	for i := 1; i <= packets; i++ {
+		page := oggPageBytes(0, uint64(i*testPacketSamples), [][]byte{{0xF8, 0xFF, 0xFE}}, nil)
+		song = append(song, page...)
+	}
+	return song
+}
+
+// sampleCounter counts the samples written to it
+type sampleCounter struct {
+	lock     sync.Mutex
+	samples  int
+	duration time.Duration
+}
+
+func (c *sampleCounter) WriteSample(sample media.Sample) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.samples++
+	c.duration += sample.Duration
+	return nil
+}
+
+func TestPlay(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets int
+	}{
+		{name: "one packet", packets: 1},
+		{name: "short song", packets: 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := NewMemorySource()
+			source.Put("song.ogg", testSong(test.packets))
+			hub, err := New("room", source, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output := &sampleCounter{}
+			hub.SetOutput(output)
+			song, err := hub.Load(context.Background(), "song.ogg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			next, err := hub.Load(context.Background(), "song.ogg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer next.Close()
+
+			// The room schedules the next song while the current one plays
+			done := make(chan error)
+			go func() {
+				done <- hub.Play(context.Background(), song, time.Time{})
+			}()
+			for playing := true; playing; {
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Fatal(err)
+					}
+					playing = false
+				default:
+					hub.NextStart(next)
+				}
+			}
+
+			want := time.Duration(test.packets) * 20 * time.Millisecond
+			if output.samples != test.packets || output.duration != want {
+				t.Errorf("sent %d samples lasting %v, want %d lasting %v", output.samples, output.duration, test.packets, want)
+			}
+			start, continuous := hub.NextStart(next)
+			if !continuous {
+				t.Fatal("the next song doesn't continue the one which just ended")
+			}
+			if lead := time.Until(start); lead < -handoffTolerance || lead > sendAhead {
+				t.Errorf("the next song starts in %v, want right after the song which just ended", lead)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+/*
+This loudness.go normalizes the volume of songs. The integrated loudness of a song is read from its
+R128 or ReplayGain tags, or measured while it is played the first time, and cached. Songs are then
+scaled towards the target loudness of the room while being streamed.
+*/
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/loudness"
+)
+
+const (
+	// DefaultLoudnessTarget is the loudness songs are brought to, in LUFS, as recommended by ReplayGain 2.0
+	DefaultLoudnessTarget = -18.0
+	// Gains closer to 0 dB than this aren't worth decoding and encoding a song again
+	normalizationThreshold = 0.5
+	// Reference loudness of R128 gain tags, and of ReplayGain tags, in LUFS
+	r128Reference       = -23.0
+	replayGainReference = -18.0
+	// Songs quieter than this are considered silent, and never amplified
+	silenceLoudness = -70.0
+)
+
+// songLoudness is the measured loudness of a song
+type songLoudness struct {
+	Loudness float64 `json:"loudness"` // LUFS
+	Peak     float64 `json:"peak"`     // highest absolute sample, 1 is full scale, 0 if unknown
+}
+
+// loudnessFromTags reads the loudness from the gain tags of the song, or returns nil if there are none
+func loudnessFromTags(tags map[string]string) *songLoudness {
+	// R128_TRACK_GAIN is a Q7.8 gain in dB bringing the song to -23 LUFS
+	if gain, err := strconv.Atoi(tags["R128_TRACK_GAIN"]); err == nil {
+		return &songLoudness{Loudness: r128Reference - float64(gain)/256}
+	}
+	if gain, err := parseReplayGain(tags["REPLAYGAIN_TRACK_GAIN"]); err == nil {
+		peak, _ := strconv.ParseFloat(strings.TrimSpace(tags["REPLAYGAIN_TRACK_PEAK"]), 64)
+		return &songLoudness{Loudness: replayGainReference - gain, Peak: peak}
+	}
+	return nil
+}
+
+// parseReplayGain parses gains like "-6.48 dB"
+func parseReplayGain(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(value, "dB"), "db"))
+	return strconv.ParseFloat(value, 64)
+}
+
+// LoudnessCache keeps the measured loudness of songs in a JSON file, so songs are only measured once
+type LoudnessCache struct {
+	path    string
+	lock    sync.Mutex
+	entries map[string]*songLoudness // keyed by song key
+}
+
+// NewLoudnessCache creates a cache persisted to the given file, which is loaded if it exists
+func NewLoudnessCache(path string) (*LoudnessCache, error) {
+	cache := &LoudnessCache{
+		path:    path,
+		entries: make(map[string]*songLoudness),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// LoudnessCacheFromEnv creates a cache persisted to LOUDNESS_CACHE_FILE, or a file under the system temp dir
+func LoudnessCacheFromEnv() (*LoudnessCache, error) {
+	path := os.Getenv("LOUDNESS_CACHE_FILE")
+	if path == "" {
+		path = filepath.Join(os.TempDir(), "singsphere-loudness.json")
+	}
+	return NewLoudnessCache(path)
+}
+
+func (c *LoudnessCache) get(key string) *songLoudness {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[key]
+}
+
+// put stores the loudness of a song, the file is replaced at once so it is never left half written
+func (c *LoudnessCache) put(key string, value *songLoudness) error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = value
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	partial := c.path + ".part"
+	if err := os.WriteFile(partial, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(partial, c.path)
+}
+
+// SetLoudnessTarget sets the loudness songs are brought to in LUFS, it applies to songs loaded afterwards
+func (hub *AudioHub) SetLoudnessTarget(target float64) {
+	hub.lock.Lock()
+	hub.loudnessTarget = target
+	hub.lock.Unlock()
+}
+
+// LoudnessTarget returns the loudness songs are brought to in LUFS
+func (hub *AudioHub) LoudnessTarget() float64 {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return hub.loudnessTarget
+}
+
+// normalize sets the gain bringing the song to the target loudness. Songs are left untouched if their
+// loudness is unknown, or if the codec needed to apply the gain is unavailable. Songs of unknown loudness
+// are measured while they play, so they are normalized the next time.
+func (hub *AudioHub) normalize(song *Song) {
+	if measured := hub.loudness.get(songKey(song.audio)); measured != nil {
+		song.loudness = measured
+	} else if song.loudness == nil && codec.Available && hub.loudness != nil {
+		song.meter = loudness.NewMeter(codec.Channels)
+	}
+	if song.loudness == nil || song.loudness.Loudness < silenceLoudness {
+		return
+	}
+	song.Music.Loudness = roundTenth(song.loudness.Loudness)
+	if !codec.Available {
+		return
+	}
+	gain := loudness.Gain(song.loudness.Loudness, song.loudness.Peak, hub.LoudnessTarget())
+	if math.Abs(gain) < normalizationThreshold {
+		return
+	}
+	song.gain = loudness.DBToLinear(gain)
+	song.Music.Gain = roundTenth(gain)
+}
+
+// measure decodes a packet sent as is, so the song's meter hears it too
+func (song *Song) measure(packet []byte, duration time.Duration) {
+	if song.meter == nil {
+		return
+	}
+	if _, err := song.decode(packet, duration); err != nil {
+		// A partial measurement would be wrong, the song is measured again next time
+		song.meter = nil
+	}
+}
+
+// saveLoudness caches the loudness measured while the song played to its end
+func (hub *AudioHub) saveLoudness(song *Song) {
+	if song.meter == nil {
+		return
+	}
+	measured := &songLoudness{Loudness: song.meter.Integrated(), Peak: song.meter.Peak()}
+	song.meter = nil
+	if err := hub.loudness.put(songKey(song.audio), measured); err != nil {
+		log.Printf("room %s: fail to cache loudness of %s: %v\n", hub.roomName, song.Music.SongName, err)
+	}
+}
+
+func roundTenth(value float64) float64 {
+	return math.Round(value*10) / 10
+}
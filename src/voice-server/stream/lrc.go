@@ -0,0 +1,198 @@
+/*
+This lrc.go parses time-synced lyrics in the LRC format, including the enhanced format
+where each word of a line carries its own <mm:ss.xx> timestamp.
+*/
+package stream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lyrics are the time-synced lyrics of a song, lines are sorted by time
+type Lyrics struct {
+	Title  string       `json:"title,omitempty"`
+	Artist string       `json:"artist,omitempty"`
+	Album  string       `json:"album,omitempty"`
+	Lines  []*LyricLine `json:"lines"`
+}
+
+// LyricLine is a line of lyrics, times are playback positions in seconds
+type LyricLine struct {
+	Index int          `json:"index"`
+	Time  float64      `json:"time"`
+	Text  string       `json:"text"`
+	Words []*LyricWord `json:"words,omitempty"` // only given by enhanced LRC and UltraStar
+	Part  int          `json:"part,omitempty"`  // part of a duet singing the line, 0 if it is sung by everyone
+}
+
+// LyricWord is a word of an enhanced LRC line, or a syllable of an UltraStar line
+type LyricWord struct {
+	Time     float64 `json:"time"`
+	Duration float64 `json:"duration,omitempty"` // only given by UltraStar
+	Text     string  `json:"text"`
+}
+
+var (
+	lrcTimestampPattern = regexp.MustCompile(`^\[(\d+):(\d+(?:[.:]\d+)?)\]`)
+	lrcTagPattern       = regexp.MustCompile(`^\[([a-zA-Z]+):(.*)\]$`)
+	lrcWordPattern      = regexp.MustCompile(`<(\d+):(\d+(?:[.:]\d+)?)>`)
+)
+
+// ParseLRC parses LRC lyrics, unknown tags and malformed lines are ignored
+func ParseLRC(r io.Reader) (*Lyrics, error) {
+	lyrics := &Lyrics{Lines: []*LyricLine{}}
+	var offset time.Duration
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// A line may start with several timestamps when it is repeated, like a chorus
+		times := []time.Duration{}
+		for {
+			match := lrcTimestampPattern.FindStringSubmatch(line)
+			if match == nil {
+				break
+			}
+			times = append(times, parseLRCTime(match[1], match[2]))
+			line = line[len(match[0]):]
+		}
+		if len(times) == 0 {
+			if match := lrcTagPattern.FindStringSubmatch(line); match != nil {
+				value := strings.TrimSpace(match[2])
+				switch strings.ToLower(match[1]) {
+				case "ti":
+					lyrics.Title = value
+				case "ar":
+					lyrics.Artist = value
+				case "al":
+					lyrics.Album = value
+				case "offset":
+					// A positive offset shows lyrics sooner
+					if ms, err := strconv.Atoi(value); err == nil {
+						offset = time.Duration(ms) * time.Millisecond
+					}
+				}
+			}
+			continue
+		}
+		text, words := parseLRCWords(line)
+		for _, t := range times {
+			lyrics.Lines = append(lyrics.Lines, &LyricLine{
+				Time:  t.Seconds(),
+				Text:  text,
+				Words: words,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	applyLRCOffset(lyrics, offset)
+	sortLyricLines(lyrics)
+	return lyrics, nil
+}
+
+// sortLyricLines sorts the lines by time and numbers them
+func sortLyricLines(lyrics *Lyrics) {
+	sort.SliceStable(lyrics.Lines, func(i, j int) bool {
+		return lyrics.Lines[i].Time < lyrics.Lines[j].Time
+	})
+	for i, line := range lyrics.Lines {
+		line.Index = i
+	}
+}
+
+// parseLRCWords splits the word timestamps out of an enhanced LRC line
+func parseLRCWords(line string) (string, []*LyricWord) {
+	matches := lrcWordPattern.FindAllStringSubmatchIndex(line, -1)
+	if len(matches) == 0 {
+		return strings.TrimSpace(line), nil
+	}
+	words := []*LyricWord{}
+	for i, match := range matches {
+		end := len(line)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		text := strings.TrimSpace(line[match[1]:end])
+		if text == "" {
+			// A trailing timestamp only marks the end of the last word
+			continue
+		}
+		words = append(words, &LyricWord{
+			Time: parseLRCTime(line[match[2]:match[3]], line[match[4]:match[5]]).Seconds(),
+			Text: text,
+		})
+	}
+	texts := make([]string, len(words))
+	for i, word := range words {
+		texts[i] = word.Text
+	}
+	return strings.Join(texts, " "), words
+}
+
+func parseLRCTime(minutes string, seconds string) time.Duration {
+	m, _ := strconv.Atoi(minutes)
+	// Some files separate hundredths with a colon
+	s, _ := strconv.ParseFloat(strings.Replace(seconds, ":", ".", 1), 64)
+	return time.Duration(m)*time.Minute + time.Duration(s*float64(time.Second))
+}
+
+func applyLRCOffset(lyrics *Lyrics, offset time.Duration) {
+	if offset == 0 {
+		return
+	}
+	shift := func(t float64) float64 {
+		if t -= offset.Seconds(); t < 0 {
+			return 0
+		}
+		return t
+	}
+	for _, line := range lyrics.Lines {
+		line.Time = shift(line.Time)
+	}
+	// Lines repeated with several timestamps share their words
+	shifted := map[*LyricWord]bool{}
+	for _, line := range lyrics.Lines {
+		for _, word := range line.Words {
+			if !shifted[word] {
+				word.Time = shift(word.Time)
+				shifted[word] = true
+			}
+		}
+	}
+}
+
+// LineAt returns the index of the line being sung at the given playback position, or -1 before the first line
+func (lyrics *Lyrics) LineAt(pos time.Duration) int {
+	return sort.Search(len(lyrics.Lines), func(i int) bool {
+		return lyrics.Lines[i].Time > pos.Seconds()
+	}) - 1
+}
+
+// lyricsKey returns the name of the LRC file lying next to the given song
+func lyricsKey(name string) string {
+	key := songKey(name)
+	return strings.TrimSuffix(key, path.Ext(key)) + ".lrc"
+}
+
+// loadLyrics reads the lyrics of the named song, it returns nil lyrics if the song has none
+func (hub *AudioHub) loadLyrics(ctx context.Context, name string) (*Lyrics, error) {
+	file, err := hub.source.Open(ctx, lyricsKey(name))
+	if errors.Is(err, ErrSongNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseLRC(file)
+}
@@ -0,0 +1,165 @@
+package stream
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLine is a lyric line without its index, words are given as time and text
+type testLine struct {
+	time  float64
+	text  string
+	words []LyricWord
+}
+
+func linesOf(lyrics *Lyrics) []testLine {
+	lines := []testLine{}
+	for _, line := range lyrics.Lines {
+		var words []LyricWord
+		for _, word := range line.Words {
+			words = append(words, *word)
+		}
+		lines = append(lines, testLine{time: line.Time, text: line.Text, words: words})
+	}
+	return lines
+}
+
+func TestParseLRC(t *testing.T) {
+	tests := []struct {
+		name      string
+		lrc       string
+		wantLines []testLine
+		wantTags  [3]string // title, artist and album
+	}{
+		{
+			name: "simple lines",
+			lrc:  "[00:01.50]Hello\n[00:03.25] world \n",
+			wantLines: []testLine{
+				{time: 1.5, text: "Hello"},
+				{time: 3.25, text: "world"},
+			},
+		},
+		{
+			name: "tags",
+			lrc:  "[ti: Song ]\n[ar:Artist]\n[al:Album]\n[by:someone]\n[00:01.00]Line",
+			wantLines: []testLine{
+				{time: 1, text: "Line"},
+			},
+			wantTags: [3]string{"Song", "Artist", "Album"},
+		},
+		{
+			name: "repeated lines are sorted",
+			lrc:  "[00:10.00][00:02.00]Chorus\n[00:05.00]Verse",
+			wantLines: []testLine{
+				{time: 2, text: "Chorus"},
+				{time: 5, text: "Verse"},
+				{time: 10, text: "Chorus"},
+			},
+		},
+		{
+			name: "minutes and colon separated hundredths",
+			lrc:  "[01:02:50]Late\n[2:00]Later",
+			wantLines: []testLine{
+				{time: 62.5, text: "Late"},
+				{time: 120, text: "Later"},
+			},
+		},
+		{
+			name: "offset shows lyrics sooner",
+			lrc:  "[offset:500]\n[00:00.25]Clamped\n[00:02.00]Line",
+			wantLines: []testLine{
+				{time: 0, text: "Clamped"},
+				{time: 1.5, text: "Line"},
+			},
+		},
+		{
+			name: "enhanced words",
+			lrc:  "[00:01.00]<00:01.00>Hello <00:01.50>dear <00:02.25>world<00:03.00>",
+			wantLines: []testLine{
+				{time: 1, text: "Hello dear world", words: []LyricWord{
+					{Time: 1, Text: "Hello"},
+					{Time: 1.5, Text: "dear"},
+					{Time: 2.25, Text: "world"},
+				}},
+			},
+		},
+		{
+			name: "enhanced words shifted by the offset",
+			lrc:  "[offset:1000]\n[00:02.00][00:04.00]<00:02.00>Again <00:02.50>and",
+			wantLines: []testLine{
+				{time: 1, text: "Again and", words: []LyricWord{
+					{Time: 1, Text: "Again"},
+					{Time: 1.5, Text: "and"},
+				}},
+				{time: 3, text: "Again and", words: []LyricWord{
+					{Time: 1, Text: "Again"},
+					{Time: 1.5, Text: "and"},
+				}},
+			},
+		},
+		{
+			name: "malformed lines are ignored",
+			lrc: strings.Join([]string{
+				"no timestamp",
+				"[xx:01.00]bad minutes",
+				"[00:01.00",
+				"[offset:soon]",
+				"[]",
+				"",
+				"[00:01.00]Kept",
+			}, "\n"),
+			wantLines: []testLine{
+				{time: 1, text: "Kept"},
+			},
+		},
+		{
+			name:      "empty",
+			lrc:       "",
+			wantLines: []testLine{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lyrics, err := ParseLRC(strings.NewReader(test.lrc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := linesOf(lyrics); !reflect.DeepEqual(got, test.wantLines) {
+				t.Errorf("lines = %+v, want %+v", got, test.wantLines)
+			}
+			for i, line := range lyrics.Lines {
+				if line.Index != i {
+					t.Errorf("line %d has index %d", i, line.Index)
+				}
+			}
+			if tags := [3]string{lyrics.Title, lyrics.Artist, lyrics.Album}; tags != test.wantTags {
+				t.Errorf("tags = %q, want %q", tags, test.wantTags)
+			}
+		})
+	}
+}
+
+func TestLyricsLineAt(t *testing.T) {
+	lyrics, err := ParseLRC(strings.NewReader("[00:01.00]One\n[00:02.00]Two\n[00:04.00]Three"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pos  time.Duration
+		want int
+	}{
+		{pos: 0, want: -1},
+		{pos: 999 * time.Millisecond, want: -1},
+		{pos: time.Second, want: 0},
+		{pos: 3 * time.Second, want: 1},
+		{pos: 4 * time.Second, want: 2},
+		{pos: time.Minute, want: 2},
+	}
+	for _, test := range tests {
+		if got := lyrics.LineAt(test.pos); got != test.want {
+			t.Errorf("LineAt(%v) = %d, want %d", test.pos, got, test.want)
+		}
+	}
+}
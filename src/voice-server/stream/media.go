@@ -1,7 +1,14 @@
 package stream
 
 type Music struct {
-	SongName string `json:"name"`
-	Artist   string `json:"artist"`
-	Duration int    `json:"duration"`
+	SongName string   `json:"name"`
+	Title    string   `json:"title,omitempty"`
+	Artist   string   `json:"artist"`
+	Album    string   `json:"album,omitempty"`
+	Duration int      `json:"duration"` // seconds
+	Channels int      `json:"channels,omitempty"`
+	PreSkip  int      `json:"pre_skip,omitempty"` // samples at 48 kHz
+	Loudness float64  `json:"loudness,omitempty"` // integrated loudness in LUFS, 0 if unknown
+	Gain     float64  `json:"gain,omitempty"`     // dB applied to reach the room's target loudness
+	Karaoke  *Karaoke `json:"karaoke,omitempty"`  // read from the song's UltraStar file, nil if it has none
 }
@@ -0,0 +1,88 @@
+/*
+This melody.go reads the reference melody of songs, used to score singers. It lies next to the song
+as JSON, with the notes to sing and when:
+
+	{"notes": [{"time": 12.5, "duration": 0.4, "pitch": 62, "text": "Hel"}, ...]}
+*/
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Melody is the reference melody of a song, notes are sorted by time
+type Melody struct {
+	Notes []*MelodyNote `json:"notes"`
+}
+
+// MelodyNote is a note of a melody, times are playback positions in seconds
+type MelodyNote struct {
+	Time     float64 `json:"time"`
+	Duration float64 `json:"duration"`
+	Pitch    float64 `json:"pitch"` // MIDI note number, 60 is the middle C
+	Text     string  `json:"text,omitempty"`
+	Kind     string  `json:"kind,omitempty"` // empty for regular notes, or one of the Note kinds
+	Part     int     `json:"part,omitempty"` // part of a duet singing the note, 0 if it is sung by everyone
+}
+
+// Kinds of notes, regular notes have none
+const (
+	NoteGolden    = "golden"    // worth more
+	NoteFreestyle = "freestyle" // not scored
+	NoteRap       = "rap"       // spoken, the pitch doesn't matter
+	NoteGoldenRap = "golden_rap"
+)
+
+var ErrInvalidMelody = errors.New("invalid melody")
+
+// ParseMelody parses a JSON melody, notes are sorted by time
+func ParseMelody(r io.Reader) (*Melody, error) {
+	var melody Melody
+	if err := json.NewDecoder(r).Decode(&melody); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMelody, err)
+	}
+	for i, note := range melody.Notes {
+		if note == nil || note.Time < 0 || note.Duration <= 0 {
+			return nil, fmt.Errorf("%w: note %d", ErrInvalidMelody, i)
+		}
+	}
+	sortMelody(&melody)
+	return &melody, nil
+}
+
+func sortMelody(melody *Melody) {
+	sort.SliceStable(melody.Notes, func(i, j int) bool {
+		return melody.Notes[i].Time < melody.Notes[j].Time
+	})
+}
+
+// Pitched tells whether singers are expected to hit the pitch of the note
+func (note *MelodyNote) Pitched() bool {
+	return note.Kind != NoteFreestyle && note.Kind != NoteRap && note.Kind != NoteGoldenRap
+}
+
+// melodyKey returns the name of the melody file lying next to the given song
+func melodyKey(name string) string {
+	key := songKey(name)
+	return strings.TrimSuffix(key, path.Ext(key)) + ".melody.json"
+}
+
+// loadMelody reads the melody of the named song, it returns a nil melody if the song has none
+func (hub *AudioHub) loadMelody(ctx context.Context, name string) (*Melody, error) {
+	file, err := hub.source.Open(ctx, melodyKey(name))
+	if errors.Is(err, ErrSongNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseMelody(file)
+}
@@ -0,0 +1,197 @@
+/*
+This objectstore.go implements a MediaSource on top of an S3 compatible object store. Objects are
+fetched with plain HTTP GET requests, signed with AWS Signature Version 4 when credentials are given,
+and streamed to the hub while being downloaded.
+*/
+package stream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ObjectStoreSource reads songs from a bucket of an S3 compatible object store, using path-style URLs
+type ObjectStoreSource struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	// Timeout bounds both the wait for response headers and any stall while downloading the body
+	Timeout time.Duration
+}
+
+const defaultObjectStoreTimeout = 10 * time.Second
+
+var ErrSourceTimeout = errors.New("media source timed out")
+
+func NewObjectStoreSource(endpoint string, bucket string, region string, accessKey string, secretKey string) *ObjectStoreSource {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &ObjectStoreSource{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{},
+		Timeout:   defaultObjectStoreTimeout,
+	}
+}
+
+func (s *ObjectStoreSource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	body, err := s.get(ctx, songKey(name), "")
+	if err != nil {
+		return nil, err
+	}
+	return newSpoolReader(body)
+}
+
+// Tail fetches the last bytes of the named song with a range request
+func (s *ObjectStoreSource) Tail(ctx context.Context, name string, size int64) ([]byte, error) {
+	body, err := s.get(ctx, songKey(name), fmt.Sprintf("bytes=-%d", size))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// get requests the object with the given key, rangeHeader is sent as is if not empty
+func (s *ObjectStoreSource) get(ctx context.Context, key string, rangeHeader string) (io.ReadCloser, error) {
+	reqCtx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	if s.accessKey != "" {
+		s.sign(req, time.Now().UTC())
+	}
+
+	// The timer cancels the request whenever the store stays silent for too long
+	body := &idleTimeoutBody{timeout: s.Timeout, cancel: cancel}
+	body.timer = time.AfterFunc(s.Timeout, body.expire)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		body.Close()
+		if body.expired.Load() {
+			return nil, fmt.Errorf("%w: fetching %s", ErrSourceTimeout, key)
+		}
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		body.body = resp.Body
+		body.timer.Reset(s.Timeout)
+		return body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrSongNotFound, key)
+	}
+	resp.Body.Close()
+	body.Close()
+	return nil, fmt.Errorf("fetching %s: unexpected status %s", key, resp.Status)
+}
+
+func (s *ObjectStoreSource) objectURL(key string) string {
+	return fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, escapePath(key))
+}
+
+// escapePath escapes every segment of the key the way S3 canonical URIs require
+func escapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+	}
+	return strings.Join(segments, "/")
+}
+
+// sign adds an AWS Signature Version 4 authorization header to the given request, the payload is left unsigned
+func (s *ObjectStoreSource) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// idleTimeoutBody is a response body whose request is cancelled once no data arrives for the timeout
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired atomic.Bool
+}
+
+func (b *idleTimeoutBody) expire() {
+	b.expired.Store(true)
+	b.cancel()
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err != nil && err != io.EOF && b.expired.Load() {
+		return n, ErrSourceTimeout
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
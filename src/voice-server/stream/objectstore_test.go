@@ -0,0 +1,214 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newObjectStore serves the given objects of the bucket "songs", keyed by their path in it
+func newObjectStore(t *testing.T, objects map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, found := strings.CutPrefix(req.URL.Path, "/songs/")
+		content, exist := objects[key]
+		if !found || !exist {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, key, time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestObjectStoreSourceOpen(t *testing.T) {
+	server := newObjectStore(t, map[string]string{
+		"song.ogg":           "0123456789",
+		"artist/my song.ogg": "spaces",
+	})
+	tests := []openTest{
+		{name: "song", want: "0123456789"},
+		{name: "../song.ogg", want: "0123456789"},
+		{name: "artist/my song", want: "spaces"},
+		{name: "missing", wantErr: ErrSongNotFound},
+	}
+	testOpen(t, NewObjectStoreSource(server.URL, "songs", "", "", ""), tests)
+}
+
+func TestObjectStoreSourceSeek(t *testing.T) {
+	server := newObjectStore(t, map[string]string{"song.ogg": "0123456789"})
+	source := NewObjectStoreSource(server.URL, "songs", "", "", "")
+	media, err := source.Open(context.Background(), "song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer media.Close()
+	seeker, ok := media.(io.ReadSeeker)
+	if !ok {
+		t.Fatal("downloads should be seekable")
+	}
+	steps := []struct {
+		offset int64
+		whence int
+		read   int
+		want   string
+	}{
+		{offset: 6, whence: io.SeekStart, read: 2, want: "67"},
+		{offset: 1, whence: io.SeekStart, read: 3, want: "123"},
+		{offset: 2, whence: io.SeekCurrent, read: 5, want: "6789"},
+	}
+	for _, step := range steps {
+		if _, err := seeker.Seek(step.offset, step.whence); err != nil {
+			t.Fatalf("Seek(%d, %d) error = %v", step.offset, step.whence, err)
+		}
+		buf := make([]byte, step.read)
+		n, err := io.ReadFull(media, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != step.want {
+			t.Errorf("read %q after Seek(%d, %d), want %q", got, step.offset, step.whence, step.want)
+		}
+	}
+	if _, err := seeker.Seek(0, io.SeekEnd); !errors.Is(err, errNotSeekable) {
+		t.Errorf("Seek from the end error = %v, want %v", err, errNotSeekable)
+	}
+}
+
+func TestObjectStoreSourceSignsRequests(t *testing.T) {
+	var authorization, date string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		date = req.Header.Get("x-amz-date")
+		w.Write([]byte("song"))
+	}))
+	defer server.Close()
+	source := NewObjectStoreSource(server.URL, "songs", "eu-west-1", "access", "secret")
+	media, err := source.Open(context.Background(), "song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, media)
+	prefix := "AWS4-HMAC-SHA256 Credential=access/" + date[:8] + "/eu-west-1/s3/aws4_request, "
+	if !strings.HasPrefix(authorization, prefix) {
+		t.Errorf("Authorization = %q, want it to start with %q", authorization, prefix)
+	}
+}
+
+func TestObjectStoreSourceErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr error // nil if any error but a timeout or a missing song is expected
+	}{
+		{
+			name: "not found",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				http.NotFound(w, req)
+			},
+			wantErr: ErrSongNotFound,
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			},
+		},
+		{
+			name: "no response",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				<-req.Context().Done()
+			},
+			wantErr: ErrSourceTimeout,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+			source := NewObjectStoreSource(server.URL, "songs", "", "", "")
+			source.Timeout = 50 * time.Millisecond
+			media, err := source.Open(context.Background(), "song")
+			if err == nil {
+				media.Close()
+				t.Fatal("Open should fail")
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("Open error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr == nil && (errors.Is(err, ErrSongNotFound) || errors.Is(err, ErrSourceTimeout)) {
+				t.Errorf("Open error = %v, want an unexpected status", err)
+			}
+		})
+	}
+}
+
+func TestObjectStoreSourceStalledDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("0123"))
+		w.(http.Flusher).Flush()
+		// The rest of the song never comes
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+	source := NewObjectStoreSource(server.URL, "songs", "", "", "")
+	source.Timeout = 50 * time.Millisecond
+	media, err := source.Open(context.Background(), "song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer media.Close()
+	var read bytes.Buffer
+	_, err = io.Copy(&read, media)
+	if !errors.Is(err, ErrSourceTimeout) {
+		t.Errorf("reading a stalled download error = %v, want %v", err, ErrSourceTimeout)
+	}
+	if read.String() != "0123" {
+		t.Errorf("read %q before the download stalled, want %q", read.String(), "0123")
+	}
+}
+
+func TestObjectStoreSourceCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+	source := NewObjectStoreSource(server.URL, "songs", "", "", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := source.Open(ctx, "song"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Open with a cancelled context error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestObjectStoreSourceTail(t *testing.T) {
+	server := newObjectStore(t, map[string]string{"song.ogg": "0123456789"})
+	source := NewObjectStoreSource(server.URL, "songs", "", "", "")
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{size: 3, want: "789"},
+		{size: 10, want: "0123456789"},
+		{size: 20, want: "0123456789"},
+	}
+	for _, test := range tests {
+		tail, err := source.Tail(context.Background(), "song", test.size)
+		if err != nil {
+			t.Fatalf("Tail(%d) error = %v", test.size, err)
+		}
+		if string(tail) != test.want {
+			t.Errorf("Tail(%d) = %q, want %q", test.size, tail, test.want)
+		}
+	}
+	if _, err := source.Tail(context.Background(), "missing", 3); !errors.Is(err, ErrSongNotFound) {
+		t.Errorf("Tail of a missing song error = %v, want %v", err, ErrSongNotFound)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+This ogg.go implements a minimal Ogg Opus demuxer. Unlike pion's oggreader it splits
+pages into Opus packets, and keeps track of page offsets so a stream can be seeked.
+*/
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	oggPageHeaderLen     = 27
+	oggPageSignature     = "OggS"
+	oggFlagContinued     = 0x01
+	oggNoGranule         = ^uint64(0) // granule of a page on which no packet ends
+	opusSampleRate       = 48000
+	opusIDSignature      = "OpusHead"
+	opusCommentSignature = "OpusTags"
+)
+
+var (
+	errBadOggPage     = errors.New("invalid ogg page")
+	errNotSeekable    = errors.New("audio stream is not seekable")
+	errSeekOutOfRange = errors.New("seek position out of range")
+)
+
+// oggPage is a single page of an Ogg bitstream
+type oggPage struct {
+	offset   int64
+	flags    byte
+	granule  uint64
+	segments []byte
+	payload  []byte
+}
+
+// oggIndexEntry locates an audio page, and the granule range its completed packets cover
+type oggIndexEntry struct {
+	offset       int64
+	startGranule uint64
+	endGranule   uint64
+}
+
+// oggReader reads Opus packets out of an Ogg bitstream, and indexes audio pages as it goes
+type oggReader struct {
+	stream        io.Reader
+	offset        int64
+	packets       [][]byte // completed packets of the current page, not consumed yet
+	partial       []byte   // packet continued on the next page
+	skipContinued bool     // drop the continued packet of the next page after a seek
+	index         []oggIndexEntry
+	indexedOffset int64 // end offset of the last indexed page
+	lastGranule   uint64
+}
+
+func newOggReader(stream io.Reader) *oggReader {
+	return &oggReader{stream: stream}
+}
+
+// readPageHeader reads the fixed header and the segment table of the next page
+func readPageHeader(r io.Reader, page *oggPage) error {
+	header := make([]byte, oggPageHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte(oggPageSignature)) {
+		return errBadOggPage
+	}
+	page.flags = header[5]
+	page.granule = binary.LittleEndian.Uint64(header[6:14])
+	page.segments = make([]byte, header[26])
+	if _, err := io.ReadFull(r, page.segments); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+func (p *oggPage) payloadLen() int {
+	size := 0
+	for _, lacing := range p.segments {
+		size += int(lacing)
+	}
+	return size
+}
+
+// readPage reads the next whole page
+func (o *oggReader) readPage() (*oggPage, error) {
+	page := &oggPage{offset: o.offset}
+	if err := readPageHeader(o.stream, page); err != nil {
+		return nil, err
+	}
+	page.payload = make([]byte, page.payloadLen())
+	if _, err := io.ReadFull(o.stream, page.payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	o.offset += int64(oggPageHeaderLen + len(page.segments) + len(page.payload))
+	if page.offset >= o.indexedOffset {
+		o.indexPage(page)
+		o.indexedOffset = o.offset
+	}
+	return page, nil
+}
+
+// indexPage records the given page if any audio packet ends on it
+func (o *oggReader) indexPage(page *oggPage) {
+	// Header pages carry granule 0, and pages without a completed packet carry no granule
+	if page.granule == 0 || page.granule == oggNoGranule {
+		return
+	}
+	o.index = append(o.index, oggIndexEntry{
+		offset:       page.offset,
+		startGranule: o.lastGranule,
+		endGranule:   page.granule,
+	})
+	o.lastGranule = page.granule
+}
+
+// nextPacket returns the next complete packet, reading more pages when needed
+func (o *oggReader) nextPacket() ([]byte, error) {
+	for len(o.packets) == 0 {
+		page, err := o.readPage()
+		if err != nil {
+			return nil, err
+		}
+		o.splitPackets(page)
+	}
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+	return packet, nil
+}
+
+// splitPackets splits the page payload into packets using its lacing values
+func (o *oggReader) splitPackets(page *oggPage) {
+	if page.flags&oggFlagContinued == 0 {
+		o.partial = nil
+	}
+	dropFirst := o.skipContinued && page.flags&oggFlagContinued != 0
+	o.skipContinued = false
+
+	start, end := 0, 0
+	for _, lacing := range page.segments {
+		end += int(lacing)
+		// A lacing value of 255 means the packet goes on in the next segment
+		if lacing == 255 {
+			continue
+		}
+		packet := append(o.partial, page.payload[start:end]...)
+		o.partial = nil
+		start = end
+		if dropFirst {
+			dropFirst = false
+			continue
+		}
+		o.packets = append(o.packets, packet)
+	}
+	if dropFirst {
+		// The continued packet doesn't even end on this page, keep skipping it
+		o.skipContinued = true
+		return
+	}
+	// The last packet is continued on the next page
+	if start < end {
+		o.partial = append(o.partial, page.payload[start:end]...)
+	}
+}
+
+// seek moves the reader to the given page offset, the underlying stream must be an io.Seeker
+func (o *oggReader) seek(offset int64) error {
+	seeker, ok := o.stream.(io.Seeker)
+	if !ok {
+		return errNotSeekable
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	o.offset = offset
+	o.packets = nil
+	o.partial = nil
+	o.skipContinued = true
+	return nil
+}
+
+// seekGranule moves the reader to the audio page containing the given granule, and returns the granule that page starts at.
+// Pages which haven't been read yet are indexed on the way, the reader is left untouched if the granule is out of range.
+func (o *oggReader) seekGranule(granule uint64) (uint64, error) {
+	if n := len(o.index); n == 0 || o.index[n-1].endGranule <= granule {
+		resumeOffset, packets, partial, skipContinued := o.offset, o.packets, o.partial, o.skipContinued
+		if err := o.seek(o.indexedOffset); err != nil {
+			return 0, err
+		}
+		for n := len(o.index); n == 0 || o.index[n-1].endGranule <= granule; n = len(o.index) {
+			if _, err := o.readPage(); err != nil {
+				// Go back to where the stream was before scanning ahead
+				if seekErr := o.seek(resumeOffset); seekErr != nil {
+					return 0, seekErr
+				}
+				o.packets, o.partial, o.skipContinued = packets, partial, skipContinued
+				if errors.Is(err, io.EOF) {
+					return 0, errSeekOutOfRange
+				}
+				return 0, err
+			}
+		}
+	}
+	entry, err := seekIndex(o.index, granule)
+	if err != nil {
+		return 0, err
+	}
+	if err := o.seek(entry.offset); err != nil {
+		return 0, err
+	}
+	return entry.startGranule, nil
+}
+
+// Pages are at most 65307 bytes long, so the last complete page always lies within this tail
+const oggTailLen = 65536 + oggPageHeaderLen + 255
+
+// probeLastGranule finds the granule of the last page by scanning the tail of the stream, then rewinds it.
+// It fails on streams which can't seek from their end.
+func probeLastGranule(stream io.ReadSeeker) (uint64, error) {
+	size, err := stream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	start := size - oggTailLen
+	if start < 0 {
+		start = 0
+	}
+	if _, err := stream.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	tail, err := io.ReadAll(stream)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := stream.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return lastGranule(tail)
+}
+
+// lastGranule returns the granule of the last page found in the given tail of an Ogg bitstream
+func lastGranule(tail []byte) (uint64, error) {
+	for i := bytes.LastIndex(tail, []byte(oggPageSignature)); i >= 0; i = bytes.LastIndex(tail[:i], []byte(oggPageSignature)) {
+		if len(tail)-i < oggPageHeaderLen {
+			continue
+		}
+		granule := binary.LittleEndian.Uint64(tail[i+6 : i+14])
+		if granule != oggNoGranule {
+			return granule, nil
+		}
+	}
+	return 0, errBadOggPage
+}
+
+// seekIndex finds the indexed audio page which contains the given granule
+func seekIndex(index []oggIndexEntry, granule uint64) (oggIndexEntry, error) {
+	if len(index) == 0 || granule >= index[len(index)-1].endGranule {
+		return oggIndexEntry{}, errSeekOutOfRange
+	}
+	i := sort.Search(len(index), func(i int) bool {
+		return index[i].endGranule > granule
+	})
+	return index[i], nil
+}
+
+// isOpusHeader tells whether the packet is an identification or comment header rather than audio
+func isOpusHeader(packet []byte) bool {
+	return bytes.HasPrefix(packet, []byte(opusIDSignature)) || bytes.HasPrefix(packet, []byte(opusCommentSignature))
+}
+
+func samplesToDuration(samples uint64) time.Duration {
+	return time.Duration(samples) * time.Second / opusSampleRate
+}
+
+func durationToSamples(d time.Duration) uint64 {
+	return uint64(d * opusSampleRate / time.Second)
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
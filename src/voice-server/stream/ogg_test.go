@@ -0,0 +1,221 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Samples of each test packet, 20 ms at 48 kHz
+const testPacketSamples = 960
+
+// oggPageBytes builds an Ogg page holding the given packets, followed by the beginning of a packet
+// continued on the next page if open isn't empty. open must be a multiple of 255 bytes long.
+// Checksums are left out, the reader doesn't verify them.
+func oggPageBytes(flags byte, granule uint64, packets [][]byte, open []byte) []byte {
+	segments := []byte{}
+	payload := []byte{}
+	for _, packet := range packets {
+		for n := len(packet); ; n -= 255 {
+			if n < 255 {
+				segments = append(segments, byte(n))
+				break
+			}
+			segments = append(segments, 255)
+		}
+		payload = append(payload, packet...)
+	}
+	for n := len(open); n > 0; n -= 255 {
+		segments = append(segments, 255)
+	}
+	payload = append(payload, open...)
+	header := make([]byte, oggPageHeaderLen)
+	copy(header, oggPageSignature)
+	header[5] = flags
+	binary.LittleEndian.PutUint64(header[6:14], granule)
+	header[26] = byte(len(segments))
+	page := append(header, segments...)
+	return append(page, payload...)
+}
+
+// testOggStream returns an Ogg Opus stream of the given audio pages after the two header pages,
+// every page holding two packets named after their page and their rank in it
+func testOggStream(pages int) []byte {
+	stream := oggPageBytes(0, 0, [][]byte{[]byte("OpusHead")}, nil)
+	stream = append(stream, oggPageBytes(0, 0, [][]byte{[]byte("OpusTags")}, nil)...)
+	for i := 1; i <= pages; i++ {
+		packets := [][]byte{{byte('a' + i - 1), '1'}, {byte('a' + i - 1), '2'}}
+		stream = append(stream, oggPageBytes(0, uint64(i*2*testPacketSamples), packets, nil)...)
+	}
+	return stream
+}
+
+// expectPacket checks that the next packet read is the given one
+func expectPacket(t *testing.T, reader *oggReader, want string) {
+	t.Helper()
+	if packet, err := reader.nextPacket(); err != nil || string(packet) != want {
+		t.Fatalf("nextPacket() = %q, %v, want %q", packet, err, want)
+	}
+}
+
+func TestSeekIndex(t *testing.T) {
+	index := []oggIndexEntry{
+		{offset: 100, startGranule: 0, endGranule: 1920},
+		{offset: 200, startGranule: 1920, endGranule: 3840},
+		{offset: 300, startGranule: 3840, endGranule: 5760},
+	}
+	tests := []struct {
+		name       string
+		index      []oggIndexEntry
+		granule    uint64
+		wantOffset int64
+		wantErr    error
+	}{
+		{name: "beginning", index: index, granule: 0, wantOffset: 100},
+		{name: "within the first page", index: index, granule: 1919, wantOffset: 100},
+		{name: "page boundary", index: index, granule: 1920, wantOffset: 200},
+		{name: "within the last page", index: index, granule: 5000, wantOffset: 300},
+		{name: "last sample", index: index, granule: 5759, wantOffset: 300},
+		{name: "end", index: index, granule: 5760, wantErr: errSeekOutOfRange},
+		{name: "past the end", index: index, granule: 100000, wantErr: errSeekOutOfRange},
+		{name: "empty index", index: nil, granule: 0, wantErr: errSeekOutOfRange},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry, err := seekIndex(test.index, test.granule)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("seekIndex(%d) error = %v, want %v", test.granule, err, test.wantErr)
+			}
+			if err == nil && entry.offset != test.wantOffset {
+				t.Errorf("seekIndex(%d) = page at %d, want %d", test.granule, entry.offset, test.wantOffset)
+			}
+		})
+	}
+}
+
+func TestOggReaderSeekGranule(t *testing.T) {
+	tests := []struct {
+		name        string
+		granule     uint64
+		wantStart   uint64
+		wantPacket  string
+		wantErr     error
+		afterPacket string // next packet once the seek failed, the reader is left where it was
+	}{
+		{name: "beginning", granule: 0, wantStart: 0, wantPacket: "a1"},
+		{name: "within a page", granule: 2500, wantStart: 1920, wantPacket: "b1"},
+		{name: "page boundary", granule: 3840, wantStart: 3840, wantPacket: "c1"},
+		{name: "last page", granule: 7679, wantStart: 5760, wantPacket: "d1"},
+		{name: "end", granule: 7680, wantErr: errSeekOutOfRange, afterPacket: "a2"},
+		{name: "past the end", granule: 50000, wantErr: errSeekOutOfRange, afterPacket: "a2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := newOggReader(bytes.NewReader(testOggStream(4)))
+			// Read the headers and the first packet, later pages are indexed while seeking
+			for _, want := range []string{"OpusHead", "OpusTags", "a1"} {
+				expectPacket(t, reader, want)
+			}
+			start, err := reader.seekGranule(test.granule)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("seekGranule(%d) error = %v, want %v", test.granule, err, test.wantErr)
+			}
+			want := test.wantPacket
+			if err != nil {
+				want = test.afterPacket
+			} else if start != test.wantStart {
+				t.Errorf("seekGranule(%d) = %d, want %d", test.granule, start, test.wantStart)
+			}
+			expectPacket(t, reader, want)
+		})
+	}
+}
+
+func TestOggReaderSeekBackwards(t *testing.T) {
+	reader := newOggReader(bytes.NewReader(testOggStream(3)))
+	packets := []string{}
+	for {
+		packet, err := reader.nextPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, string(packet))
+	}
+	if len(packets) != 8 {
+		t.Fatalf("read %d packets, want 8: %q", len(packets), packets)
+	}
+	// The whole stream is indexed, seeking back needs no scan
+	start, err := reader.seekGranule(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 1920 {
+		t.Errorf("seekGranule(2000) = %d, want 1920", start)
+	}
+	expectPacket(t, reader, "b1")
+}
+
+func TestOggReaderSeekDropsContinuedPacket(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 255)
+	stream := oggPageBytes(0, 0, [][]byte{[]byte("OpusHead")}, nil)
+	stream = append(stream, oggPageBytes(0, 0, [][]byte{[]byte("OpusTags")}, nil)...)
+	stream = append(stream, oggPageBytes(0, 1920, [][]byte{[]byte("a1"), []byte("a2")}, long)...)
+	// The packet begun on the previous page ends here, it can't be decoded after a seek to this page
+	stream = append(stream, oggPageBytes(oggFlagContinued, 3840, [][]byte{[]byte("end"), []byte("b2")}, nil)...)
+
+	reader := newOggReader(bytes.NewReader(stream))
+	start, err := reader.seekGranule(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 1920 {
+		t.Errorf("seekGranule(2000) = %d, want 1920", start)
+	}
+	expectPacket(t, reader, "b2")
+}
+
+func TestOggReaderNotSeekable(t *testing.T) {
+	reader := newOggReader(io.MultiReader(bytes.NewReader(testOggStream(2))))
+	if _, err := reader.seekGranule(0); !errors.Is(err, errNotSeekable) {
+		t.Errorf("seekGranule() error = %v, want %v", err, errNotSeekable)
+	}
+}
+
+func TestLastGranule(t *testing.T) {
+	stream := testOggStream(3)
+	// The last page holds two segments of two bytes
+	lastPage := len(stream) - oggPageHeaderLen - 2 - 4
+	tests := []struct {
+		name    string
+		tail    []byte
+		want    uint64
+		wantErr error
+	}{
+		{name: "whole stream", tail: stream, want: 5760},
+		{name: "last page only", tail: stream[lastPage:], want: 5760},
+		{name: "cut in a page", tail: stream[10:], want: 5760},
+		{
+			name: "page without a completed packet",
+			tail: append(append([]byte{}, stream...), oggPageBytes(0, oggNoGranule, nil, bytes.Repeat([]byte{'x'}, 255))...),
+			want: 5760,
+		},
+		{name: "truncated header", tail: stream[lastPage : lastPage+oggPageHeaderLen-1], wantErr: errBadOggPage},
+		{name: "no page", tail: []byte("not ogg"), wantErr: errBadOggPage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			granule, err := lastGranule(test.tail)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("lastGranule() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && granule != test.want {
+				t.Errorf("lastGranule() = %d, want %d", granule, test.want)
+			}
+		})
+	}
+}
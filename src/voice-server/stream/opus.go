@@ -0,0 +1,76 @@
+/*
+This opus.go parses the header packets of an Ogg Opus stream, see RFC 7845 section 5.
+*/
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// opusHead holds the fields of the identification header the server cares about
+type opusHead struct {
+	channels   int
+	preSkip    uint64
+	outputGain int16 // Q7.8 dB
+}
+
+// opusTags holds the user comments of the comment header, keyed by upper-cased field name
+type opusTags map[string]string
+
+var (
+	errBadOpusHead = errors.New("invalid opus identification header")
+	errBadOpusTags = errors.New("invalid opus comment header")
+)
+
+func parseOpusHead(packet []byte) (*opusHead, error) {
+	if len(packet) < 19 || !bytes.HasPrefix(packet, []byte(opusIDSignature)) {
+		return nil, errBadOpusHead
+	}
+	return &opusHead{
+		channels:   int(packet[9]),
+		preSkip:    uint64(binary.LittleEndian.Uint16(packet[10:12])),
+		outputGain: int16(binary.LittleEndian.Uint16(packet[16:18])),
+	}, nil
+}
+
+func parseOpusTags(packet []byte) (opusTags, error) {
+	if !bytes.HasPrefix(packet, []byte(opusCommentSignature)) {
+		return nil, errBadOpusTags
+	}
+	data := packet[len(opusCommentSignature):]
+	// readField reads a length-prefixed string off data
+	readField := func() (string, error) {
+		if len(data) < 4 {
+			return "", errBadOpusTags
+		}
+		size := binary.LittleEndian.Uint32(data)
+		if uint64(len(data)-4) < uint64(size) {
+			return "", errBadOpusTags
+		}
+		field := string(data[4 : 4+size])
+		data = data[4+size:]
+		return field, nil
+	}
+	if _, err := readField(); err != nil { // vendor string
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, errBadOpusTags
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	tags := opusTags{}
+	for i := uint32(0); i < count; i++ {
+		comment, err := readField()
+		if err != nil {
+			return nil, err
+		}
+		if key, value, ok := strings.Cut(comment, "="); ok {
+			tags[strings.ToUpper(key)] = value
+		}
+	}
+	return tags, nil
+}
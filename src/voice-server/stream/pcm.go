@@ -0,0 +1,110 @@
+package stream
+
+import (
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// Bitrate of the audio encoded again after being processed, such as normalized or crossfaded
+const processedBitrate = 128000
+
+// nextPCM reads and decodes the next audio packet. It returns the packet along with its stereo samples,
+// trimmed of the pre-skip and scaled by the song's gain. The samples are only valid until the next call.
+func (song *Song) nextPCM() ([]byte, time.Duration, []int16, error) {
+	packet, duration, err := song.nextAudio()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	pcm, err := song.decode(packet, duration)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if song.gain != 1 {
+		for i, sample := range pcm {
+			pcm[i] = clampSample(float64(sample) * song.gain)
+		}
+	}
+	return packet, duration, pcm, nil
+}
+
+// decode decodes a packet into stereo samples trimmed of the pre-skip, and feeds them to the song's meter
+func (song *Song) decode(packet []byte, duration time.Duration) ([]int16, error) {
+	var err error
+	if song.decoder == nil {
+		if song.decoder, err = codec.NewDecoder(); err != nil {
+			return nil, err
+		}
+		song.pcm = make([]int16, codec.MaxFrameSamples*codec.Channels)
+	}
+	n, err := song.decoder.Decode(packet, song.pcm)
+	if err != nil {
+		return nil, err
+	}
+	pcm := song.pcm[trimmedSamples(n, duration)*codec.Channels : n*codec.Channels]
+	if song.meter != nil {
+		song.meter.Write(pcm)
+	}
+	return pcm, nil
+}
+
+// trimmedSamples returns how many of the n decoded samples were trimmed off by the pre-skip
+func trimmedSamples(n int, duration time.Duration) int {
+	if skipped := n - int(durationToSamples(duration)); skipped > 0 {
+		return skipped
+	}
+	return 0
+}
+
+func clampSample(sample float64) int16 {
+	if sample > 32767 {
+		return 32767
+	} else if sample < -32768 {
+		return -32768
+	}
+	return int16(sample)
+}
+
+// pcmEncoder encodes processed stereo samples into 20 ms Opus packets
+type pcmEncoder struct {
+	enc     *codec.Encoder
+	pending []int16 // samples not filling a whole frame yet
+}
+
+func newPCMEncoder() (*pcmEncoder, error) {
+	enc, err := codec.NewEncoder(processedBitrate)
+	if err != nil {
+		return nil, err
+	}
+	return &pcmEncoder{enc: enc}, nil
+}
+
+// push adds samples to encode, and returns the packets of every whole frame
+func (e *pcmEncoder) push(pcm []int16) ([]media.Sample, error) {
+	e.pending = append(e.pending, pcm...)
+	samples := []media.Sample{}
+	frameLen := codec.FrameSamples * codec.Channels
+	for len(e.pending) >= frameLen {
+		packet, err := e.enc.Encode(e.pending[:frameLen])
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, media.Sample{Data: packet, Duration: samplesToDuration(codec.FrameSamples)})
+		e.pending = e.pending[frameLen:]
+	}
+	return samples, nil
+}
+
+// missing returns how many samples per channel are needed to complete the pending frame
+func (e *pcmEncoder) missing() int {
+	if len(e.pending) == 0 {
+		return 0
+	}
+	return codec.FrameSamples - len(e.pending)/codec.Channels
+}
+
+// flush completes the pending frame with silence and encodes it
+func (e *pcmEncoder) flush() ([]media.Sample, error) {
+	return e.push(make([]int16, e.missing()*codec.Channels))
+}
@@ -0,0 +1,219 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/codec"
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/loudness"
+)
+
+// Song is a song opened for streaming, along with the metadata parsed from its headers
+type Song struct {
+	Music       *Music
+	audio       string  // name of the audio in the source, differs from the song's for UltraStar files
+	Lyrics      *Lyrics // nil if the song has no lyrics
+	Melody      *Melody // reference melody to score singers, nil if the song has none
+	media       io.ReadCloser
+	ogg         *oggReader
+	preSkip     uint64
+	lastGranule uint64          // 0 if the end of the song couldn't be probed
+	skip        uint64          // pre-skip samples still to be dropped
+	position    time.Duration   // playback position of the audio read so far
+	loudness    *songLoudness   // nil if unknown
+	meter       *loudness.Meter // measures the song while it plays if its loudness is unknown, nil otherwise
+	gain        float64         // linear gain applied to the decoded samples
+	decoder     *codec.Decoder
+	pcm         []int16
+	leftover    []int16 // samples decoded by a crossfade but not played yet
+}
+
+// tailFetcher is implemented by sources that can fetch the end of a song without downloading all of it
+type tailFetcher interface {
+	Tail(ctx context.Context, name string, size int64) ([]byte, error)
+}
+
+// Load opens the named song and reads its metadata, so it is known before the song is played.
+// The song may be an UltraStar file, its audio is then read from the file it points at.
+func (hub *AudioHub) Load(ctx context.Context, name string) (*Song, error) {
+	audio := name
+	var karaoke *UltraStar
+	if isUltraStar(name) {
+		var err error
+		if karaoke, err = hub.loadUltraStar(ctx, name); err != nil {
+			return nil, err
+		}
+		if karaoke == nil {
+			return nil, ErrSongNotFound
+		}
+		if karaoke.Audio == "" {
+			return nil, fmt.Errorf("%w: no #MP3 or #AUDIO tag", ErrInvalidUltraStar)
+		}
+		audio = path.Join(path.Dir(songKey(name)), karaoke.Audio)
+	}
+	media, err := hub.source.Open(ctx, audio)
+	if err != nil {
+		return nil, err
+	}
+	song := &Song{
+		Music: &Music{SongName: name},
+		audio: audio,
+		media: media,
+		ogg:   newOggReader(media),
+		gain:  1,
+	}
+	// The total duration is given by the granule of the last page
+	if seeker, ok := media.(io.ReadSeeker); ok {
+		granule, err := probeLastGranule(seeker)
+		if err != nil && !errors.Is(err, errNotSeekable) {
+			media.Close()
+			return nil, err
+		}
+		song.lastGranule = granule
+	}
+	if err := song.readHeaders(); err != nil {
+		media.Close()
+		return nil, err
+	}
+	// Sources streaming over the network may still fetch the end of the song on its own
+	if fetcher, ok := hub.source.(tailFetcher); ok && song.lastGranule == 0 {
+		if tail, err := fetcher.Tail(ctx, audio, oggTailLen); err == nil {
+			song.lastGranule, _ = lastGranule(tail)
+		}
+	}
+	song.Music.Duration = int(math.Round(song.Duration().Seconds()))
+	hub.normalize(song)
+
+	// An UltraStar file lying next to the song gives its lyrics and melody
+	if karaoke == nil {
+		if karaoke, err = hub.loadUltraStar(ctx, ultraStarKey(name)); err != nil {
+			log.Printf("room %s: fail to load UltraStar file of %s: %v\n", hub.roomName, name, err)
+		}
+	}
+	if karaoke != nil {
+		song.setKaraoke(karaoke)
+		return song, nil
+	}
+	// Lyrics are optional, a song still plays if they can't be read
+	if song.Lyrics, err = hub.loadLyrics(ctx, name); err != nil {
+		log.Printf("room %s: fail to load lyrics of %s: %v\n", hub.roomName, name, err)
+	}
+	if song.Melody, err = hub.loadMelody(ctx, name); err != nil {
+		log.Printf("room %s: fail to load melody of %s: %v\n", hub.roomName, name, err)
+	}
+	return song, nil
+}
+
+// setKaraoke takes the lyrics, the melody and the metadata of the song from its UltraStar file
+func (song *Song) setKaraoke(karaoke *UltraStar) {
+	song.Lyrics = karaoke.Lyrics
+	song.Melody = karaoke.Melody
+	song.Music.Karaoke = karaoke.Karaoke
+	// Tags of the audio take precedence
+	if song.Music.Title == "" {
+		song.Music.Title = karaoke.Title
+	}
+	if song.Music.Artist == "" {
+		song.Music.Artist = karaoke.Artist
+	}
+}
+
+// readHeaders parses the identification and comment headers at the beginning of the song
+func (song *Song) readHeaders() error {
+	packet, err := song.ogg.nextPacket()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	head, err := parseOpusHead(packet)
+	if err != nil {
+		return err
+	}
+	packet, err = song.ogg.nextPacket()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	tags, err := parseOpusTags(packet)
+	if err != nil {
+		return err
+	}
+	song.preSkip = head.preSkip
+	song.skip = head.preSkip
+	song.Music.Channels = head.channels
+	song.Music.PreSkip = int(head.preSkip)
+	song.Music.Title = tags["TITLE"]
+	song.Music.Artist = tags["ARTIST"]
+	song.Music.Album = tags["ALBUM"]
+	song.loudness = loudnessFromTags(tags)
+	return nil
+}
+
+// Duration returns the playable duration of the song, or 0 if it is unknown
+func (song *Song) Duration() time.Duration {
+	return song.granuleToPosition(song.lastGranule)
+}
+
+// granuleToPosition converts a granule to a playback position, the first preSkip samples are never played
+func (song *Song) granuleToPosition(granule uint64) time.Duration {
+	if granule <= song.preSkip {
+		return 0
+	}
+	return samplesToDuration(granule - song.preSkip)
+}
+
+func (song *Song) positionToGranule(pos time.Duration) uint64 {
+	return durationToSamples(pos) + song.preSkip
+}
+
+// nextAudio reads the next audio packet, and returns it along with the duration it adds to the playback.
+// Samples of the pre-skip are discarded by decoders, so they don't count towards the duration.
+func (song *Song) nextAudio() ([]byte, time.Duration, error) {
+	for {
+		packet, err := song.ogg.nextPacket()
+		if err != nil {
+			return nil, 0, err
+		}
+		if isOpusHeader(packet) {
+			continue
+		}
+		samples, err := codec.PacketSamples(packet)
+		if err != nil {
+			return nil, 0, err
+		}
+		if song.skip >= samples {
+			// The whole packet lies within the pre-skip
+			song.skip -= samples
+			continue
+		}
+		samples -= song.skip
+		song.skip = 0
+		duration := samplesToDuration(samples)
+		song.position += duration
+		return packet, duration, nil
+	}
+}
+
+// seek moves the song to the page containing the given position
+func (song *Song) seek(pos time.Duration) error {
+	granule, err := song.ogg.seekGranule(song.positionToGranule(pos))
+	if err != nil {
+		return err
+	}
+	song.skip = 0
+	if granule < song.preSkip {
+		song.skip = song.preSkip - granule
+	}
+	song.position = song.granuleToPosition(granule)
+	// Part of the song is skipped or heard twice, so the measurement is given up
+	song.meter = nil
+	return nil
+}
+
+func (song *Song) Close() error {
+	return song.media.Close()
+}
@@ -0,0 +1,129 @@
+/*
+This source.go defines where the audio of songs comes from. A hub reads songs through a
+MediaSource, so the same streaming loop serves local files, an object store or memory.
+*/
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/transcode"
+)
+
+// MediaSource opens songs by name
+type MediaSource interface {
+	// Open returns a stream of the named song from its beginning. The stream is seekable if it implements io.Seeker.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+var ErrSongNotFound = errors.New("song not found")
+
+// songKey normalizes a song name into a relative key which can never escape the source root
+func songKey(name string) string {
+	key := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if path.Ext(key) == "" {
+		key += ".ogg"
+	}
+	return key
+}
+
+// SourceFromEnv creates the media source configured by MEDIA_SOURCE, songs are read from MEDIA_DIR by default.
+// Songs which aren't Ogg Opus are transcoded when read.
+func SourceFromEnv() (MediaSource, error) {
+	source, err := baseSourceFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	transcoder, err := transcode.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewTranscodingSource(source, transcoder), nil
+}
+
+func baseSourceFromEnv() (MediaSource, error) {
+	switch os.Getenv("MEDIA_SOURCE") {
+	case "", "local":
+		return NewLocalSource(os.Getenv("MEDIA_DIR")), nil
+	case "s3":
+		source := NewObjectStoreSource(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_REGION"),
+			os.Getenv("AWS_ACCESS_KEY_ID"),
+			os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		)
+		if timeout, err := time.ParseDuration(os.Getenv("S3_TIMEOUT")); err == nil {
+			source.Timeout = timeout
+		}
+		return source, nil
+	}
+	return nil, fmt.Errorf("unknown media source %q", os.Getenv("MEDIA_SOURCE"))
+}
+
+// LocalSource reads songs from a local directory, such as the mounted S3 bucket
+type LocalSource struct {
+	dir string
+}
+
+func NewLocalSource(dir string) *LocalSource {
+	return &LocalSource{dir: dir}
+}
+
+func (s *LocalSource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(songKey(name))))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSongNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// MemorySource serves songs kept in memory, it is meant for tests
+type MemorySource struct {
+	songs map[string][]byte
+	lock  sync.RWMutex
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{
+		songs: make(map[string][]byte),
+	}
+}
+
+// Put stores the audio of the named song
+func (s *MemorySource) Put(name string, data []byte) {
+	s.lock.Lock()
+	s.songs[songKey(name)] = data
+	s.lock.Unlock()
+}
+
+func (s *MemorySource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.lock.RLock()
+	data, exist := s.songs[songKey(name)]
+	s.lock.RUnlock()
+	if !exist {
+		return nil, fmt.Errorf("%w: %s", ErrSongNotFound, name)
+	}
+	return &memoryMedia{bytes.NewReader(data)}, nil
+}
+
+type memoryMedia struct {
+	*bytes.Reader
+}
+
+func (m *memoryMedia) Close() error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSongKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"song", "song.ogg"},
+		{"song.ogg", "song.ogg"},
+		{"artist/song.mp3", "artist/song.mp3"},
+		{"/song", "song.ogg"},
+		{"../song", "song.ogg"},
+		{"../../etc/passwd", "etc/passwd.ogg"},
+		{"artist/../../song", "song.ogg"},
+		{"artist/./song", "artist/song.ogg"},
+	}
+	for _, test := range tests {
+		if got := songKey(test.name); got != test.want {
+			t.Errorf("songKey(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLocalSource(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "media")
+	writeFile(t, filepath.Join(root, "song.ogg"), "song")
+	writeFile(t, filepath.Join(root, "artist", "other.ogg"), "other")
+	// Lies next to the root, it must never be served
+	writeFile(t, filepath.Join(dir, "secret.ogg"), "secret")
+
+	tests := []openTest{
+		{name: "song", want: "song"},
+		{name: "song.ogg", want: "song"},
+		{name: "/song", want: "song"},
+		{name: "artist/other", want: "other"},
+		{name: "artist/../song", want: "song"},
+		{name: "missing", wantErr: ErrSongNotFound},
+		{name: "../secret", wantErr: ErrSongNotFound},
+		{name: "artist/../../secret", wantErr: ErrSongNotFound},
+		{name: "../media/../secret.ogg", wantErr: ErrSongNotFound},
+	}
+	testOpen(t, NewLocalSource(root), tests)
+}
+
+func TestMemorySource(t *testing.T) {
+	source := NewMemorySource()
+	source.Put("song", []byte("song"))
+	source.Put("artist/other.ogg", []byte("other"))
+
+	tests := []openTest{
+		{name: "song", want: "song"},
+		{name: "song.ogg", want: "song"},
+		{name: "../song", want: "song"},
+		{name: "artist/other", want: "other"},
+		{name: "other", wantErr: ErrSongNotFound},
+		{name: "missing", wantErr: ErrSongNotFound},
+	}
+	testOpen(t, source, tests)
+}
+
+func TestMemorySourceSeek(t *testing.T) {
+	source := NewMemorySource()
+	source.Put("song", []byte("0123456789"))
+	media, err := source.Open(context.Background(), "song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer media.Close()
+	seeker, ok := media.(io.ReadSeeker)
+	if !ok {
+		t.Fatal("songs in memory should be seekable")
+	}
+	if _, err := seeker.Seek(-3, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, media); got != "789" {
+		t.Errorf("read %q after seeking to the end, want %q", got, "789")
+	}
+	// Every song opened reads from its beginning
+	again, err := source.Open(context.Background(), "song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, again); got != "0123456789" {
+		t.Errorf("read %q from a song opened again, want it whole", got)
+	}
+}
+
+// openTest is a song opened from a source, along with what is read from it
+type openTest struct {
+	name    string
+	want    string
+	wantErr error
+}
+
+// testOpen opens the song of every test from the source, and checks what is read from it
+func testOpen(t *testing.T, source MediaSource, tests []openTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			media, err := source.Open(context.Background(), test.name)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("Open(%q) error = %v, want %v", test.name, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open(%q) error = %v", test.name, err)
+			}
+			if got := readAll(t, media); got != test.want {
+				t.Errorf("Open(%q) read %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(t *testing.T, media io.ReadCloser) string {
+	t.Helper()
+	defer media.Close()
+	data, err := io.ReadAll(media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
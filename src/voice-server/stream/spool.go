@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"io"
+	"os"
+)
+
+const spoolChunkSize = 32 * 1024
+
+// spoolReader makes a download seekable while it is still in progress. Everything read from the
+// source is kept in a temporary file, so the reader can go back to any downloaded offset, and
+// seeking ahead downloads up to the target offset.
+type spoolReader struct {
+	src  io.ReadCloser
+	file *os.File
+	size int64 // bytes downloaded so far
+	pos  int64
+	eof  bool
+}
+
+func newSpoolReader(src io.ReadCloser) (*spoolReader, error) {
+	file, err := os.CreateTemp("", "singsphere-*.spool")
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return &spoolReader{src: src, file: file}, nil
+}
+
+func (s *spoolReader) Read(p []byte) (int, error) {
+	if s.pos < s.size {
+		if remain := s.size - s.pos; int64(len(p)) > remain {
+			p = p[:remain]
+		}
+		n, err := s.file.ReadAt(p, s.pos)
+		s.pos += int64(n)
+		if err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+	if s.eof {
+		return 0, io.EOF
+	}
+	n, err := s.src.Read(p)
+	if n > 0 {
+		if _, writeErr := s.file.WriteAt(p[:n], s.size); writeErr != nil {
+			return 0, writeErr
+		}
+		s.size += int64(n)
+		s.pos = s.size
+	}
+	if err == io.EOF {
+		s.eof = true
+		if n > 0 {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// Seek supports io.SeekStart and io.SeekCurrent only, the size of the download isn't known until it completes
+func (s *spoolReader) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = s.pos + offset
+	default:
+		return 0, errNotSeekable
+	}
+	if target < 0 {
+		return 0, errSeekOutOfRange
+	}
+	buf := make([]byte, spoolChunkSize)
+	for s.size < target && !s.eof {
+		s.pos = s.size
+		if _, err := s.Read(buf); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	s.pos = target
+	return target, nil
+}
+
+func (s *spoolReader) Close() error {
+	s.src.Close()
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
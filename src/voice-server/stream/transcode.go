@@ -0,0 +1,47 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/transcode"
+)
+
+// TranscodingSource serves songs of other formats than Ogg Opus by converting them on the fly
+type TranscodingSource struct {
+	source     MediaSource
+	transcoder *transcode.Transcoder
+}
+
+func NewTranscodingSource(source MediaSource, transcoder *transcode.Transcoder) *TranscodingSource {
+	return &TranscodingSource{
+		source:     source,
+		transcoder: transcoder,
+	}
+}
+
+func (s *TranscodingSource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !transcode.Supported(songKey(name)) {
+		return s.source.Open(ctx, name)
+	}
+	input, err := s.source.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	path, err := s.transcoder.Transcode(ctx, songKey(name), input)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Tail fetches the end of songs passed through as is, converted songs are probed once they are on disk
+func (s *TranscodingSource) Tail(ctx context.Context, name string, size int64) ([]byte, error) {
+	fetcher, ok := s.source.(tailFetcher)
+	if !ok || transcode.Supported(songKey(name)) {
+		return nil, errNotSeekable
+	}
+	return fetcher.Tail(ctx, name, size)
+}
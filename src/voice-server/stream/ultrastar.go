@@ -0,0 +1,234 @@
+/*
+This ultrastar.go parses karaoke songs in the UltraStar .txt format. A header of #TAG:value lines gives the
+tempo and the audio file, then each note is a line "<kind> <beat> <length> <pitch> <syllable>" where pitch 0
+is the middle C. "-" lines break lyric lines, and duets split their notes into "P1" and "P2" parts.
+The same file then drives the lyrics, the melody used for scoring and the parts of duets.
+*/
+package stream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Karaoke is the metadata of a song read from its UltraStar file
+type Karaoke struct {
+	BPM      float64  `json:"bpm"`
+	Gap      float64  `json:"gap"` // seconds before the first beat
+	Language string   `json:"language,omitempty"`
+	Genre    string   `json:"genre,omitempty"`
+	Year     int      `json:"year,omitempty"`
+	Parts    []string `json:"parts,omitempty"` // names of the parts of a duet, nil if it isn't one
+}
+
+// UltraStar is a parsed UltraStar song
+type UltraStar struct {
+	Title   string
+	Artist  string
+	Audio   string // audio file, relative to the UltraStar file
+	Karaoke *Karaoke
+	Lyrics  *Lyrics
+	Melody  *Melody
+}
+
+// Kinds of UltraStar notes, by their leading character
+var ultraStarKinds = map[string]string{
+	":": "",
+	"*": NoteGolden,
+	"F": NoteFreestyle,
+	"R": NoteRap,
+	"G": NoteGoldenRap,
+}
+
+var ErrInvalidUltraStar = errors.New("invalid UltraStar song")
+
+// ParseUltraStar parses an UltraStar song, unknown tags are ignored
+func ParseUltraStar(r io.Reader) (*UltraStar, error) {
+	song := &UltraStar{
+		Karaoke: &Karaoke{},
+		Lyrics:  &Lyrics{Lines: []*LyricLine{}},
+		Melody:  &Melody{Notes: []*MelodyNote{}},
+	}
+	parts := map[int]string{}
+	relative := false
+	beatOffset := 0 // beats of the lines before, in relative files
+	part := 0
+	var line *LyricLine
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if number == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "#") {
+			tag, value, _ := strings.Cut(text[1:], ":")
+			value = strings.TrimSpace(value)
+			switch strings.ToUpper(strings.TrimSpace(tag)) {
+			case "TITLE":
+				song.Title = value
+			case "ARTIST":
+				song.Artist = value
+			case "MP3", "AUDIO":
+				song.Audio = value
+			case "BPM":
+				song.Karaoke.BPM, _ = parseUltraStarFloat(value)
+			case "GAP":
+				gap, _ := parseUltraStarFloat(value)
+				song.Karaoke.Gap = gap / 1000
+			case "LANGUAGE":
+				song.Karaoke.Language = value
+			case "GENRE":
+				song.Karaoke.Genre = value
+			case "YEAR":
+				song.Karaoke.Year, _ = strconv.Atoi(value)
+			case "RELATIVE":
+				relative = strings.EqualFold(value, "yes")
+			case "P1", "DUETSINGERP1":
+				parts[1] = value
+			case "P2", "DUETSINGERP2":
+				parts[2] = value
+			}
+			continue
+		}
+		if song.Karaoke.BPM <= 0 {
+			return nil, fmt.Errorf("%w: line %d: notes before a valid #BPM", ErrInvalidUltraStar, number)
+		}
+		fields := strings.Fields(text)
+		switch kind := fields[0]; {
+		case kind == "E":
+			return song.finish(parts)
+		case kind == "P1" || kind == "P2" || kind == "P3":
+			// P3 is sung by both singers
+			part, _ = strconv.Atoi(kind[1:])
+			if part == 3 {
+				part = 0
+			}
+			line = nil
+		case kind == "-":
+			line = nil
+			if relative && len(fields) > 1 {
+				// Relative files count the beats of a line from where the previous break says
+				shift, err := strconv.Atoi(fields[len(fields)-1])
+				if err != nil {
+					return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidUltraStar, number, err)
+				}
+				beatOffset += shift
+			}
+		default:
+			noteKind, known := ultraStarKinds[kind]
+			if !known || len(fields) < 4 {
+				continue
+			}
+			var numbers [3]int
+			for i := range numbers {
+				n, err := strconv.Atoi(fields[i+1])
+				if err != nil {
+					return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidUltraStar, number, err)
+				}
+				numbers[i] = n
+			}
+			beat, length, pitch := beatOffset+numbers[0], numbers[1], numbers[2]
+			syllable := ultraStarSyllable(text, fields[:4])
+			at, duration := song.beatTime(beat), song.beatTime(beat+length)-song.beatTime(beat)
+			if line == nil {
+				line = &LyricLine{Time: at, Part: part}
+				song.Lyrics.Lines = append(song.Lyrics.Lines, line)
+			}
+			line.Text += syllable
+			line.Words = append(line.Words, &LyricWord{Time: at, Duration: duration, Text: syllable})
+			song.Melody.Notes = append(song.Melody.Notes, &MelodyNote{
+				Time:     at,
+				Duration: duration,
+				Pitch:    float64(60 + pitch),
+				Text:     syllable,
+				Kind:     noteKind,
+				Part:     part,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// Many files lack the final E
+	return song.finish(parts)
+}
+
+// beatTime returns the position of a beat in seconds. UltraStar beats are quarters of the #BPM beats.
+func (song *UltraStar) beatTime(beat int) float64 {
+	return song.Karaoke.Gap + float64(beat)*60/(song.Karaoke.BPM*4)
+}
+
+// finish sorts what was parsed, lines of both parts of duets are interleaved
+func (song *UltraStar) finish(parts map[int]string) (*UltraStar, error) {
+	if len(song.Melody.Notes) == 0 {
+		return nil, fmt.Errorf("%w: no notes", ErrInvalidUltraStar)
+	}
+	duet := false
+	for _, note := range song.Melody.Notes {
+		duet = duet || note.Part > 1
+	}
+	if duet {
+		song.Karaoke.Parts = []string{parts[1], parts[2]}
+	}
+	song.Lyrics.Title, song.Lyrics.Artist = song.Title, song.Artist
+	sortLyricLines(song.Lyrics)
+	sortMelody(song.Melody)
+	return song, nil
+}
+
+// ultraStarSyllable returns the syllable of a note line, after its first four fields.
+// Its spaces are kept since they separate the words.
+func ultraStarSyllable(text string, fields []string) string {
+	rest := text
+	for _, field := range fields {
+		rest = strings.TrimLeft(rest, " \t")
+		rest = rest[len(field):]
+	}
+	// A single space separates the syllable from the pitch
+	if strings.HasPrefix(rest, " ") || strings.HasPrefix(rest, "\t") {
+		rest = rest[1:]
+	}
+	// A tilde continues the previous syllable on another note
+	if rest == "~" {
+		return ""
+	}
+	return rest
+}
+
+func parseUltraStarFloat(value string) (float64, error) {
+	// Some editors write decimal commas
+	return strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+}
+
+// ultraStarKey returns the name of the UltraStar file lying next to the given song
+func ultraStarKey(name string) string {
+	key := songKey(name)
+	return strings.TrimSuffix(key, path.Ext(key)) + ".txt"
+}
+
+// isUltraStar tells whether the named song is an UltraStar file pointing at its audio
+func isUltraStar(name string) bool {
+	return strings.EqualFold(path.Ext(songKey(name)), ".txt")
+}
+
+// loadUltraStar reads the named UltraStar file, it returns nil if there is none
+func (hub *AudioHub) loadUltraStar(ctx context.Context, name string) (*UltraStar, error) {
+	file, err := hub.source.Open(ctx, name)
+	if errors.Is(err, ErrSongNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseUltraStar(file)
+}
@@ -0,0 +1,210 @@
+package stream
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// At 240 BPM, UltraStar beats last 1/16 s
+const testUltraStarHeader = "#TITLE:Song\n#ARTIST:Artist\n#MP3:song.ogg\n#BPM:240\n#GAP:500\n"
+
+func notesOf(melody *Melody) []MelodyNote {
+	notes := []MelodyNote{}
+	for _, note := range melody.Notes {
+		notes = append(notes, *note)
+	}
+	return notes
+}
+
+func TestParseUltraStarHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    Karaoke
+		wantAll [3]string // title, artist and audio
+	}{
+		{
+			name:    "tags",
+			header:  testUltraStarHeader + "#LANGUAGE:English\n#GENRE:Pop\n#YEAR:1999\n#EDITION:ignored\n",
+			want:    Karaoke{BPM: 240, Gap: 0.5, Language: "English", Genre: "Pop", Year: 1999},
+			wantAll: [3]string{"Song", "Artist", "song.ogg"},
+		},
+		{
+			name:    "decimal commas and spaces",
+			header:  "\ufeff#TITLE: Song \r\n#AUDIO:other.ogg\r\n#BPM: 120,5\r\n#GAP:1250,5\r\n",
+			want:    Karaoke{BPM: 120.5, Gap: 1.2505},
+			wantAll: [3]string{"Song", "", "other.ogg"},
+		},
+		{
+			name:   "no gap",
+			header: "#bpm:300\n",
+			want:   Karaoke{BPM: 300},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			song, err := ParseUltraStar(strings.NewReader(test.header + ": 0 4 0 la\nE\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*song.Karaoke, test.want) {
+				t.Errorf("karaoke = %+v, want %+v", *song.Karaoke, test.want)
+			}
+			if got := [3]string{song.Title, song.Artist, song.Audio}; got != test.wantAll {
+				t.Errorf("title, artist and audio = %q, want %q", got, test.wantAll)
+			}
+		})
+	}
+}
+
+func TestParseUltraStarNotes(t *testing.T) {
+	song, err := ParseUltraStar(strings.NewReader(testUltraStarHeader + strings.Join([]string{
+		": 0 4 0 Hel",
+		": 4 4 2 lo",
+		": 8 2 2 ~",
+		"- 12",
+		"* 16 8 7  world",
+		"F 24 4 0 hey",
+		"R 28 2 0 yo",
+		"G 32 2 0 !",
+		"E",
+		": 40 4 0 ignored",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantNotes := []MelodyNote{
+		{Time: 0.5, Duration: 0.25, Pitch: 60, Text: "Hel"},
+		{Time: 0.75, Duration: 0.25, Pitch: 62, Text: "lo"},
+		{Time: 1, Duration: 0.125, Pitch: 62, Text: ""},
+		{Time: 1.5, Duration: 0.5, Pitch: 67, Text: " world", Kind: NoteGolden},
+		{Time: 2, Duration: 0.25, Pitch: 60, Text: "hey", Kind: NoteFreestyle},
+		{Time: 2.25, Duration: 0.125, Pitch: 60, Text: "yo", Kind: NoteRap},
+		{Time: 2.5, Duration: 0.125, Pitch: 60, Text: "!", Kind: NoteGoldenRap},
+	}
+	if got := notesOf(song.Melody); !reflect.DeepEqual(got, wantNotes) {
+		t.Errorf("notes = %+v, want %+v", got, wantNotes)
+	}
+	wantPitched := []bool{true, true, true, true, false, false, false}
+	for i, note := range song.Melody.Notes {
+		if note.Pitched() != wantPitched[i] {
+			t.Errorf("note %d pitched = %v, want %v", i, note.Pitched(), wantPitched[i])
+		}
+	}
+	wantLines := []testLine{
+		{time: 0.5, text: "Hello", words: []LyricWord{
+			{Time: 0.5, Duration: 0.25, Text: "Hel"},
+			{Time: 0.75, Duration: 0.25, Text: "lo"},
+			{Time: 1, Duration: 0.125, Text: ""},
+		}},
+		{time: 1.5, text: " worldheyyo!", words: []LyricWord{
+			{Time: 1.5, Duration: 0.5, Text: " world"},
+			{Time: 2, Duration: 0.25, Text: "hey"},
+			{Time: 2.25, Duration: 0.125, Text: "yo"},
+			{Time: 2.5, Duration: 0.125, Text: "!"},
+		}},
+	}
+	if got := linesOf(song.Lyrics); !reflect.DeepEqual(got, wantLines) {
+		t.Errorf("lines = %+v, want %+v", got, wantLines)
+	}
+	if song.Lyrics.Title != "Song" || song.Lyrics.Artist != "Artist" {
+		t.Errorf("lyrics of %q by %q, want the song's title and artist", song.Lyrics.Title, song.Lyrics.Artist)
+	}
+	if song.Karaoke.Parts != nil {
+		t.Errorf("parts = %q, want none for a solo song", song.Karaoke.Parts)
+	}
+}
+
+func TestParseUltraStarRelative(t *testing.T) {
+	song, err := ParseUltraStar(strings.NewReader(testUltraStarHeader + "#RELATIVE:yes\n" + strings.Join([]string{
+		": 0 4 0 one",
+		"- 8 8",
+		": 0 4 0 two",
+		"- 6 4",
+		": 2 4 0 three",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTimes := []float64{0.5, 1, 1.375}
+	for i, note := range song.Melody.Notes {
+		if note.Time != wantTimes[i] {
+			t.Errorf("note %q at %v, want %v", note.Text, note.Time, wantTimes[i])
+		}
+	}
+}
+
+func TestParseUltraStarDuet(t *testing.T) {
+	song, err := ParseUltraStar(strings.NewReader(testUltraStarHeader + "#P1:Alice\n#DUETSINGERP2:Bob\n" + strings.Join([]string{
+		"P1",
+		": 0 4 0 first",
+		"- 8",
+		": 16 4 0 third",
+		"P2",
+		": 8 4 3 second",
+		"- 12",
+		"* 24 4 3 fourth",
+		"P3",
+		": 32 4 5 both",
+		"E",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Alice", "Bob"}; !reflect.DeepEqual(song.Karaoke.Parts, want) {
+		t.Errorf("parts = %q, want %q", song.Karaoke.Parts, want)
+	}
+	// Lines of both parts are interleaved by time
+	wantLines := []struct {
+		text string
+		part int
+	}{
+		{"first", 1},
+		{"second", 2},
+		{"third", 1},
+		{"fourth", 2},
+		{"both", 0},
+	}
+	if len(song.Lyrics.Lines) != len(wantLines) {
+		t.Fatalf("got %d lines, want %d", len(song.Lyrics.Lines), len(wantLines))
+	}
+	for i, want := range wantLines {
+		line := song.Lyrics.Lines[i]
+		if line.Text != want.text || line.Part != want.part || line.Index != i {
+			t.Errorf("line %d = %q of part %d at index %d, want %q of part %d", i, line.Text, line.Part, line.Index, want.text, want.part)
+		}
+	}
+	wantParts := []int{1, 2, 1, 2, 0}
+	for i, note := range song.Melody.Notes {
+		if note.Part != wantParts[i] {
+			t.Errorf("note %q of part %d, want %d", note.Text, note.Part, wantParts[i])
+		}
+	}
+	if golden := song.Melody.Notes[3]; golden.Kind != NoteGolden {
+		t.Errorf("note %q kind = %q, want %q", golden.Text, golden.Kind, NoteGolden)
+	}
+}
+
+func TestParseUltraStarErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		txt  string
+	}{
+		{name: "notes before the tempo", txt: "#TITLE:Song\n: 0 4 0 la\n#BPM:240\n"},
+		{name: "zero tempo", txt: "#BPM:0\n: 0 4 0 la\n"},
+		{name: "no notes", txt: testUltraStarHeader + "E\n"},
+		{name: "only unknown lines", txt: testUltraStarHeader + "X 0 4 0 la\n: 0 4\n"},
+		{name: "bad beat", txt: testUltraStarHeader + ": zero 4 0 la\n"},
+		{name: "bad pitch", txt: testUltraStarHeader + ": 0 4 high la\n"},
+		{name: "bad relative break", txt: testUltraStarHeader + "#RELATIVE:yes\n: 0 4 0 la\n- 8 later\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseUltraStar(strings.NewReader(test.txt)); !errors.Is(err, ErrInvalidUltraStar) {
+				t.Errorf("ParseUltraStar() error = %v, want %v", err, ErrInvalidUltraStar)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
+)
+
+const (
+	maxNameLength   = 32 // characters
+	maxEmojiLength  = 8  // code points, enough for the longest emoji sequences
+	maxAvatarLength = 2048
+)
+
+var (
+	ErrInvalidName   = fmt.Errorf("names may be up to %d printable characters", maxNameLength)
+	ErrInvalidEmoji  = errors.New("invalid emoji")
+	ErrInvalidAvatar = errors.New("avatars must be http or https URLs")
+	ErrInvalidColor  = errors.New(`colors must be like "#ff8800"`)
+)
+
+var colorPattern = regexp.MustCompile(`^#([0-9a-f]{3}|[0-9a-f]{6})$`)
+
+// Profile is how a user shows up in their room
+type Profile struct {
+	Name   string // display name, may be empty
+	Emoji  string
+	Avatar string // URL of a picture, may be empty
+	Color  string // preferred color as "#rrggbb" or "#rgb", may be empty
+}
+
+// normalize trims the fields of the profile and checks them
+func (p *Profile) normalize() error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Emoji = strings.TrimSpace(p.Emoji)
+	p.Avatar = strings.TrimSpace(p.Avatar)
+	p.Color = strings.ToLower(strings.TrimSpace(p.Color))
+	if !validName(p.Name) {
+		return ErrInvalidName
+	}
+	if !validEmoji(p.Emoji) {
+		return ErrInvalidEmoji
+	}
+	if p.Avatar != "" && !validAvatar(p.Avatar) {
+		return ErrInvalidAvatar
+	}
+	if p.Color != "" && !colorPattern.MatchString(p.Color) {
+		return ErrInvalidColor
+	}
+	return nil
+}
+
+func validName(name string) bool {
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxNameLength {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validEmoji tells whether the given string is a single emoji, possibly a sequence joining several
+func validEmoji(emoji string) bool {
+	if emoji == "" || !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > maxEmojiLength {
+		return false
+	}
+	symbol := false
+	for _, r := range emoji {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		case unicode.Is(unicode.Sk, r), r == '\u200d', r == '\ufe0f':
+			// Skin tones, joiners and the emoji presentation selector
+		default:
+			return false
+		}
+	}
+	return symbol
+}
+
+func validAvatar(avatar string) bool {
+	if len(avatar) > maxAvatarLength {
+		return false
+	}
+	u, err := url.Parse(avatar)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// profileOf returns the profile of a new user, filled in with the claims of their token.
+// Invalid claims are ignored rather than turning the user away, and users without an emoji get a random one.
+func profileOf(identity *auth.Identity) Profile {
+	profile := Profile{Emoji: randomEmoji()}
+	claims := []func(p *Profile){
+		func(p *Profile) { p.Name = identity.Name },
+		func(p *Profile) { p.Emoji = identity.Emoji },
+		func(p *Profile) { p.Avatar = identity.Avatar },
+		func(p *Profile) { p.Color = identity.Color },
+	}
+	for _, claim := range claims {
+		candidate := profile
+		claim(&candidate)
+		if candidate.normalize() == nil {
+			profile = candidate
+		}
+	}
+	return profile
+}
+
+func randomEmoji() string {
+	return emojis[rand.Intn(len(emojis))]
+}
+
+// Profile returns the profile of this user
+func (u *User) Profile() Profile {
+	u.stateLock.RLock()
+	defer u.stateLock.RUnlock()
+	return u.profile
+}
+
+// SetProfile replaces the profile of this user, its fields are trimmed. Every user has an emoji,
+// an empty one is replaced by a random one.
+func (u *User) SetProfile(profile Profile) error {
+	if strings.TrimSpace(profile.Emoji) == "" {
+		profile.Emoji = randomEmoji()
+	}
+	if err := profile.normalize(); err != nil {
+		return err
+	}
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	u.profile = profile
+	return nil
+}
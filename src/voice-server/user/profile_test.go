@@ -0,0 +1,150 @@
+package user
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		want  bool
+	}{
+		{emoji: "🎤", want: true},
+		{emoji: "❤️", want: true},
+		{emoji: "👍🏽", want: true},
+		{emoji: "👩\u200d🎤", want: true},
+		{emoji: "👨\u200d👩\u200d👧\u200d👦", want: true},
+		{emoji: "", want: false},
+		{emoji: "a", want: false},
+		{emoji: "🎤a", want: false},
+		{emoji: "\u200d\ufe0f", want: false},
+		{emoji: strings.Repeat("🎤", maxEmojiLength+1), want: false},
+		{emoji: "\xff", want: false},
+	}
+	for _, test := range tests {
+		if got := validEmoji(test.emoji); got != test.want {
+			t.Errorf("validEmoji(%q) = %v, want %v", test.emoji, got, test.want)
+		}
+	}
+}
+
+func TestProfileNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile Profile
+		want    Profile
+		wantErr error
+	}{
+		{
+			name:    "trimmed",
+			profile: Profile{Name: " Alice ", Emoji: " 🎤 ", Avatar: " https://example.com/a.png ", Color: " #FF8800 "},
+			want:    Profile{Name: "Alice", Emoji: "🎤", Avatar: "https://example.com/a.png", Color: "#ff8800"},
+		},
+		{name: "short color", profile: Profile{Emoji: "🎤", Color: "#f80"}, want: Profile{Emoji: "🎤", Color: "#f80"}},
+		{
+			name:    "longest name",
+			profile: Profile{Name: strings.Repeat("é", maxNameLength), Emoji: "🎤"},
+			want:    Profile{Name: strings.Repeat("é", maxNameLength), Emoji: "🎤"},
+		},
+		{name: "name too long", profile: Profile{Name: strings.Repeat("é", maxNameLength+1), Emoji: "🎤"}, wantErr: ErrInvalidName},
+		{name: "control character in the name", profile: Profile{Name: "Al\nice", Emoji: "🎤"}, wantErr: ErrInvalidName},
+		{name: "no emoji", profile: Profile{Name: "Alice"}, wantErr: ErrInvalidEmoji},
+		{name: "text as emoji", profile: Profile{Emoji: ":)"}, wantErr: ErrInvalidEmoji},
+		{name: "avatar without scheme", profile: Profile{Emoji: "🎤", Avatar: "example.com/a.png"}, wantErr: ErrInvalidAvatar},
+		{name: "avatar of another scheme", profile: Profile{Emoji: "🎤", Avatar: "javascript:alert(1)"}, wantErr: ErrInvalidAvatar},
+		{name: "color name", profile: Profile{Emoji: "🎤", Color: "orange"}, wantErr: ErrInvalidColor},
+		{name: "color without hash", profile: Profile{Emoji: "🎤", Color: "ff8800"}, wantErr: ErrInvalidColor},
+		{name: "color of four digits", profile: Profile{Emoji: "🎤", Color: "#ff88"}, wantErr: ErrInvalidColor},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := test.profile
+			err := profile.normalize()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("normalize() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && profile != test.want {
+				t.Errorf("normalize() = %+v, want %+v", profile, test.want)
+			}
+		})
+	}
+}
+
+func TestProfileOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity auth.Identity
+		want     Profile // a random emoji is expected if Emoji is empty
+	}{
+		{
+			name:     "claims",
+			identity: auth.Identity{Name: "Alice", Emoji: "🎸", Avatar: "https://example.com/a.png", Color: "#123"},
+			want:     Profile{Name: "Alice", Emoji: "🎸", Avatar: "https://example.com/a.png", Color: "#123"},
+		},
+		{name: "no claims", identity: auth.Identity{}},
+		{
+			name:     "invalid claims are ignored",
+			identity: auth.Identity{Name: strings.Repeat("a", maxNameLength+1), Emoji: "a", Avatar: "ftp://example.com", Color: "#12"},
+		},
+		{
+			name:     "valid claims are kept along with invalid ones",
+			identity: auth.Identity{Name: "Alice", Emoji: "a", Color: "#ABC"},
+			want:     Profile{Name: "Alice", Color: "#abc"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := profileOf(&test.identity)
+			want := test.want
+			if want.Emoji == "" {
+				if !validEmoji(profile.Emoji) {
+					t.Errorf("profileOf() emoji = %q, want a random one", profile.Emoji)
+				}
+				want.Emoji = profile.Emoji
+			}
+			if profile != want {
+				t.Errorf("profileOf() = %+v, want %+v", profile, want)
+			}
+		})
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile Profile
+		want    Profile // a random emoji is expected if Emoji is empty
+		wantErr error
+	}{
+		{name: "emoji", profile: Profile{Name: "Alice", Emoji: "🎸"}, want: Profile{Name: "Alice", Emoji: "🎸"}},
+		{name: "emoji cleared", profile: Profile{Name: "Alice"}, want: Profile{Name: "Alice"}},
+		{name: "blank emoji", profile: Profile{Name: "Alice", Emoji: " "}, want: Profile{Name: "Alice"}},
+		{name: "invalid", profile: Profile{Name: "Alice", Emoji: "a"}, wantErr: ErrInvalidEmoji},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := &User{profile: Profile{Name: "Bob", Emoji: "🎤"}}
+			err := u.SetProfile(test.profile)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("SetProfile() error = %v, want %v", err, test.wantErr)
+			}
+			want := test.want
+			if err != nil {
+				// The profile is left as it was
+				want = Profile{Name: "Bob", Emoji: "🎤"}
+			} else if want.Emoji == "" {
+				if !validEmoji(u.Profile().Emoji) {
+					t.Errorf("emoji = %q, want a random one", u.Profile().Emoji)
+				}
+				want.Emoji = u.Profile().Emoji
+			}
+			if got := u.Profile(); got != want {
+				t.Errorf("profile = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package user
 
 import (
 	"errors"
+	"time"
 
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
 	"github.com/pion/webrtc/v3"
@@ -55,3 +56,30 @@ func (u *User) SendEvent(event *socket.OutboundEvent) error {
 	}
 	return nil
 }
+
+// SendError sends the given error to this user
+func (u *User) SendError(err error) error {
+	return u.ws.SendError(err)
+}
+
+// Disconnect closes the websocket of this user, the close frame carries the given code and reason.
+// Their peer connection is then closed and they leave their room, as if they hung up.
+func (u *User) Disconnect(code int, reason string) {
+	u.ws.Close(code, reason)
+}
+
+// SendPing sends the current time, which the client echoes in a pong event to measure the round trip time
+func (u *User) SendPing() error {
+	return u.SendEvent(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "ping"},
+		Time:      float64(time.Now().UnixMicro()) / 1e6,
+	})
+}
+
+// SendTimeSync asks the client for its clock, its response is handled as a time_sync event
+func (u *User) SendTimeSync() error {
+	return u.SendEvent(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "time_sync"},
+		TimeSync:  &socket.TimeSyncWrap{Origin: socket.UnixMillis(time.Now())},
+	})
+}
@@ -0,0 +1,78 @@
+package user
+
+// Role is what a user may do in their room
+type Role string
+
+const (
+	// RoleHost moderates the room from the stage
+	RoleHost Role = "host"
+	// RoleSinger is on stage, their mic is heard by the room
+	RoleSinger Role = "singer"
+	// RoleAudience listens, and may raise their hand to get on stage
+	RoleAudience Role = "audience"
+)
+
+// Role returns the role of this user in their room
+func (u *User) Role() Role {
+	u.stateLock.RLock()
+	defer u.stateLock.RUnlock()
+	return u.role
+}
+
+// SetRole changes the role of this user, users getting on stage lower their hand
+func (u *User) SetRole(role Role) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	u.role = role
+	if role != RoleAudience {
+		u.handRaised = false
+	}
+}
+
+// OnStage tells whether the mic of this user is heard by the room
+func (u *User) OnStage() bool {
+	role := u.Role()
+	return role == RoleHost || role == RoleSinger
+}
+
+// HandRaised tells whether this user asked to get on stage
+func (u *User) HandRaised() bool {
+	u.stateLock.RLock()
+	defer u.stateLock.RUnlock()
+	return u.handRaised
+}
+
+// SetHandRaised raises or lowers the hand of this user
+func (u *User) SetHandRaised(raised bool) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	u.handRaised = raised
+}
+
+// Muted tells whether the mic of this user is silenced by the server
+func (u *User) Muted() bool {
+	u.stateLock.RLock()
+	defer u.stateLock.RUnlock()
+	return u.muted
+}
+
+// SetMuted mutes or unmutes the mic of this user
+func (u *User) SetMuted(muted bool) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	u.muted = muted
+}
+
+// MuteLocked tells whether this user was muted by the host, and can't unmute themselves
+func (u *User) MuteLocked() bool {
+	u.stateLock.RLock()
+	defer u.stateLock.RUnlock()
+	return u.muteLocked
+}
+
+// SetMuteLocked prevents this user from unmuting themselves, or lets them again
+func (u *User) SetMuteLocked(locked bool) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	u.muteLocked = locked
+}
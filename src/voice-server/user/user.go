@@ -5,10 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
-	"strconv"
+	"sync"
 	"time"
 
+	"github.com/Nahemah1022/singsphere-voice-server/pkg/auth"
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/rtc"
 	"github.com/Nahemah1022/singsphere-voice-server/pkg/socket"
 	"github.com/pion/webrtc/v3"
@@ -16,14 +16,23 @@ import (
 
 type User struct {
 	ID                string
-	Emoji             string
-	Mute              bool
 	ws                *socket.Websocket
 	rtc               *rtc.RtcNode
 	joinCh            chan *User
 	leaveCh           chan *User
+	requestCh         chan *Request
 	MicReadyCtx       context.Context
 	micReadyCtxCancel context.CancelFunc
+	musicSender       *webrtc.RTPSender // sends the backing track, or the room mix
+	latencyLock       sync.Mutex
+	pingRTT           time.Duration         // round trip time of websocket pings, 0 until measured
+	clock             socket.ClockEstimator // offset and drift of the client's clock from time_sync exchanges
+	stateLock         sync.RWMutex          // guards the profile, the role, the hand and the mute of the user
+	profile           Profile
+	role              Role
+	handRaised        bool
+	muted             bool
+	muteLocked        bool // muted by the host
 }
 
 var emojis = []string{
@@ -31,24 +40,47 @@ var emojis = []string{
 	"👽", "👨‍🚀", "🐺", "🐯", "🦁", "🐶", "🐼", "🙈",
 }
 
-var errNotImplemented = errors.New("not implemented")
+const (
+	// Period of the ping events measuring the round trip time over the websocket
+	pingPeriod = 5 * time.Second
+	// A burst of time_sync exchanges gives a first clock estimate quickly, later ones follow the drift
+	timeSyncBurst       = 5
+	timeSyncBurstPeriod = 500 * time.Millisecond
+	timeSyncPeriod      = 15 * time.Second
+)
+
+// Request carries an inbound event that should be handled by the user's room
+type Request struct {
+	User  *User
+	Event *socket.InboundEvent
+}
 
 func (u *User) Wrap() *socket.UserWrap {
+	profile := u.Profile()
 	return &socket.UserWrap{
-		ID:    u.ID,
-		Emoji: u.Emoji,
-		Mute:  u.Mute,
+		ID:         u.ID,
+		Name:       profile.Name,
+		Avatar:     profile.Avatar,
+		Emoji:      profile.Emoji,
+		Color:      profile.Color,
+		Mute:       u.Muted(),
+		Role:       string(u.Role()),
+		HandRaised: u.HandRaised(),
+		MuteLocked: u.MuteLocked(),
 	}
 }
 
-func New(joinCh chan *User, leaveCh chan *User, ws *socket.Websocket, rtcNode *rtc.RtcNode) *User {
+// New creates a user with the given identity
+func New(joinCh chan *User, leaveCh chan *User, requestCh chan *Request, ws *socket.Websocket, rtcNode *rtc.RtcNode, identity *auth.Identity) *User {
 	ctx, ctxCancel := context.WithCancel(context.TODO())
 	return &User{
-		ID:                strconv.FormatInt(time.Now().UnixNano(), 10), // generate random id based on timestamp
-		Mute:              true,
-		Emoji:             emojis[rand.Intn(len(emojis))],
+		ID:                identity.ID,
+		profile:           profileOf(identity),
+		muted:             true, // clients join with their mic muted
+		role:              RoleAudience,
 		joinCh:            joinCh,
 		leaveCh:           leaveCh,
+		requestCh:         requestCh,
 		ws:                ws,
 		rtc:               rtcNode,
 		MicReadyCtx:       ctx,
@@ -61,6 +93,11 @@ func (u *User) Run() {
 		u.rtc.Ternimate()
 		u.leaveCh <- u
 	}()
+	pingTicker := time.NewTicker(pingPeriod)
+	defer pingTicker.Stop()
+	timeSyncTicker := time.NewTicker(timeSyncBurstPeriod)
+	defer timeSyncTicker.Stop()
+	timeSyncs := 0
 	wsClose := make(chan struct{})
 	go u.ws.Run(wsClose)
 	go func() {
@@ -89,6 +126,13 @@ func (u *User) Run() {
 			}
 		case <-u.rtc.ICEDisconnectedCtx.Done():
 			return
+		case <-pingTicker.C:
+			u.SendPing()
+		case <-timeSyncTicker.C:
+			u.SendTimeSync()
+			if timeSyncs++; timeSyncs == timeSyncBurst {
+				timeSyncTicker.Reset(timeSyncPeriod)
+			}
 		}
 	}
 }
@@ -123,12 +167,15 @@ func (u *User) handleInboundEvent(event *socket.InboundEvent) error {
 			return u.ws.SendError(errors.New("fail to add candidate"))
 		}
 		return nil
-	} else if event.Type == "mute" {
-		return nil
-	} else if event.Type == "unmute" {
+	} else if event.Type == "time_sync" {
+		return u.handleTimeSync(event)
+	} else if event.Type == "pong" {
+		u.handlePong(event.Time)
 		return nil
 	}
-	return u.ws.SendError(errNotImplemented)
+	// Other events concern the whole room, so they are handled by the room
+	u.requestCh <- &Request{User: u, Event: event}
+	return nil
 }
 
 // GetMicTrack return user's mic track or error if haven't attached yet
@@ -158,6 +205,104 @@ func (u *User) AcceptMicTrack(tr *webrtc.TrackRemote) error {
 	return nil
 }
 
+// AcceptMusicTrack attaches the given room music track to user's peer connection instance
+func (u *User) AcceptMusicTrack(track *webrtc.TrackLocalStaticSample) error {
+	sender, err := u.rtc.AddTrackSample(track)
+	if err != nil {
+		return err
+	}
+	u.musicSender = sender
+	// Receiver reports about the music tell the round trip time to the client
+	go u.rtc.WatchRTCP(sender)
+	return nil
+}
+
+// AcceptMixTrack attaches the track carrying the room mixed for this user, in rooms mixing on the server
+func (u *User) AcceptMixTrack(track *webrtc.TrackLocalStaticSample) error {
+	return u.AcceptMusicTrack(track)
+}
+
+// SwitchMusicTrack replaces the music track sent to this user without renegotiating
+func (u *User) SwitchMusicTrack(track *webrtc.TrackLocalStaticSample) error {
+	if u.musicSender == nil {
+		return errors.New("music track haven't attached yet")
+	}
+	if u.musicSender.Track() == track {
+		return nil
+	}
+	return u.musicSender.ReplaceTrack(track)
+}
+
+// RTT returns the round trip time to the client, measured with RTCP if possible or with websocket pings
+func (u *User) RTT() time.Duration {
+	if rtt := u.rtc.RTT(); rtt > 0 {
+		return rtt
+	}
+	u.latencyLock.Lock()
+	defer u.latencyLock.Unlock()
+	return u.pingRTT
+}
+
+// handleTimeSync answers the client's time_sync requests, and estimates the client's clock from its responses
+func (u *User) handleTimeSync(event *socket.InboundEvent) error {
+	ts := event.TimeSync
+	if ts == nil || ts.Origin == 0 {
+		return u.ws.SendError(errors.New("empty time sync"))
+	}
+	if ts.IsResponse() {
+		u.clock.Add(
+			socket.FromUnixMillis(ts.Origin),
+			socket.FromUnixMillis(ts.Receive),
+			socket.FromUnixMillis(ts.Transmit),
+			event.ReceivedAt,
+		)
+		return nil
+	}
+	return u.SendEvent(&socket.OutboundEvent{
+		EventBase: socket.EventBase{Type: "time_sync"},
+		TimeSync: &socket.TimeSyncWrap{
+			Origin:   ts.Origin,
+			Receive:  socket.UnixMillis(event.ReceivedAt),
+			Transmit: socket.UnixMillis(time.Now()),
+		},
+	})
+}
+
+// ClientTime converts a server time to the client's clock, and tells whether the client's clock is known
+func (u *User) ClientTime(t time.Time) (time.Time, bool) {
+	return u.clock.ToRemote(t)
+}
+
+// MicCaptureTime converts an RTP timestamp of the mic to when the audio was captured, by the server's clock.
+// It returns false until both a sender report and the client's clock are known.
+func (u *User) MicCaptureTime(timestamp uint32) (time.Time, bool) {
+	captured, ok := u.rtc.MicCaptureTime(timestamp)
+	if !ok {
+		return time.Time{}, false
+	}
+	offset, ok := u.clock.Offset(time.Now())
+	if !ok {
+		return time.Time{}, false
+	}
+	return captured.Add(-offset), true
+}
+
+// ClockDrift returns how fast the client's clock runs compared to the server's, in parts per million
+func (u *User) ClockDrift() float64 {
+	return u.clock.Drift()
+}
+
+// handlePong measures the round trip time of the ping sent at the given unix time in seconds
+func (u *User) handlePong(sentAt float64) {
+	rtt := time.Since(time.UnixMicro(int64(sentAt * 1e6)))
+	if rtt < 0 || rtt > pingPeriod {
+		return
+	}
+	u.latencyLock.Lock()
+	u.pingRTT = rtt
+	u.latencyLock.Unlock()
+}
+
 // RemoveSender makes this user stop listening the track with given ssrc
 func (u *User) RemoveSender(ssrc webrtc.SSRC) error {
 	if err := u.rtc.RemoveTrack(ssrc); err != nil {